@@ -0,0 +1,1351 @@
+// Package config parses the options of kqm from the command line
+// arguments, the KQM_* environment variables and a config file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/activesphere/kqm/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+// Usage : Usage text of kqm, printed with --help and on invalid options.
+var Usage = `
+kqm [OPTIONS] host:port [host:port]...
+
+KQM is a command line tool to monitor Apache Kafka for lags.
+It also comes with an option to send the lag statistics to Statsd.
+IPv6 broker addresses are bracketed, e.g. [::1]:9092.
+
+Option               Description
+------               -----------
+--statsd-addr        Use this option if you need to send
+                     the lag statistics to Statsd. Repeat
+                     it to send the statistics to several
+                     Statsd instances.
+                     Default: localhost:8125
+
+--statsd-prefix      Set a prefix for the data being sent
+                     to Statsd.
+                     Default: kqm
+
+--statsd-rate        Maximum number of gauges sent to each
+                     Statsd instance per second. The gauges
+                     are queued and sent by a single
+                     sender, and dropped while the queue,
+                     holding the gauges sent at this rate
+                     within an interval, is full. The
+                     number dropped is logged once per
+                     interval.
+                     Default: 0 (unlimited)
+
+--statsd-flush-interval
+                     Buffer the gauges and send them to
+                     Statsd in batches every interval (in
+                     milliseconds), and once more on
+                     shutdown. A gauge sent several times
+                     within an interval is sent with its
+                     last value. Can't be combined with
+                     --statsd-rate.
+                     Default: 0 (unbuffered)
+
+--statsd-sample-rate Rate (greater than 0, at most 1) the
+                     per partition lag gauges are sampled
+                     at, to reduce the load on Statsd. A
+                     sampled gauge keeps its last sent
+                     value until the next sample, so the
+                     lags of a partition are updated less
+                     often and may lag behind. Can't be
+                     combined with --statsd-flush-interval.
+                     Default: 1 (every gauge sent)
+
+--interval           Specify the interval of calculating
+                     the lag statistics (in seconds).
+                     Default: 60 seconds
+
+--emit-assigned      Send a zero lag for the partitions
+                     assigned to a consumer group that have
+                     no committed offset yet, so that every
+                     assigned partition reports a value.
+                     Default: false
+
+--resolve-brokers    Resolve the broker addresses again and
+                     rebuild the Kafka client when none of
+                     the brokers are reachable, e.g. when
+                     broker IPs change behind a stable DNS
+                     name.
+                     Default: false
+
+--allow-negative-lag Send the raw lag even when it is
+                     negative, i.e. the consumer offset is
+                     ahead of the broker offset, instead of
+                     leaving out the partition gauge. Useful
+                     for debugging offset inversions.
+                     Default: false
+
+--allowlist-url      Fetch the topics to be monitored from
+                     this URL before the first cycle and
+                     after every interval. The response
+                     must be a JSON list of topic names or
+                     "topic:partition" entries. On failure,
+                     the last known list is kept.
+                     Default: all topics are monitored
+
+--file-output, --output-file
+                     Append the lag of every cycle to the
+                     file at this path. Each row has the
+                     timestamp, group, topic, partition,
+                     broker offset, consumer offset and
+                     lag. The rows are JSON lines with
+                     --output-file, unless --file-format is
+                     set.
+                     Default: disabled
+
+--file-format        Format of the file output: csv, or
+                     json for one JSON object per line with
+                     the ts, group, topic, partition,
+                     broker_offset, consumer_offset and lag
+                     keys.
+                     Default: csv, or json with --output-file
+
+--file-max-size, --output-max-size
+                     Rotate the file output once it grows
+                     beyond this size (in MB).
+                     Default: 100 MB
+
+--report-granularity Comma-separated list of the levels at
+                     which the lag is sent to Statsd:
+                     partition, topic (sum over the
+                     partitions of a topic for a group) and
+                     group (sum over all the topics of a
+                     group).
+                     Default: partition
+
+--detect-paused      Send a suspected_paused gauge per
+                     partition, which is 1 when the broker
+                     offset keeps moving while the group
+                     has not committed for this many
+                     seconds even though the partition is
+                     assigned to a member of the group.
+                     Default: 0 (disabled)
+
+--max-broker-concurrency, --fetch-concurrency
+                     Maximum number of brokers queried for
+                     their offsets at the same time in a
+                     cycle, i.e. the size of the pool of
+                     workers sending the offset requests.
+                     Default: 50
+
+--fetch-timeout      Maximum time (in seconds) to wait for
+                     the offsets of a broker in a cycle. A
+                     broker that doesn't answer in time
+                     fails the cycle, like any failed
+                     offset request. 0 waits for as long as
+                     the connection allows.
+                     Default: 30 seconds
+
+--fetch-bytes        Number of bytes requested at once from
+                     each __consumer_offsets partition. It
+                     is doubled for a message that doesn't
+                     fit, up to --fetch-max-bytes.
+                     Default: 32768
+
+--fetch-max-bytes    Maximum number of bytes requested at
+                     once from each __consumer_offsets
+                     partition. A message larger than this
+                     is skipped and counted in the consumer
+                     errors. 0 means no limit.
+                     Default: 0
+
+--consumer-max-wait  Maximum time (in milliseconds) the
+                     brokers wait for new messages before
+                     answering a fetch request of the
+                     __consumer_offsets consumer.
+                     Default: 250 ms
+
+--read-timeout       Maximum time (in seconds) to wait for
+                     a response from a broker, after which
+                     the connection is closed and the
+                     request fails.
+                     Default: 30 seconds
+
+--metadata-refresh   Interval (in seconds) of the
+                     background refresh of the cluster
+                     metadata, which holds the partition
+                     leaders. Lower it on clusters with
+                     frequent partition reassignments.
+                     Default: 600 seconds
+
+--metadata-retries   Number of retries of a failed metadata
+                     request.
+                     Default: 3
+
+--offset-source      Source of the consumer offsets: topic
+                     parses the commits on the
+                     __consumer_offsets topic, admin
+                     fetches the committed offsets of every
+                     consumer group from its coordinator
+                     after every interval.
+                     Default: topic
+
+--lag-smoothing-alpha
+                     Smooth the partition lag sent to
+                     Statsd with an exponentially weighted
+                     moving average using this factor
+                     (between 0 and 1). The raw lag is sent
+                     with a .raw suffix. Note that
+                     smoothing delays the reported lag: the
+                     smaller the factor, the longer a
+                     change in lag takes to show up.
+                     Default: 0 (disabled)
+
+--api-addr           Serve the HTTP API on this address
+                     (eg. localhost:8080). GET /status
+                     returns a JSON report of the Kafka
+                     client, the offsets consumer, the last
+                     broker offsets cycle and the
+                     reporters, with status 503 when any of
+                     them is unhealthy. GET /lag returns
+                     the current lag of every partition,
+                     optionally filtered with ?group=.
+                     GET /healthz and GET /readyz serve
+                     the liveness and readiness probes; the
+                     monitor is ready once a cycle has
+                     succeeded with a consumer offset seen.
+                     /healthz returns a JSON object with
+                     the version, commit and build date.
+                     Default: disabled
+
+--offset-format      Parser used for the messages on the
+                     __consumer_offsets topic: burrow, or
+                     modern which reads the value according
+                     to its schema version (0 to 3) and
+                     rejects unknown versions.
+                     Default: burrow
+
+--client-id          Client ID sent to the brokers with
+                     every request, which identifies KQM in
+                     the broker request logs and metrics.
+                     Default: kqm
+
+--offsets-retention  Offsets retention of the brokers
+                     (offsets.retention.minutes, in
+                     minutes). When set, the time left
+                     before the committed offsets of each
+                     group expire is sent as
+                     retention_risk_seconds, and a warning
+                     is logged when less than a tenth of
+                     the retention is left.
+                     Default: 0 (disabled)
+
+--tag                Attach a static key=value tag to every
+                     gauge sent to Statsd, in the DogStatsD
+                     format. It is also added as a label
+                     of the Prometheus metrics and as a
+                     resource attribute of the OTLP
+                     metrics. Can be specified multiple
+                     times, e.g. --tag region=us-east --tag
+                     env=prod.
+                     Default: no tags
+
+--shard-index, --instance-id
+                     Index of this instance among the
+                     shards consuming the
+                     __consumer_offsets topic. An instance
+                     consumes the partitions whose number
+                     modulo the shard count equals its
+                     index, so that replicas of KQM split
+                     the work, e.g. --instance-id 1
+                     --shard-count 2 on the second of two.
+                     Default: 0
+
+--shard-count        Number of shards consuming the
+                     __consumer_offsets topic. KQM fails at
+                     startup if there are more shards than
+                     partitions.
+                     Default: 1 (no sharding)
+
+--close-brokers-per-cycle
+                     Fetch the offsets of the leader
+                     brokers on connections opened for the
+                     cycle and closed after it, instead of
+                     keeping them open. Lowers the number
+                     of open sockets on large clusters at
+                     the cost of reconnecting every cycle.
+                     The connections of the Kafka client
+                     used for the metadata are kept open.
+                     Default: false
+
+--openmetrics-topic  Produce a snapshot of the lags to this
+                     Kafka topic after every interval, as
+                     one message without a key. The value
+                     holds a kqm_consumer_lag gauge with
+                     the group, topic and partition labels
+                     in the OpenMetrics text format,
+                     timestamped in seconds with the time
+                     of the cycle.
+                     Default: disabled
+
+--report-coordinators
+                     Send the ID of the coordinator broker
+                     of each consumer group as a gauge
+                     after every interval. The coordinators
+                     are also served by the API at GET
+                     /coordinators.
+                     Default: false
+
+--broker-offset-max-age
+                     Maximum age (in seconds) of a broker
+                     offset used for the lag when fetching
+                     it fails. Beyond it, the broker offset
+                     is treated as unknown and no lag is
+                     sent for the partition. With 0, a
+                     failed fetch fails the whole cycle.
+                     Default: 0
+
+--sasl               Authenticate with the brokers using
+                     SASL/PLAIN. Requires --sasl-user and
+                     --sasl-password.
+                     Default: false
+
+--sasl-user          User for the SASL/PLAIN
+                     authentication.
+
+--sasl-password      Password for the SASL/PLAIN
+                     authentication.
+
+--tls                Connect to the brokers over TLS.
+                     Default: false
+
+--tls-ca             PEM file of the CA used to verify the
+                     brokers. The system roots are used
+                     when not given.
+
+--tls-cert           PEM file of the client certificate
+                     presented to the brokers.
+
+--tls-key            PEM file of the key of the client
+                     certificate.
+
+--tls-skip-verify    Don't verify the certificates of the
+                     brokers, e.g. self-signed certificates
+                     in staging. Insecure, not for
+                     production.
+                     Default: false
+
+--prometheus-addr    Serve the lags on /metrics of this
+                     address (e.g. :9308) to be scraped by
+                     Prometheus, in addition to Statsd.
+                     Default: disabled
+
+--prometheus-buckets Comma separated upper bounds of the
+                     buckets of a kqm_consumer_lag_messages
+                     histogram of the lags of every cycle,
+                     served with --prometheus-addr (e.g.
+                     10,100,1000).
+                     Default: disabled
+
+--offset-start       Position of the __consumer_offsets
+                     topic the consumption starts from:
+                     oldest replays the committed offsets
+                     so that idle groups are reported, at
+                     the cost of reading the whole topic at
+                     startup; newest only sees the commits
+                     made after starting. A reconnect
+                     resumes from the last consumed offset.
+                     Default: oldest
+
+--retry-interval     Interval (in seconds) to wait for
+                     before retrying a failed cycle.
+                     Default: the interval
+
+--max-retries        Number of times a failed cycle is
+                     retried before it is skipped. 0
+                     retries until the cycle succeeds.
+                     Default: 0
+
+--config             JSON or YAML (.yaml, .yml) file
+                     mapping the option names (without the
+                     leading dashes) to their values, with
+                     the brokers under the brokers key. The
+                     options passed on the command line
+                     take precedence.
+                     Default: none
+
+--group-whitelist    Only monitor the consumer groups
+                     matching this regex. Takes precedence
+                     over --group-blacklist.
+                     Default: all groups
+
+--group-blacklist    Don't monitor the consumer groups
+                     matching this regex.
+                     Default: none
+
+--topic-whitelist    Only monitor the topics matching this
+                     regex. Takes precedence over --topic-
+                     blacklist.
+                     Default: all topics
+
+--topic-blacklist    Don't monitor the topics matching this
+                     regex, e.g. ^__ for the internal
+                     topics.
+                     Default: none
+
+--partitions         Only monitor these partition ranges of
+                     the topics, given as a comma-separated
+                     list of topic:first-last or
+                     topic:partition, e.g.
+                     orders:0-3,payments:5. The topics not
+                     listed are monitored at all their
+                     partitions.
+                     Default: all partitions
+
+--time-lag           Also send the lag in seconds of each
+                     group at each partition, the
+                     difference between the timestamps of
+                     the latest message and of the message
+                     at the committed offset. Requires
+                     message timestamps (Kafka 0.10+). The
+                     latest message of each lagging
+                     partition and the message at each
+                     committed offset are fetched from the
+                     leaders, up to --max-broker-
+                     concurrency at a time, and cached:
+                     each cycle fetches the messages at the
+                     offsets that moved since the previous
+                     one, i.e. up to one per lagging group
+                     and partition plus one per lagging
+                     partition.
+                     Default: false
+
+--commit-age         Also send the time in seconds since
+                     each group last committed an offset at
+                     each partition, as commit_age_seconds.
+                     Commits without a timestamp are
+                     skipped.
+                     Default: false
+
+--partition-counts   Also send the number of partitions of
+                     each monitored topic as
+                     topic.<topic>.partition_count, and log
+                     the topics whose partition count
+                     changed. New partitions aren't
+                     monitored until a group commits to
+                     them, unless the topic is listed in
+                     --topics.
+                     Default: false
+
+--track-log-start    Also request the log start (oldest)
+                     offset of each partition, and send it
+                     as
+                     topic.<topic>.<partition>.log_start,
+                     to spot partitions whose retention
+                     deletes messages before they are
+                     consumed.
+                     Default: false
+
+--statsd-format      Format of the per partition metrics:
+                     statsd for dotted names from the
+                     metric template, or dogstatsd for
+                     <prefix>.consumer.lag with the group,
+                     topic and partition sent as DogStatsD
+                     tags.
+                     Default: statsd
+
+--metric-template    Template of the names of the per
+                     partition metrics, with the {prefix},
+                     {group}, {topic} and {partition}
+                     placeholders. Suffixes such as .raw
+                     are appended to the rendered name.
+                     Default: {prefix}.group.{group}.{topic}.{partition}
+
+--log-format         Format of the log lines: text, or json
+                     for one JSON object per line.
+                     Default: text
+
+--stale-timeout      Stop reporting the lag of a group at a
+                     partition when it hasn't committed to
+                     it for this many minutes (e.g. 10), so
+                     that deleted groups are dropped. Idle
+                     and stuck groups that don't commit are
+                     dropped as well, although the
+                     retention risk of their offsets is
+                     still reported.
+                     Default: 0 (disabled)
+
+--dry-run            Print the gauges to stdout instead of
+                     sending them to Statsd, which doesn't
+                     need to be reachable.
+                     Default: false
+
+--cloudwatch-namespace
+                     Send the lags to CloudWatch as a
+                     ConsumerLag metric in this namespace,
+                     dimensioned by Group, Topic and
+                     Partition. The credentials are read
+                     from the AWS_ACCESS_KEY_ID,
+                     AWS_SECRET_ACCESS_KEY and
+                     AWS_SESSION_TOKEN environment
+                     variables, or else from the role of
+                     the ECS task or of the EC2 instance.
+                     Default: disabled
+
+--cloudwatch-region  AWS region of CloudWatch.
+                     Default: $AWS_REGION
+
+--cloudwatch-dimension
+                     Dimension of the form name=value added
+                     to every CloudWatch metric. Can be
+                     repeated.
+                     Default: none
+
+--kafka-version      Version of the Kafka protocol used
+                     with the brokers, e.g. 0.10.2.0, which
+                     enables the requests of newer brokers.
+                     One of 0.8.2.0 to 0.10.2.0.
+                     Default: the sarama default (0.8.2.0)
+
+--report-missing     Send a missing_commit gauge of 1 for
+                     each group that has committed to some
+                     partitions of a topic but not to a
+                     partition with a broker offset, which
+                     catches new or stuck consumers. The
+                     broker offsets of all the partitions
+                     of the monitored topics are fetched.
+                     Default: false
+
+--topics             Comma-separated list of topics whose
+                     broker offsets are fetched from the
+                     first cycle, before any group commits
+                     to them, so that their offset gauges
+                     are sent right away. The lags still
+                     need a committed offset.
+                     Default: none
+
+--max-reconnect-backoff
+                     Maximum wait (in seconds) between the
+                     attempts to reach the brokers, at
+                     startup and when none of them are
+                     reachable. The wait starts at a second
+                     and doubles after every attempt, with
+                     a random half to spread out the
+                     reconnects.
+                     Default: 120 seconds
+
+--lag-threshold      Send a level gauge per partition, 0
+                     when the lag is below the warn lag, 1
+                     from the warn lag and 2 from the crit
+                     lag. Given as topic:warn:crit, or
+                     warn:crit for the topics without their
+                     own threshold. Can be repeated, e.g.
+                     --lag-threshold 1000:10000 --lag-
+                     threshold orders:100:1000.
+                     Default: none
+
+--once               Run a single cycle and exit, with a
+                     non-zero status if it fails, e.g. for
+                     cron jobs. The __consumer_offsets
+                     topic is read up to its latest offsets
+                     first.
+                     Default: false
+
+--once-timeout       Maximum time (in seconds) spent
+                     reading the __consumer_offsets topic
+                     with --once before running the cycle
+                     with the offsets read so far.
+                     Default: 60 seconds
+
+--list-groups        Print the consumer groups found, each
+                     followed by the topics it committed
+                     offsets for, and exit without sending
+                     anything. The __consumer_offsets topic
+                     is read up to its latest offsets, for
+                     at most --once-timeout.
+                     Default: false
+
+--otlp-endpoint      Push the lags to this OpenTelemetry
+                     collector (e.g. http://localhost:4318)
+                     after every interval, as a
+                     consumer.lag gauge with the group,
+                     topic and partition attributes, using
+                     OTLP over HTTP with JSON.
+                     Default: disabled
+
+--graphite-addr      Write the lags to this Graphite
+                     address (host:port) after every
+                     interval, with the plaintext protocol
+                     over TCP, as lines of the form
+                     <prefix>.group.<group>.<topic>.<partition>.lag
+                     with the whitespace in the names
+                     replaced by underscores.
+                     Default: disabled
+
+--graphite-prefix    Prefix of the metrics written to
+                     Graphite.
+                     Default: kqm
+
+--alert-webhook-url  POST a JSON alert to this URL when the
+                     lag of a group at a partition goes
+                     above --alert-threshold, with the
+                     group, topic, partition, lag,
+                     threshold and ts fields. The alerts of
+                     a cycle are posted together, as a JSON
+                     list. A partition is alerted on again
+                     only after its lag went back to the
+                     threshold or below.
+                     Default: disabled
+
+--alert-threshold    Lag (in messages) above which the
+                     alert webhook is called.
+                     Default: 0
+
+--group-rollup       Add up the lags of the consumer groups
+                     matching a regex into a rollup, sent
+                     as <prefix>.rollup.<name>.total. Given
+                     as regex=template, where the template
+                     is expanded with the submatches of the
+                     regex, e.g.
+                     ^(svc-[a-z]+)-[a-z0-9]+$=$1. Can be
+                     repeated; a group belongs to the first
+                     rollup it matches.
+                     Default: none
+
+--rollup-only        Don't send the gauges of the groups
+                     belonging to a rollup, only the rollup
+                     totals.
+                     Default: false
+
+--version            Print the version, git commit and
+                     build date, and exit.
+
+--log-level          Specify the level of severity of the
+                     logger. Levels are as follows:
+                     0 - Panic
+                     1 - Fatal
+                     2 - Error (Default)
+                     3 - Warn
+                     4 - Info
+                     5 - Debug (logs every gauge sent)
+
+Example Command Usage:
+kqm --log-level=5 \
+    --interval=30 \
+    --statsd-addr localhost:8125 \
+    --statsd-prefix prefix_demo \
+    localhost:9092
+`
+
+// stringList : Flag value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// ErrShowVersion : Returned by ParseConfig when --version is passed, before
+// the other arguments are validated.
+var ErrShowVersion = errors.New("Version requested")
+
+// ParseConfig : Parses the command line arguments with the flag set passed
+// as argument. The options missing from the arguments are read from the
+// KQM_* environment variables, and then from the config file, if given.
+func ParseConfig(flags *flag.FlagSet, args []string) (*monitor.QMConfig, error) {
+
+	var (
+		brokers                    []string
+		tags                       stringList
+		cwDimensions               stringList
+		lagThresholds              stringList
+		groupRollups               stringList
+		interval, logLevel         *int
+		retryInterval, maxRetries  *int
+		maxReconnectBackoff        *int
+		pausedAfter                *int
+		maxBrokerConcurrency       *int
+		fetchTimeout               *int
+		fetchBytes, fetchMaxBytes  *int
+		maxWaitTime, readTimeout   *int
+		metadataRefresh            *int
+		metadataRetries            *int
+		offsetsRetention           *int
+		brokerOffsetMaxAge         *int
+		staleTimeout               *int
+		shardIndex, shardCount     *int
+		smoothingAlpha             *float64
+		statsdAddrs                stringList
+		statsdPrefix               *string
+		statsdRate                 *int
+		statsdFlushInterval        *int
+		statsdSampleRate           *float64
+		metricTemplate             *string
+		statsdFormat               *string
+		allowlistURL, apiAddr      *string
+		openMetricsTopic           *string
+		prometheusAddr             *string
+		prometheusBuckets          *string
+		otlpEndpoint               *string
+		graphiteAddr               *string
+		graphitePrefix             *string
+		alertWebhookURL            *string
+		alertThreshold             *int64
+		cwNamespace, cwRegion      *string
+		fileOutput, fileFormat     *string
+		granularity, offsetSource  *string
+		offsetStart                *string
+		offsetFormat, clientID     *string
+		kafkaVersion               *string
+		fileMaxSize                *int64
+		emitAssigned, negativeLag  *bool
+		reportMissing              *bool
+		topics                     *string
+		rollupOnly                 *bool
+		resolveBrokers             *bool
+		closeBrokers, coordinators *bool
+		timeLag                    *bool
+		commitAge                  *bool
+		partitionCounts            *bool
+		trackLogStart              *bool
+		dryRun                     *bool
+		once                       *bool
+		listGroups                 *bool
+		onceTimeout                *int
+		sasl                       *bool
+		saslUser, saslPassword     *string
+		tlsEnabled                 *bool
+		tlsCA, tlsCert, tlsKey     *string
+		tlsSkipVerify              *bool
+		configPath                 *string
+		showVersion                *bool
+		logFormat                  *string
+		groupWhitelist             *string
+		groupBlacklist             *string
+		topicWhitelist             *string
+		topicBlacklist             *string
+		partitions                 *string
+	)
+
+	interval = flags.Int("interval", 60, "")
+	retryInterval = flags.Int("retry-interval", 0, "")
+	maxRetries = flags.Int("max-retries", 0, "")
+	maxReconnectBackoff = flags.Int("max-reconnect-backoff",
+		int(monitor.DefaultMaxReconnectBackoff/time.Second), "")
+	flags.Var(&statsdAddrs, "statsd-addr", "")
+	statsdPrefix = flags.String("statsd-prefix", "kqm", "")
+	statsdRate = flags.Int("statsd-rate", 0, "")
+	statsdFlushInterval = flags.Int("statsd-flush-interval", 0, "")
+	statsdSampleRate = flags.Float64("statsd-sample-rate", 1, "")
+	emitAssigned = flags.Bool("emit-assigned", false, "")
+	reportMissing = flags.Bool("report-missing", false, "")
+	topics = flags.String("topics", "", "")
+	partitions = flags.String("partitions", "", "")
+	negativeLag = flags.Bool("allow-negative-lag", false, "")
+	resolveBrokers = flags.Bool("resolve-brokers", false, "")
+	allowlistURL = flags.String("allowlist-url", "", "")
+	fileOutput = flags.String("file-output", "", "")
+	flags.StringVar(fileOutput, "output-file", "", "")
+	fileFormat = flags.String("file-format", monitor.CSVFileFormat, "")
+	fileMaxSize = flags.Int64("file-max-size", 100, "")
+	flags.Int64Var(fileMaxSize, "output-max-size", 100, "")
+	granularity = flags.String("report-granularity", "partition", "")
+	pausedAfter = flags.Int("detect-paused", 0, "")
+	maxBrokerConcurrency = flags.Int("max-broker-concurrency", 50, "")
+	flags.IntVar(maxBrokerConcurrency, "fetch-concurrency", 50, "")
+	fetchTimeout = flags.Int("fetch-timeout", 30, "")
+	fetchBytes = flags.Int("fetch-bytes", 32768, "")
+	fetchMaxBytes = flags.Int("fetch-max-bytes", 0, "")
+	maxWaitTime = flags.Int("consumer-max-wait", 250, "")
+	readTimeout = flags.Int("read-timeout", 30, "")
+	metadataRefresh = flags.Int("metadata-refresh", 600, "")
+	metadataRetries = flags.Int("metadata-retries", 3, "")
+	offsetSource = flags.String("offset-source", monitor.TopicOffsetSource, "")
+	offsetStart = flags.String("offset-start", monitor.OldestOffsetStart, "")
+	smoothingAlpha = flags.Float64("lag-smoothing-alpha", 0, "")
+	apiAddr = flags.String("api-addr", "", "")
+	offsetFormat = flags.String("offset-format", monitor.BurrowOffsetFormat, "")
+	clientID = flags.String("client-id", "kqm", "")
+	kafkaVersion = flags.String("kafka-version", "", "")
+	offsetsRetention = flags.Int("offsets-retention", 0, "")
+	flags.Var(&tags, "tag", "")
+	shardIndex = flags.Int("shard-index", 0, "")
+	flags.IntVar(shardIndex, "instance-id", 0, "")
+	shardCount = flags.Int("shard-count", 1, "")
+	openMetricsTopic = flags.String("openmetrics-topic", "", "")
+	prometheusAddr = flags.String("prometheus-addr", "", "")
+	prometheusBuckets = flags.String("prometheus-buckets", "", "")
+	otlpEndpoint = flags.String("otlp-endpoint", "", "")
+	graphiteAddr = flags.String("graphite-addr", "", "")
+	graphitePrefix = flags.String("graphite-prefix", "kqm", "")
+	alertWebhookURL = flags.String("alert-webhook-url", "", "")
+	alertThreshold = flags.Int64("alert-threshold", 0, "")
+	closeBrokers = flags.Bool("close-brokers-per-cycle", false, "")
+	coordinators = flags.Bool("report-coordinators", false, "")
+	brokerOffsetMaxAge = flags.Int("broker-offset-max-age", 0, "")
+	sasl = flags.Bool("sasl", false, "")
+	saslUser = flags.String("sasl-user", "", "")
+	saslPassword = flags.String("sasl-password", "", "")
+	tlsEnabled = flags.Bool("tls", false, "")
+	tlsCA = flags.String("tls-ca", "", "")
+	tlsCert = flags.String("tls-cert", "", "")
+	tlsKey = flags.String("tls-key", "", "")
+	tlsSkipVerify = flags.Bool("tls-skip-verify", false, "")
+	groupWhitelist = flags.String("group-whitelist", "", "")
+	groupBlacklist = flags.String("group-blacklist", "", "")
+	topicWhitelist = flags.String("topic-whitelist", "", "")
+	topicBlacklist = flags.String("topic-blacklist", "", "")
+	timeLag = flags.Bool("time-lag", false, "")
+	commitAge = flags.Bool("commit-age", false, "")
+	partitionCounts = flags.Bool("partition-counts", false, "")
+	trackLogStart = flags.Bool("track-log-start", false, "")
+	metricTemplate = flags.String("metric-template",
+		monitor.DefaultMetricTemplate, "")
+	statsdFormat = flags.String("statsd-format", monitor.StatsdFormat, "")
+	staleTimeout = flags.Int("stale-timeout", 0, "")
+	dryRun = flags.Bool("dry-run", false, "")
+	once = flags.Bool("once", false, "")
+	listGroups = flags.Bool("list-groups", false, "")
+	onceTimeout = flags.Int("once-timeout", 60, "")
+	cwNamespace = flags.String("cloudwatch-namespace", "", "")
+	cwRegion = flags.String("cloudwatch-region", os.Getenv("AWS_REGION"), "")
+	flags.Var(&cwDimensions, "cloudwatch-dimension", "")
+	flags.Var(&lagThresholds, "lag-threshold", "")
+	flags.Var(&groupRollups, "group-rollup", "")
+	rollupOnly = flags.Bool("rollup-only", false, "")
+	logLevel = flags.Int("log-level", 2, "")
+	logFormat = flags.String("log-format", "text", "")
+	configPath = flags.String("config", "", "")
+	showVersion = flags.Bool("version", false, "")
+	flags.Usage = func() {
+		fmt.Println(Usage)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if *showVersion {
+		return nil, ErrShowVersion
+	}
+
+	brokers, err = applyEnv(flags, flags.Args())
+	if err != nil {
+		return nil, err
+	}
+	if *configPath != "" {
+		brokers, err = applyConfigFile(flags, *configPath, brokers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("Please specify brokers")
+	}
+	if err := validateBrokers(brokers); err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	// --output-file writes JSON lines, unless the file format is set.
+	if set["output-file"] && !set["file-format"] {
+		*fileFormat = monitor.JSONFileFormat
+	}
+
+	if *interval <= 0 {
+		return nil, fmt.Errorf("Interval must be positive")
+	}
+
+	if *retryInterval < 0 || *maxRetries < 0 {
+		return nil, fmt.Errorf("The retry interval and the maximum number " +
+			"of retries can't be negative")
+	}
+
+	if *onceTimeout <= 0 {
+		return nil, fmt.Errorf("Once timeout must be positive")
+	}
+
+	if *maxReconnectBackoff <= 0 {
+		return nil, fmt.Errorf("Max reconnect backoff must be positive")
+	}
+
+	if *maxBrokerConcurrency <= 0 {
+		return nil, fmt.Errorf("Max broker concurrency must be positive")
+	}
+
+	if *alertThreshold < 0 {
+		return nil, fmt.Errorf("Alert threshold can't be negative")
+	}
+
+	if *fetchTimeout < 0 {
+		return nil, fmt.Errorf("Fetch timeout can't be negative")
+	}
+
+	if *maxWaitTime <= 0 || *readTimeout <= 0 {
+		return nil, fmt.Errorf("Consumer max wait and read timeout must be " +
+			"positive")
+	}
+	if *readTimeout*1000 <= *maxWaitTime {
+		return nil, fmt.Errorf("Read timeout must be above the consumer max " +
+			"wait, which the fetch requests can take")
+	}
+
+	if *metadataRefresh <= 0 || *metadataRetries <= 0 {
+		return nil, fmt.Errorf("Metadata refresh and retries must be positive")
+	}
+
+	if *fetchBytes <= 0 || *fetchMaxBytes < 0 ||
+		*fetchMaxBytes > 0 && *fetchMaxBytes < *fetchBytes {
+		return nil, fmt.Errorf("Fetch bytes must be positive, and not above " +
+			"the fetch max bytes when set")
+	}
+
+	if *offsetSource != monitor.TopicOffsetSource &&
+		*offsetSource != monitor.AdminOffsetSource {
+		return nil, fmt.Errorf("Unknown offset source: %s", *offsetSource)
+	}
+
+	if _, ok := monitor.OffsetStarts[*offsetStart]; !ok {
+		return nil, fmt.Errorf("Unknown offset start: %s", *offsetStart)
+	}
+
+	if *smoothingAlpha < 0 || *smoothingAlpha > 1 {
+		return nil, fmt.Errorf("Lag smoothing alpha must be between 0 and 1")
+	}
+
+	if *statsdRate < 0 {
+		return nil, fmt.Errorf("Statsd rate can't be negative")
+	}
+
+	if *statsdFlushInterval < 0 {
+		return nil, fmt.Errorf("Statsd flush interval can't be negative")
+	}
+
+	if *statsdSampleRate <= 0 || *statsdSampleRate > 1 {
+		return nil, fmt.Errorf("Statsd sample rate must be greater than 0 " +
+			"and at most 1")
+	}
+
+	if len(statsdAddrs) == 0 {
+		statsdAddrs = stringList{"localhost:8125"}
+	}
+
+	if err := monitor.ValidateTags(tags); err != nil {
+		return nil, err
+	}
+
+	if *cwNamespace != "" && *cwRegion == "" {
+		return nil, fmt.Errorf("Please specify the CloudWatch region")
+	}
+
+	if err := monitor.ValidateMetricTemplate(*metricTemplate); err != nil {
+		return nil, err
+	}
+
+	buckets, err := monitor.ParseBuckets(*prometheusBuckets)
+	if err != nil {
+		return nil, err
+	}
+	if len(buckets) > 0 && *prometheusAddr == "" {
+		return nil, fmt.Errorf("Prometheus buckets require a Prometheus " +
+			"address")
+	}
+
+	if err := monitor.ValidateStatsdFormat(*statsdFormat); err != nil {
+		return nil, err
+	}
+
+	if *shardCount < 1 || *shardIndex < 0 || *shardIndex >= *shardCount {
+		return nil, fmt.Errorf("Shard index must be between 0 and shard count - 1")
+	}
+
+	if *logLevel < 0 || *logLevel >= len(log.AllLevels) {
+		return nil, fmt.Errorf("Log level must be between 0 and %d",
+			len(log.AllLevels)-1)
+	}
+
+	var formatter log.Formatter
+	switch *logFormat {
+	case "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return nil, fmt.Errorf("Unknown log format: %s", *logFormat)
+	}
+
+	if *clientID == "" {
+		return nil, fmt.Errorf("Client ID must not be empty")
+	}
+
+	var version sarama.KafkaVersion
+	if *kafkaVersion != "" {
+		version, err = monitor.ParseKafkaVersion(*kafkaVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := monitor.OffsetParsers[*offsetFormat]; !ok {
+		return nil, fmt.Errorf("Unknown offset format: %s", *offsetFormat)
+	}
+
+	granularitySet, err := monitor.ParseGranularity(*granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	groupFilter, err := monitor.NewFilter(*groupWhitelist, *groupBlacklist)
+	if err != nil {
+		return nil, fmt.Errorf("Error in group filter. Details: %s", err)
+	}
+
+	topicFilter, err := monitor.NewFilter(*topicWhitelist, *topicBlacklist)
+	if err != nil {
+		return nil, fmt.Errorf("Error in topic filter. Details: %s", err)
+	}
+
+	var partitionFilter *monitor.PartitionFilter
+	if *partitions != "" {
+		partitionFilter, err = monitor.ParsePartitionFilter(*partitions)
+		if err != nil {
+			return nil, fmt.Errorf("Error in partitions. Details: %s", err)
+		}
+	}
+
+	var thresholds *monitor.Thresholds
+	if len(lagThresholds) > 0 {
+		thresholds, err = monitor.ParseThresholds(lagThresholds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rollups, err := monitor.ParseRollups(groupRollups)
+	if err != nil {
+		return nil, err
+	}
+	if *rollupOnly && len(rollups) == 0 {
+		return nil, fmt.Errorf("Please specify a group rollup with rollup only")
+	}
+
+	kafkaCfg := monitor.KafkaConfig{
+		Brokers:          brokers,
+		ResolveBrokers:   *resolveBrokers,
+		OffsetSource:     *offsetSource,
+		OffsetStart:      *offsetStart,
+		OffsetFormat:     *offsetFormat,
+		ClientID:         *clientID,
+		Version:          version,
+		FetchDefault:     int32(*fetchBytes),
+		FetchMax:         int32(*fetchMaxBytes),
+		MaxWaitTime:      time.Duration(*maxWaitTime) * time.Millisecond,
+		ReadTimeout:      time.Duration(*readTimeout) * time.Second,
+		MetadataRefresh:  time.Duration(*metadataRefresh) * time.Second,
+		MetadataRetryMax: *metadataRetries,
+		ShardIndex:       *shardIndex,
+		ShardCount:       *shardCount,
+		SASLEnabled:      *sasl,
+		SASLUser:         *saslUser,
+		SASLPassword:     *saslPassword,
+		TLSEnabled:       *tlsEnabled,
+		TLSCAFile:        *tlsCA,
+		TLSCertFile:      *tlsCert,
+		TLSKeyFile:       *tlsKey,
+		TLSSkipVerify:    *tlsSkipVerify,
+	}
+	if err := monitor.ValidateSASL(&kafkaCfg); err != nil {
+		return nil, err
+	}
+
+	cfg := &monitor.QMConfig{
+		KafkaCfg: kafkaCfg,
+		StatsdCfg: monitor.StatsdConfig{
+			Addrs:          statsdAddrs,
+			Prefix:         *statsdPrefix,
+			Tags:           tags,
+			MetricTemplate: *metricTemplate,
+			Format:         *statsdFormat,
+			Rate:           *statsdRate,
+			FlushInterval:  time.Duration(*statsdFlushInterval) * time.Millisecond,
+			SampleRate:     float32(*statsdSampleRate),
+		},
+		FileCfg: monitor.FileConfig{
+			Path:    *fileOutput,
+			Format:  *fileFormat,
+			MaxSize: *fileMaxSize * 1024 * 1024,
+		},
+		Interval:             time.Duration(*interval) * time.Second,
+		RetryInterval:        time.Duration(*retryInterval) * time.Second,
+		MaxRetries:           *maxRetries,
+		MaxReconnectBackoff:  time.Duration(*maxReconnectBackoff) * time.Second,
+		EmitAssigned:         *emitAssigned,
+		ReportMissing:        *reportMissing,
+		Topics:               splitList(*topics),
+		AllowNegativeLag:     *negativeLag,
+		AllowlistURL:         *allowlistURL,
+		Granularity:          granularitySet,
+		GroupFilter:          groupFilter,
+		TopicFilter:          topicFilter,
+		PartitionFilter:      partitionFilter,
+		Thresholds:           thresholds,
+		Rollups:              rollups,
+		RollupOnly:           *rollupOnly,
+		PausedAfter:          time.Duration(*pausedAfter) * time.Second,
+		MaxBrokerConcurrency: *maxBrokerConcurrency,
+		FetchTimeout:         time.Duration(*fetchTimeout) * time.Second,
+		LagSmoothingAlpha:    *smoothingAlpha,
+		APIAddr:              *apiAddr,
+		OffsetsRetention:     time.Duration(*offsetsRetention) * time.Minute,
+		CloseBrokers:         *closeBrokers,
+		OpenMetricsTopic:     *openMetricsTopic,
+		PrometheusCfg: monitor.PrometheusConfig{
+			Addr:    *prometheusAddr,
+			Buckets: buckets,
+			Tags:    tags,
+		},
+		OTLPCfg: monitor.OTLPConfig{
+			Endpoint: *otlpEndpoint,
+			Tags:     tags,
+		},
+		GraphiteCfg: monitor.GraphiteConfig{
+			Addr:   *graphiteAddr,
+			Prefix: *graphitePrefix,
+		},
+		WebhookCfg: monitor.WebhookConfig{
+			URL:       *alertWebhookURL,
+			Threshold: *alertThreshold,
+		},
+		CloudWatchCfg: monitor.CloudWatchConfig{
+			Region:     *cwRegion,
+			Namespace:  *cwNamespace,
+			Dimensions: cwDimensions,
+		},
+		ReportCoordinators: *coordinators,
+		BrokerOffsetMaxAge: time.Duration(*brokerOffsetMaxAge) * time.Second,
+		TimeLag:            *timeLag,
+		CommitAge:          *commitAge,
+		PartitionCounts:    *partitionCounts,
+		TrackLogStart:      *trackLogStart,
+		StaleTimeout:       time.Duration(*staleTimeout) * time.Minute,
+		DryRun:             *dryRun,
+		Once:               *once,
+		ListGroups:         *listGroups,
+		OnceTimeout:        time.Duration(*onceTimeout) * time.Second,
+	}
+
+	if err := monitor.ValidateStatsdBuffer(cfg.StatsdCfg); err != nil {
+		return nil, err
+	}
+
+	log.SetLevel(log.AllLevels[*logLevel])
+	log.SetFormatter(formatter)
+	return cfg, nil
+}
+
+// Checks that every broker address is of the form host:port with a numeric
+// port, listing the invalid ones in the error. IPv6 hosts must be bracketed,
+// e.g. [::1]:9092, and the addresses are passed to sarama as they are.
+func validateBrokers(brokers []string) error {
+	var invalid []string
+	unbracketed := false
+	for _, broker := range brokers {
+		if validateBroker(broker) != nil {
+			invalid = append(invalid, broker)
+			if !strings.HasPrefix(broker, "[") &&
+				strings.Count(broker, ":") > 1 {
+				unbracketed = true
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		err := fmt.Sprintf("Invalid broker addresses, expected host:port: %s",
+			strings.Join(invalid, ", "))
+		if unbracketed {
+			err += ". IPv6 addresses must be bracketed, e.g. [::1]:9092"
+		}
+		return errors.New(err)
+	}
+	return nil
+}
+
+// Checks that the broker address is of the form host:port, with an IPv6
+// address as host when it's bracketed.
+func validateBroker(broker string) error {
+	host, port, err := net.SplitHostPort(broker)
+	if err != nil {
+		return err
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+	if host == "" || number == 0 {
+		return fmt.Errorf("missing host or port")
+	}
+	if strings.HasPrefix(broker, "[") {
+		// The zone of a link-local address isn't part of the IP.
+		if index := strings.Index(host, "%"); index >= 0 {
+			host = host[:index]
+		}
+		if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+			return fmt.Errorf("bracketed host isn't an IPv6 address")
+		}
+	}
+	return nil
+}
+
+// LoadConfig : Loads the configuration from a JSON or YAML config file,
+// validating it in the same way as the command line arguments.
+func LoadConfig(path string) (*monitor.QMConfig, error) {
+	flags := flag.NewFlagSet("kqm", flag.ContinueOnError)
+	return ParseConfig(flags, []string{"--config", path})
+}
+
+// Sets the options not already set in the flag set from the KQM_* environment
+// variables, named after the options in upper case with underscores, e.g.
+// KQM_STATSD_ADDR for --statsd-addr. The options that can be repeated take a
+// comma-separated list. The brokers are read from KQM_BROKERS, unless passed
+// as arguments. --version can't be set from the environment.
+func applyEnv(flags *flag.FlagSet, brokers []string) ([]string, error) {
+	if value, ok := os.LookupEnv("KQM_BROKERS"); ok && len(brokers) == 0 {
+		brokers = strings.Split(value, ",")
+	}
+
+	set := setOptions(flags)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[optionName(f.Name)] || f.Name == "version" {
+			return
+		}
+		name := "KQM_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, list := f.Value.(*stringList); list {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if err = flags.Set(f.Name, v); err != nil {
+				err = fmt.Errorf("Invalid value of %s. Details: %s", name, err)
+				return
+			}
+		}
+	})
+	return brokers, err
+}
+
+// Aliases of the options, to the names of the options they stand for.
+var optionAliases = map[string]string{
+	"output-file":       "file-output",
+	"output-max-size":   "file-max-size",
+	"fetch-concurrency": "max-broker-concurrency",
+	"instance-id":       "shard-index",
+}
+
+// Returns the name of the option an alias stands for, or the name itself.
+func optionName(name string) string {
+	if option, ok := optionAliases[name]; ok {
+		return option
+	}
+	return name
+}
+
+// Returns the names of the options already set in the flag set, with the
+// aliases resolved, so that an option set under one name isn't overridden
+// under another.
+func setOptions(flags *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[optionName(f.Name)] = true
+	})
+	return set
+}
+
+// Splits a comma-separated list, leaving out the empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Reads the config file, a JSON object or a YAML mapping (for the .yaml and
+// .yml extensions) of the option names to their values, and sets the
+// options not already set in the flag set. The brokers are read from the
+// "brokers" key, unless passed as arguments.
+func applyConfigFile(flags *flag.FlagSet, path string, brokers []string) (
+	[]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading config file. Details: %s", err)
+	}
+	var options map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		options, err = decodeYAML(data)
+	default:
+		// The numbers are kept as written, since large integers would be
+		// formatted in exponent notation once decoded as float64.
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&options)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing config file. Details: %s", err)
+	}
+
+	set := setOptions(flags)
+	for name, value := range options {
+		var values []string
+		if list, ok := value.([]interface{}); ok {
+			for _, item := range list {
+				values = append(values, fmt.Sprint(item))
+			}
+		} else {
+			values = []string{fmt.Sprint(value)}
+		}
+
+		if name == "brokers" {
+			if len(brokers) == 0 {
+				brokers = values
+			}
+			continue
+		}
+		if flags.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("Unknown option in config file: %s", name)
+		}
+		if set[optionName(name)] {
+			continue
+		}
+		for _, v := range values {
+			err = flags.Set(name, v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value of %s in config file. "+
+					"Details: %s", name, err)
+			}
+		}
+	}
+	return brokers, nil
+}
@@ -0,0 +1,511 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/activesphere/kqm/monitor"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) (string, func()) {
+	return writeNamedConfigFile(t, "config.json", content)
+}
+
+func writeNamedConfigFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "kqm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func parseArgs(args ...string) (*monitor.QMConfig, error) {
+	return ParseConfig(flag.NewFlagSet("kqm", flag.ContinueOnError), args)
+}
+
+func TestParseConfigFlagsOnly(t *testing.T) {
+	cfg, err := parseArgs("--interval", "30", "--statsd-prefix", "flags",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"localhost:9092"}, cfg.KafkaCfg.Brokers)
+	assert.Equal(t, 30*time.Second, cfg.Interval)
+	assert.Equal(t, "flags", cfg.StatsdCfg.Prefix)
+	assert.Equal(t, []string{"localhost:8125"}, cfg.StatsdCfg.Addrs)
+}
+
+func TestLoadConfigFileOnly(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `{
+		"brokers": ["kafka1:9092", "kafka2:9092"],
+		"interval": 30,
+		"statsd-prefix": "file",
+		"tag": ["env=prod", "team=data"],
+		"sasl": true,
+		"sasl-user": "kqm",
+		"sasl-password": "secret"
+	}`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"kafka1:9092", "kafka2:9092"}, cfg.KafkaCfg.Brokers)
+	assert.Equal(t, 30*time.Second, cfg.Interval)
+	assert.Equal(t, "file", cfg.StatsdCfg.Prefix)
+	assert.Equal(t, []string{"env=prod", "team=data"}, cfg.StatsdCfg.Tags)
+	assert.True(t, cfg.KafkaCfg.SASLEnabled)
+	assert.Equal(t, "kqm", cfg.KafkaCfg.SASLUser)
+}
+
+func TestLoadConfigLargeNumbers(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `{
+		"brokers": ["kafka1:9092"],
+		"fetch-bytes": 1048576,
+		"fetch-max-bytes": 10485760
+	}`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int32(1048576), cfg.KafkaCfg.FetchDefault)
+	assert.Equal(t, int32(10485760), cfg.KafkaCfg.FetchMax)
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path, cleanup := writeNamedConfigFile(t, "config.yaml", `
+# Monitoring of the production cluster.
+brokers:
+  - kafka1:9092
+  - "kafka2:9092"
+interval: 30 # seconds
+statsd-prefix: 'file'
+tag: [env=prod, team=data]
+fetch-bytes: 1048576
+sasl: true
+sasl-user: kqm
+sasl-password: "p#ss word"
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"kafka1:9092", "kafka2:9092"}, cfg.KafkaCfg.Brokers)
+	assert.Equal(t, 30*time.Second, cfg.Interval)
+	assert.Equal(t, "file", cfg.StatsdCfg.Prefix)
+	assert.Equal(t, []string{"env=prod", "team=data"}, cfg.StatsdCfg.Tags)
+	assert.Equal(t, int32(1048576), cfg.KafkaCfg.FetchDefault)
+	assert.True(t, cfg.KafkaCfg.SASLEnabled)
+	assert.Equal(t, "kqm", cfg.KafkaCfg.SASLUser)
+	assert.Equal(t, "p#ss word", cfg.KafkaCfg.SASLPassword)
+
+	cfg, err = ParseConfig(flag.NewFlagSet("kqm", flag.ContinueOnError),
+		[]string{"--config", path, "--interval", "10", "localhost:9092"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"localhost:9092"}, cfg.KafkaCfg.Brokers)
+	assert.Equal(t, 10*time.Second, cfg.Interval)
+}
+
+func TestLoadConfigYAMLInvalid(t *testing.T) {
+	for _, content := range []string{
+		"brokers: [kafka1:9092]\nstatsd:\n  addr: localhost:8125\n",
+		"- kafka1:9092\n",
+		"brokers: [kafka1:9092]\ninterval\n",
+		"brokers: [kafka1:9092]\ninterval: 30\ninterval: 10\n",
+	} {
+		path, cleanup := writeNamedConfigFile(t, "config.yml", content)
+		_, err := LoadConfig(path)
+		assert.Error(t, err, content)
+		cleanup()
+	}
+}
+
+func TestParseConfigFlagsOverrideFile(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `{
+		"brokers": ["kafka1:9092"],
+		"interval": 30,
+		"statsd-prefix": "file"
+	}`)
+	defer cleanup()
+
+	cfg, err := parseArgs("--config", path, "--statsd-prefix", "flags",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"localhost:9092"}, cfg.KafkaCfg.Brokers)
+	assert.Equal(t, 30*time.Second, cfg.Interval)
+	assert.Equal(t, "flags", cfg.StatsdCfg.Prefix)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `{"brokers": ["kafka1:9092"], "unknown": 1}`)
+	defer cleanup()
+	_, err := LoadConfig(path)
+	assert.Error(t, err)
+
+	path, cleanup = writeConfigFile(t, `{"interval": 30}`)
+	defer cleanup()
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestParseConfigInvalidFilter(t *testing.T) {
+	_, err := parseArgs("--group-whitelist", "billing(", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigInvalidTopicFilter(t *testing.T) {
+	_, err := parseArgs("--topic-blacklist", "[internal", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigKafkaVersion(t *testing.T) {
+	cfg, err := parseArgs("--kafka-version", "0.10.1.0", "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, sarama.V0_10_1_0, cfg.KafkaCfg.Version)
+
+	_, err = parseArgs("--kafka-version", "10.1", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigInstanceID(t *testing.T) {
+	cfg, err := parseArgs("--instance-id", "1", "--shard-count", "2",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, cfg.KafkaCfg.ShardIndex)
+	assert.Equal(t, 2, cfg.KafkaCfg.ShardCount)
+
+	_, err = parseArgs("--instance-id", "2", "--shard-count", "2",
+		"localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestValidateBrokers(t *testing.T) {
+	assert.NoError(t, validateBrokers([]string{"localhost:9092",
+		"10.0.0.1:9093", "[::1]:9094"}))
+
+	err := validateBrokers([]string{"localhost:9092", "localhost",
+		"kafka:abc", ":9092", "kafka:0"})
+	assert.EqualError(t, err, "Invalid broker addresses, expected "+
+		"host:port: localhost, kafka:abc, :9092, kafka:0")
+
+	_, err = parseArgs("localhost")
+	assert.Error(t, err)
+}
+
+func TestValidateBrokersIPv6(t *testing.T) {
+	brokers := []string{"[::1]:9092", "[2001:db8::10]:9093",
+		"[fe80::1%eth0]:9094", "[::ffff:10.0.0.1]:9095", "10.0.0.1:9092",
+		"kafka-1.example.com:9092"}
+	assert.NoError(t, validateBrokers(brokers))
+	cfg, err := parseArgs(brokers...)
+	if assert.NoError(t, err) {
+		assert.Equal(t, brokers, cfg.KafkaCfg.Brokers)
+	}
+
+	err = validateBrokers([]string{"::1:9092", "[10.0.0.1]:9092",
+		"[kafka]:9092", "[::1]", "[::1]:0"})
+	assert.EqualError(t, err, "Invalid broker addresses, expected "+
+		"host:port: ::1:9092, [10.0.0.1]:9092, [kafka]:9092, [::1], "+
+		"[::1]:0. IPv6 addresses must be bracketed, e.g. [::1]:9092")
+
+	err = validateBrokers([]string{"[kafka]:9092"})
+	assert.EqualError(t, err, "Invalid broker addresses, expected "+
+		"host:port: [kafka]:9092")
+}
+
+func TestParseConfigLogging(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFormatter(&log.TextFormatter{})
+	defer log.SetLevel(log.InfoLevel)
+
+	_, err := parseArgs("--log-level", "4", "--log-format", "json",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.Debugln("Gauge sent to Statsd")
+	log.Infoln("Completed Execution Successfully")
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "Completed Execution Successfully", entry["msg"])
+
+	_, err = parseArgs("--log-format", "xml", "localhost:9092")
+	assert.Error(t, err)
+	_, err = parseArgs("--log-level", "9", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigVersion(t *testing.T) {
+	// No brokers are required to print the version.
+	_, err := parseArgs("--version")
+	assert.Equal(t, ErrShowVersion, err)
+
+	_, err = parseArgs("--version", "localhost")
+	assert.Equal(t, ErrShowVersion, err)
+}
+
+func TestParseConfigGroupRollup(t *testing.T) {
+	cfg, err := parseArgs("--group-rollup", "^(svc-[a-z]+)-[a-z]+$=$1",
+		"--rollup-only", "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, cfg.Rollups, 1)
+	assert.True(t, cfg.RollupOnly)
+
+	_, err = parseArgs("--rollup-only", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigFetchBytes(t *testing.T) {
+	cfg, err := parseArgs("--fetch-bytes", "1048576", "--fetch-max-bytes",
+		"10485760", "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int32(1048576), cfg.KafkaCfg.FetchDefault)
+	assert.Equal(t, int32(10485760), cfg.KafkaCfg.FetchMax)
+
+	_, err = parseArgs("--fetch-bytes", "1048576", "--fetch-max-bytes", "1024",
+		"localhost:9092")
+	assert.Error(t, err)
+}
+
+func setEnv(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"KQM_BROKERS":       "kafka-1:9092,kafka-2:9092",
+		"KQM_STATSD_ADDR":   "statsd-1:8125,statsd-2:8125",
+		"KQM_STATSD_PREFIX": "env",
+		"KQM_INTERVAL":      "30",
+		"KQM_TLS":           "true",
+		"KQM_VERSION":       "1.0.0",
+	})()
+
+	cfg, err := parseArgs()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"kafka-1:9092", "kafka-2:9092"},
+		cfg.KafkaCfg.Brokers)
+	assert.Equal(t, []string{"statsd-1:8125", "statsd-2:8125"},
+		cfg.StatsdCfg.Addrs)
+	assert.Equal(t, "env", cfg.StatsdCfg.Prefix)
+	assert.Equal(t, 30*time.Second, cfg.Interval)
+	assert.True(t, cfg.KafkaCfg.TLSEnabled)
+
+	// The flags and arguments take precedence.
+	cfg, err = parseArgs("--statsd-prefix", "flags", "--interval", "10",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"localhost:9092"}, cfg.KafkaCfg.Brokers)
+	assert.Equal(t, "flags", cfg.StatsdCfg.Prefix)
+	assert.Equal(t, 10*time.Second, cfg.Interval)
+}
+
+func TestParseConfigEnvOverridesFile(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `{"brokers": ["file:9092"],
+		"statsd-prefix": "file", "interval": 10}`)
+	defer cleanup()
+	defer setEnv(t, map[string]string{"KQM_STATSD_PREFIX": "env"})()
+
+	cfg, err := parseArgs("--config", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "env", cfg.StatsdCfg.Prefix)
+	assert.Equal(t, 10*time.Second, cfg.Interval)
+	assert.Equal(t, []string{"file:9092"}, cfg.KafkaCfg.Brokers)
+
+	defer setEnv(t, map[string]string{"KQM_INTERVAL": "soon"})()
+	_, err = parseArgs("localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigTopics(t *testing.T) {
+	cfg, err := parseArgs("--topics", "orders, payments,,", "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"orders", "payments"}, cfg.Topics)
+}
+
+func TestParseConfigPartitions(t *testing.T) {
+	cfg, err := parseArgs("--partitions", "orders:0-3,payments:5",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, cfg.PartitionFilter.Allowed("orders", 3))
+	assert.False(t, cfg.PartitionFilter.Allowed("payments", 4))
+
+	_, err = parseArgs("--partitions", "orders:3-0", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigConsumerTimeouts(t *testing.T) {
+	cfg, err := parseArgs("--consumer-max-wait", "500", "--read-timeout", "10",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 500*time.Millisecond, cfg.KafkaCfg.MaxWaitTime)
+	assert.Equal(t, 10*time.Second, cfg.KafkaCfg.ReadTimeout)
+
+	_, err = parseArgs("--consumer-max-wait", "2000", "--read-timeout", "1",
+		"localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigMetadata(t *testing.T) {
+	cfg, err := parseArgs("--metadata-refresh", "30", "--metadata-retries", "5",
+		"localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	config, err := monitor.NewSaramaConfig(&cfg.KafkaCfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 30*time.Second, config.Metadata.RefreshFrequency)
+	assert.Equal(t, 5, config.Metadata.Retry.Max)
+
+	_, err = parseArgs("--metadata-retries", "0", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigStatsdSampleRate(t *testing.T) {
+	cfg, err := parseArgs("--statsd-sample-rate", "0.25", "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, float32(0.25), cfg.StatsdCfg.SampleRate)
+
+	for _, rate := range []string{"0", "-0.5", "1.5"} {
+		_, err = parseArgs("--statsd-sample-rate", rate, "localhost:9092")
+		assert.Error(t, err, rate)
+	}
+	_, err = parseArgs("--statsd-sample-rate", "0.5",
+		"--statsd-flush-interval", "1000", "localhost:9092")
+	assert.Error(t, err)
+}
+
+func TestParseConfigInterval(t *testing.T) {
+	for _, interval := range []string{"0", "-5"} {
+		_, err := parseArgs("--interval", interval, "localhost:9092")
+		assert.Error(t, err, interval)
+	}
+}
+
+func TestParseConfigStaleTimeout(t *testing.T) {
+	cfg, err := parseArgs("localhost:9092")
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Duration(0), cfg.StaleTimeout)
+	}
+	cfg, err = parseArgs("--stale-timeout", "10", "localhost:9092")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10*time.Minute, cfg.StaleTimeout)
+	}
+}
+
+func TestParseConfigPrometheusBuckets(t *testing.T) {
+	_, err := parseArgs("--prometheus-buckets", "10,100", "localhost:9092")
+	assert.Error(t, err)
+	cfg, err := parseArgs("--prometheus-buckets", "10,100",
+		"--prometheus-addr", ":9090", "localhost:9092")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int64{10, 100}, cfg.PrometheusCfg.Buckets)
+	}
+}
+
+func TestParseConfigOutputFile(t *testing.T) {
+	cfg, err := parseArgs("--output-file", "lags.log", "localhost:9092")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "lags.log", cfg.FileCfg.Path)
+		assert.Equal(t, monitor.JSONFileFormat, cfg.FileCfg.Format)
+	}
+
+	// The format set is kept, and --file-output still defaults to csv.
+	cfg, err = parseArgs("--output-file", "lags.log", "--file-format", "csv",
+		"localhost:9092")
+	if assert.NoError(t, err) {
+		assert.Equal(t, monitor.CSVFileFormat, cfg.FileCfg.Format)
+	}
+	cfg, err = parseArgs("--file-output", "lags.log", "localhost:9092")
+	if assert.NoError(t, err) {
+		assert.Equal(t, monitor.CSVFileFormat, cfg.FileCfg.Format)
+	}
+}
+
+func TestParseConfigAliases(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `{"output-file": "file.log",
+		"fetch-concurrency": 5, "shard-count": 4, "instance-id": 3}`)
+	defer cleanup()
+	defer setEnv(t, map[string]string{"KQM_OUTPUT_MAX_SIZE": "20"})()
+
+	// An option set under one name isn't overridden under its alias.
+	cfg, err := parseArgs("--config", path, "--file-output", "flags.log",
+		"--max-broker-concurrency", "10", "--shard-index", "1",
+		"--file-max-size", "30", "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "flags.log", cfg.FileCfg.Path)
+	assert.Equal(t, 10, cfg.MaxBrokerConcurrency)
+	assert.Equal(t, 1, cfg.KafkaCfg.ShardIndex)
+	assert.Equal(t, int64(30<<20), cfg.FileCfg.MaxSize)
+
+	cfg, err = parseArgs("--config", path, "localhost:9092")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "file.log", cfg.FileCfg.Path)
+	assert.Equal(t, 5, cfg.MaxBrokerConcurrency)
+	assert.Equal(t, 3, cfg.KafkaCfg.ShardIndex)
+	assert.Equal(t, int64(20<<20), cfg.FileCfg.MaxSize)
+}
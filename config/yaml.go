@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Decodes a YAML config file into the option names and their values, in the
+// same shape as a decoded JSON config file: a string per option, or a list
+// of strings for the options that can be repeated. Only the flat mapping a
+// config file needs is supported: top level "key: value" pairs, whose value
+// is a scalar, a [a, b] flow sequence or a block sequence of "- item" lines.
+func decodeYAML(data []byte) (map[string]interface{}, error) {
+	options := make(map[string]interface{})
+	var listKey string
+	for index, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" || trimmed == line {
+				return nil, fmt.Errorf("Unexpected list item at line %d",
+					index+1)
+			}
+			item := strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			list, _ := options[listKey].([]interface{})
+			options[listKey] = append(list, yamlScalar(item))
+			continue
+		}
+		if trimmed != line {
+			return nil, fmt.Errorf("Unsupported nested value at line %d",
+				index+1)
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Expected key: value at line %d", index+1)
+		}
+		key := yamlScalar(strings.TrimSpace(parts[0]))
+		if _, ok := options[key]; ok {
+			return nil, fmt.Errorf("Duplicate key %s at line %d", key, index+1)
+		}
+		value := strings.TrimSpace(parts[1])
+		listKey = ""
+		switch {
+		case value == "":
+			listKey = key
+			options[key] = []interface{}{}
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			list := []interface{}{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, yamlScalar(item))
+				}
+			}
+			options[key] = list
+		default:
+			options[key] = yamlScalar(value)
+		}
+	}
+	return options, nil
+}
+
+// Removes the comment ending the line, if any. A # starts a comment at the
+// beginning of the line or after a space, outside of quotes.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for index, char := range line {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '#' && (index == 0 || line[index-1] == ' ' ||
+			line[index-1] == '\t'):
+			return line[:index]
+		}
+	}
+	return line
+}
+
+// Returns the value of a scalar, without its quotes.
+func yamlScalar(value string) string {
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if first == last && (first == '"' || first == '\'') {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
@@ -0,0 +1,188 @@
+package monitor
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sources of the consumer offsets.
+const (
+	TopicOffsetSource = "topic"
+	AdminOffsetSource = "admin"
+)
+
+// GetAdminOffsets : Lists the consumer groups on every broker and fetches
+// their committed offsets from the group coordinators, storing them in the
+// Offset Store. This is an alternative to parsing the Offset Topic. A group
+// whose offsets can't be fetched is logged and counted as a broker error,
+// and keeps its offsets of the previous cycles.
+func (qm *QueueMonitor) GetAdminOffsets() error {
+	groups, err := qm.listGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		err := qm.fetchGroupOffsets(group)
+		if err != nil {
+			log.Errorf("Error while fetching offsets of group %s: %s", group, err)
+			atomic.AddInt64(&qm.brokerErrors, 1)
+		}
+	}
+	return nil
+}
+
+// Lists the consumer groups of all the brokers in the cluster.
+func (qm *QueueMonitor) listGroups() ([]string, error) {
+	client, release := qm.acquireClient()
+	defer release()
+	var groups []string
+	for _, broker := range client.Brokers() {
+		err := broker.Open(client.Config())
+		if err != nil && err != sarama.ErrAlreadyConnected {
+			log.Errorln("Error while connecting to broker.", err)
+			return nil, err
+		}
+		response, err := broker.ListGroups(&sarama.ListGroupsRequest{})
+		if err != nil {
+			log.Errorln("Error while listing consumer groups.", err)
+			return nil, err
+		}
+		if response.Err != sarama.ErrNoError {
+			return nil, response.Err
+		}
+		for group, protocolType := range response.Groups {
+			if protocolType == "consumer" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// Fetches the committed offsets of a group for the topics its members are
+// subscribed to, or for all the topics if the group has no members. The
+// partitions the group has not committed to are skipped.
+func (qm *QueueMonitor) fetchGroupOffsets(group string) error {
+	client, release := qm.acquireClient()
+	defer release()
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return err
+	}
+	topics, err := qm.groupTopics(coordinator, group)
+	if err != nil {
+		return err
+	}
+
+	request := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		for _, partition := range partitions {
+			request.AddPartition(topic, partition)
+		}
+	}
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return err
+	}
+	// A coordinator that has just restarted fails the partitions of the
+	// groups it is still loading, which are requested again shortly after.
+	for attempt := 1; attempt <= transientRetries; attempt++ {
+		retry := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+		count := 0
+		for topic, partitionMap := range response.Blocks {
+			for partition, block := range partitionMap {
+				if transientError(block.Err) {
+					retry.AddPartition(topic, partition)
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			break
+		}
+		log.Warningf("Retrying %d partitions of group %s with transient "+
+			"errors, attempt %d", count, group, attempt)
+		time.Sleep(transientBackoff)
+		retryResponse, err := coordinator.FetchOffset(retry)
+		if err != nil {
+			return err
+		}
+		for topic, partitionMap := range retryResponse.Blocks {
+			for partition, block := range partitionMap {
+				response.AddBlock(topic, partition, block)
+			}
+		}
+	}
+
+	for topic, partitionMap := range response.Blocks {
+		for partition, block := range partitionMap {
+			if block.Err != sarama.ErrNoError {
+				log.Errorln("Error in offset fetch block.", block.Err.Error())
+				continue
+			}
+			if block.Offset < 0 {
+				continue
+			}
+			qm.storeConsumerOffset(&PartitionOffset{
+				Topic:     topic,
+				Partition: partition,
+				Group:     group,
+				Offset:    block.Offset,
+				Timestamp: UnknownTimestamp,
+			})
+		}
+	}
+	return nil
+}
+
+// Fetches the topics the members of a group are subscribed to.
+func (qm *QueueMonitor) groupTopics(coordinator *sarama.Broker,
+	group string) ([]string, error) {
+	client, release := qm.acquireClient()
+	defer release()
+	response, err := coordinator.DescribeGroups(&sarama.DescribeGroupsRequest{
+		Groups: []string{group},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var topics []string
+	for _, description := range response.Groups {
+		for _, member := range description.Members {
+			metadata, err := member.GetMemberMetadata()
+			if err != nil {
+				log.Errorln("Error while parsing member metadata:", err)
+				continue
+			}
+			for _, topic := range metadata.Topics {
+				if !seen[topic] {
+					seen[topic] = true
+					topics = append(topics, topic)
+				}
+			}
+		}
+	}
+	if len(topics) > 0 {
+		return topics, nil
+	}
+
+	allTopics, err := client.Topics()
+	if err != nil {
+		return nil, err
+	}
+	for _, topic := range allTopics {
+		if topic != ConsumerOffsetTopic {
+			topics = append(topics, topic)
+		}
+	}
+	return topics, nil
+}
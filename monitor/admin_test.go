@@ -0,0 +1,98 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// coordinatorClient : Kafka client whose leader broker coordinates every
+// group but the failing one, with a single topic of three partitions.
+type coordinatorClient struct {
+	leaderClient
+	failing string
+}
+
+func (c *coordinatorClient) Coordinator(group string) (*sarama.Broker, error) {
+	if group == c.failing {
+		return nil, sarama.ErrConsumerCoordinatorNotAvailable
+	}
+	return c.cached, nil
+}
+
+func (c *coordinatorClient) Brokers() []*sarama.Broker {
+	return []*sarama.Broker{c.cached}
+}
+
+func (c *coordinatorClient) Config() *sarama.Config {
+	return sarama.NewConfig()
+}
+
+func (c *coordinatorClient) Topics() ([]string, error) {
+	return []string{"t1"}, nil
+}
+
+func (c *coordinatorClient) Partitions(topic string) ([]int32, error) {
+	return []int32{0, 1, 2}, nil
+}
+
+func TestFetchGroupOffsetsTransientError(t *testing.T) {
+	loading := &sarama.OffsetFetchResponse{}
+	loading.AddBlock("t1", 0, &sarama.OffsetFetchResponseBlock{Offset: -1,
+		Err: sarama.ErrOffsetsLoadInProgress})
+	loading.AddBlock("t1", 1, &sarama.OffsetFetchResponseBlock{Offset: 20})
+	loading.AddBlock("t1", 2, &sarama.OffsetFetchResponseBlock{Offset: -1,
+		Err: sarama.ErrNotLeaderForPartition})
+	loaded := &sarama.OffsetFetchResponse{}
+	loaded.AddBlock("t1", 0, &sarama.OffsetFetchResponseBlock{Offset: 10})
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"DescribeGroupsRequest": sarama.NewMockWrapper(
+			&sarama.DescribeGroupsResponse{
+				Groups: []*sarama.GroupDescription{{GroupId: "g1"}},
+			}),
+		"OffsetFetchRequest": sarama.NewMockSequence(
+			sarama.NewMockWrapper(loading), sarama.NewMockWrapper(loaded)),
+	})
+
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Client = &coordinatorClient{leaderClient: leaderClient{cached: broker}}
+
+	// Only the partition still loading on the coordinator is retried.
+	assert.NoError(t, qm.fetchGroupOffsets("g1"))
+	offset, ok := qm.loadConsumerOffset("t1", 0, "g1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), offset)
+	offset, ok = qm.loadConsumerOffset("t1", 1, "g1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(20), offset)
+	_, ok = qm.loadConsumerOffset("t1", 2, "g1")
+	assert.False(t, ok)
+	assert.Len(t, leader.History(), 3)
+}
+
+func TestGetAdminOffsetsFailingGroup(t *testing.T) {
+	offsets := &sarama.OffsetFetchResponse{}
+	offsets.AddBlock("t1", 0, &sarama.OffsetFetchResponseBlock{Offset: 10})
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"ListGroupsRequest": sarama.NewMockWrapper(&sarama.ListGroupsResponse{
+			Groups: map[string]string{"g1": "consumer", "g2": "consumer"},
+		}),
+		"DescribeGroupsRequest": sarama.NewMockWrapper(
+			&sarama.DescribeGroupsResponse{}),
+		"OffsetFetchRequest": sarama.NewMockWrapper(offsets),
+	})
+
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Client = &coordinatorClient{leaderClient: leaderClient{cached: broker},
+		failing: "g1"}
+
+	// The group whose coordinator fails doesn't stop the others.
+	assert.NoError(t, qm.GetAdminOffsets())
+	_, ok := qm.loadConsumerOffset("t1", 0, "g1")
+	assert.False(t, ok)
+	offset, ok := qm.loadConsumerOffset("t1", 0, "g2")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), offset)
+	assert.Equal(t, int64(1), qm.brokerErrors)
+}
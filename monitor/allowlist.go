@@ -0,0 +1,117 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Allowlist : Defines the set of topics and partitions to be monitored. An
+// entry is either a topic name, allowing all of its partitions, or of the
+// form "topic:partition". Until an allowlist is loaded, everything is allowed.
+type Allowlist struct {
+	mutex  sync.RWMutex
+	loaded bool
+	topics map[string]map[int32]bool
+}
+
+// Set : Replaces the allowlist with the entries passed as argument.
+func (a *Allowlist) Set(entries []string) error {
+	topics := make(map[string]map[int32]bool)
+	for _, entry := range entries {
+		index := strings.LastIndex(entry, ":")
+		if index == -1 {
+			topics[entry] = nil
+			continue
+		}
+		topic := entry[:index]
+		partition, err := strconv.ParseInt(entry[index+1:], 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid partition in allowlist entry: %s", entry)
+		}
+		if partitions, ok := topics[topic]; ok && partitions == nil {
+			continue
+		}
+		if topics[topic] == nil {
+			topics[topic] = make(map[int32]bool)
+		}
+		topics[topic][int32(partition)] = true
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.topics = topics
+	a.loaded = true
+	return nil
+}
+
+// Allowed : Checks whether the topic and partition should be monitored.
+func (a *Allowlist) Allowed(topic string, partition int32) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if !a.loaded {
+		return true
+	}
+	partitions, ok := a.topics[topic]
+	if !ok {
+		return false
+	}
+	return partitions == nil || partitions[partition]
+}
+
+// FetchAllowlist : Fetches the allowlist entries from the URL, which is
+// expected to respond with a JSON list of strings.
+func FetchAllowlist(client *http.Client, url string) ([]string, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status while fetching allowlist: %s",
+			response.Status)
+	}
+	var entries []string
+	err = json.NewDecoder(response.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding allowlist. Details: %s", err)
+	}
+	return entries, nil
+}
+
+// Fetches the allowlist from the configured URL, if any. On failure, the
+// last known allowlist is retained.
+func (qm *QueueMonitor) loadAllowlist() {
+	if qm.Config.AllowlistURL == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	entries, err := FetchAllowlist(client, qm.Config.AllowlistURL)
+	if err != nil {
+		log.Warningln("Keeping the last known allowlist due to error:", err)
+	} else if err = qm.Allowlist.Set(entries); err != nil {
+		log.Warningln("Keeping the last known allowlist due to error:", err)
+	} else {
+		log.Infof("Allowlist refreshed with %d entries.", len(entries))
+	}
+}
+
+// Refreshes the allowlist after every interval, until the context is done.
+// The allowlist is expected to be loaded before the first cycle.
+func (qm *QueueMonitor) refreshAllowlist(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(qm.Config.Interval):
+		}
+		qm.loadAllowlist()
+	}
+}
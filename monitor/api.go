@@ -0,0 +1,154 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NewAPIHandler : Returns the HTTP handler serving the API of the
+// QueueMonitor.
+func (qm *QueueMonitor) NewAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", qm.statusHandler)
+	mux.HandleFunc("/coordinators", qm.coordinatorsHandler)
+	mux.HandleFunc("/lag", qm.lagHandler)
+	mux.HandleFunc("/healthz", qm.healthzHandler)
+	mux.HandleFunc("/readyz", qm.readyzHandler)
+	return mux
+}
+
+// ServeAPI : Serves the API of the QueueMonitor on the configured address
+// until the context is done.
+func (qm *QueueMonitor) ServeAPI(ctx context.Context) {
+	server := &http.Server{
+		Addr:    qm.Config.APIAddr,
+		Handler: qm.NewAPIHandler(),
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.Close()
+		case <-stopped:
+		}
+	}()
+	log.Infoln("Serving API on", qm.Config.APIAddr)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorln("Error while serving API:", err)
+	}
+}
+
+// Responds with the StatusReport, using 503 as the status code when the
+// QueueMonitor is not healthy.
+func (qm *QueueMonitor) statusHandler(w http.ResponseWriter, r *http.Request) {
+	report := qm.Report(time.Now())
+	code := http.StatusOK
+	if !report.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, report)
+}
+
+// Responds with the cached coordinator broker ID of each group.
+func (qm *QueueMonitor) coordinatorsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	coordinators := make(map[string]int32)
+	qm.Coordinators.Range(func(groupI, brokerIDI interface{}) bool {
+		coordinators[groupI.(string)] = brokerIDI.(int32)
+		return true
+	})
+	writeJSON(w, http.StatusOK, coordinators)
+}
+
+// Snapshot : Returns the current lags, computed from the Offset Store and
+// the broker offsets of the last cycle, which are used until the next cycle.
+// The lags are sorted, and the slice returned isn't shared with the
+// QueueMonitor.
+func (qm *QueueMonitor) Snapshot() []PartitionLag {
+	tpMap := qm.getTopicsAndPartitions(qm.OffsetStore)
+	maxAge := qm.Config.BrokerOffsetMaxAge + qm.Config.Interval
+	lags, _, _ := qm.computeLags(tpMap, time.Now(), maxAge)
+	sortLags(lags)
+	return lags
+}
+
+// Responds with the lags of the Snapshot, which can be filtered by the group
+// query parameter.
+func (qm *QueueMonitor) lagHandler(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	filtered := []PartitionLag{}
+	for _, lag := range qm.Snapshot() {
+		if group == "" || lag.Group == group {
+			filtered = append(filtered, lag)
+		}
+	}
+	writeJSON(w, http.StatusOK, filtered)
+}
+
+// HealthzReport : Response of /healthz, with the build metadata and the
+// error of the last cycle.
+type HealthzReport struct {
+	Status         string `json:"status"`
+	Version        string `json:"version"`
+	Commit         string `json:"commit"`
+	BuildDate      string `json:"build_date"`
+	LastCycleError string `json:"last_cycle_error,omitempty"`
+}
+
+// Responds with 200 while Start is running, for liveness probes, and 503
+// otherwise. The error of the last cycle is reported without failing the
+// probe.
+func (qm *QueueMonitor) healthzHandler(w http.ResponseWriter,
+	r *http.Request) {
+	report := HealthzReport{
+		Status:    "ok",
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+	}
+	if err := qm.Status.lastCycleError(); err != nil {
+		report.LastCycleError = err.Error()
+	}
+	code := http.StatusOK
+	if atomic.LoadInt32(&qm.running) != 1 {
+		report.Status = "not ok"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, report)
+}
+
+// Responds with 200 once a cycle has fetched the broker offsets with at
+// least one consumer offset stored, for readiness probes.
+func (qm *QueueMonitor) readyzHandler(w http.ResponseWriter,
+	r *http.Request) {
+	writeProbe(w, atomic.LoadInt32(&qm.ready) == 1)
+}
+
+// Writes the plain text response of a probe, with 503 when it fails.
+func writeProbe(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ok")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Writes the value as a JSON response with the status code.
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Errorln("Error while writing JSON response:", err)
+	}
+}
@@ -0,0 +1,165 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLagHandler(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{Interval: time.Minute})
+	for _, offset := range []*PartitionOffset{
+		{Topic: "t1", Partition: 0, Group: "g1", Offset: 90},
+		{Topic: "t1", Partition: 1, Group: "g1", Offset: 45},
+		{Topic: "t1", Partition: 0, Group: "g2", Offset: 100},
+		{Topic: "t2", Partition: 0, Group: "g2", Offset: 5},
+	} {
+		qm.storeConsumerOffset(offset)
+	}
+	now := time.Now()
+	qm.BrokerOffsetStore.Store("t1", 0, 100, now)
+	qm.BrokerOffsetStore.Store("t1", 1, 50, now)
+
+	tests := []struct {
+		query    string
+		expected []PartitionLag
+	}{
+		{"", []PartitionLag{
+			{Group: "g1", Topic: "t1", Partition: 0, BrokerOffset: 100,
+				ConsumerOffset: 90, Lag: 10},
+			{Group: "g1", Topic: "t1", Partition: 1, BrokerOffset: 50,
+				ConsumerOffset: 45, Lag: 5},
+			{Group: "g2", Topic: "t1", Partition: 0, BrokerOffset: 100,
+				ConsumerOffset: 100, Lag: 0},
+		}},
+		{"?group=g2", []PartitionLag{
+			{Group: "g2", Topic: "t1", Partition: 0, BrokerOffset: 100,
+				ConsumerOffset: 100, Lag: 0},
+		}},
+		{"?group=g3", []PartitionLag{}},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		qm.NewAPIHandler().ServeHTTP(recorder,
+			httptest.NewRequest("GET", "/lag"+test.query, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var lags []PartitionLag
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &lags))
+		assert.Equal(t, test.expected, lags, test.query)
+	}
+}
+
+func TestProbeHandlers(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{Interval: time.Minute})
+	probe := func(path string) int {
+		recorder := httptest.NewRecorder()
+		qm.NewAPIHandler().ServeHTTP(recorder,
+			httptest.NewRequest("GET", path, nil))
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, probe("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe("/readyz"))
+
+	qm.running = 1
+	assert.Equal(t, http.StatusOK, probe("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe("/readyz"))
+
+	qm.ready = 1
+	assert.Equal(t, http.StatusOK, probe("/healthz"))
+	assert.Equal(t, http.StatusOK, probe("/readyz"))
+}
+
+func TestServeAPIStopsOnCancel(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{APIAddr: "127.0.0.1:0"})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		qm.ServeAPI(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The API server didn't stop")
+	}
+}
+
+func TestCoordinatorsHandler(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{Interval: time.Minute})
+	qm.Coordinators.Store("g1", int32(2))
+	recorder := httptest.NewRecorder()
+	qm.NewAPIHandler().ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/coordinators", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var coordinators map[string]int32
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &coordinators))
+	assert.Equal(t, map[string]int32{"g1": 2}, coordinators)
+}
+
+func TestStoreConsumerOffsetMarksStored(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{
+		GroupFilter: &Filter{Blacklist: regexp.MustCompile("^ignored$")},
+	})
+
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Group: "ignored"})
+	assert.Equal(t, int32(0), qm.offsetStored)
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Group: "g1"})
+	assert.Equal(t, int32(1), qm.offsetStored)
+}
+
+func TestHealthzBuildInfo(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{Interval: time.Minute})
+	qm.running = 1
+	Version, Commit = "1.2.0", "abc123"
+	defer func() { Version, Commit = "dev", "unknown" }()
+
+	recorder := httptest.NewRecorder()
+	qm.NewAPIHandler().ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var report HealthzReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, HealthzReport{Status: "ok", Version: "1.2.0",
+		Commit: "abc123", BuildDate: "unknown"}, report)
+	assert.JSONEq(t, `{"status": "ok", "version": "1.2.0", `+
+		`"commit": "abc123", "build_date": "unknown"}`, recorder.Body.String())
+}
+
+func TestSnapshot(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{Interval: time.Minute})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g1", Offset: 45})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+	now := time.Now()
+	qm.BrokerOffsetStore.Store("t1", 0, 100, now)
+	qm.BrokerOffsetStore.Store("t1", 1, 50, now)
+
+	expected := []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, BrokerOffset: 100,
+			ConsumerOffset: 90, Lag: 10},
+		{Group: "g1", Topic: "t1", Partition: 1, BrokerOffset: 50,
+			ConsumerOffset: 45, Lag: 5},
+	}
+	snapshot := qm.Snapshot()
+	assert.Equal(t, expected, snapshot)
+
+	// Changing the snapshot doesn't change the monitor, and the offsets
+	// stored afterwards don't change the snapshot.
+	snapshot[0].Lag = 1000
+	assert.Equal(t, expected, qm.Snapshot())
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 100})
+	assert.Equal(t, int64(0), qm.Snapshot()[0].Lag)
+	assert.Equal(t, int64(1000), snapshot[0].Lag)
+	assert.Equal(t, int64(5), snapshot[1].Lag)
+}
@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints of the ECS container credentials and of the EC2 instance
+// metadata service.
+const (
+	containerCredentialsHost = "http://169.254.170.2"
+	instanceMetadataHost     = "http://169.254.169.254"
+)
+
+// Credentials are refreshed this long before they expire.
+const credentialsExpiryWindow = 5 * time.Minute
+
+// AWS credentials used to sign the requests. Credentials without an
+// expiration, as read from the environment, never expire.
+type awsCredentials struct {
+	AccessKeyID  string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+// Credentials document served by the container and instance metadata
+// endpoints.
+type awsCredentialsDocument struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// awsCredentialsProvider : Resolves the AWS credentials from the environment
+// variables, or else from the role of the ECS task or of the EC2 instance,
+// and caches them until they are about to expire.
+type awsCredentialsProvider struct {
+	HTTPClient    *http.Client
+	containerHost string
+	instanceHost  string
+
+	mutex       sync.Mutex
+	credentials *awsCredentials
+}
+
+func newAWSCredentialsProvider() *awsCredentialsProvider {
+	return &awsCredentialsProvider{
+		HTTPClient:    &http.Client{Timeout: 5 * time.Second},
+		containerHost: containerCredentialsHost,
+		instanceHost:  instanceMetadataHost,
+	}
+}
+
+// Returns the cached credentials, or resolves them again when they are
+// missing or about to expire.
+func (p *awsCredentialsProvider) get(now time.Time) (awsCredentials, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.credentials != nil && (p.credentials.Expiration.IsZero() ||
+		now.Before(p.credentials.Expiration.Add(-credentialsExpiryWindow))) {
+		return *p.credentials, nil
+	}
+	credentials, err := p.resolve()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	p.credentials = &credentials
+	return credentials, nil
+}
+
+// Reads the credentials from the environment variables, or fetches the ones
+// of the ECS task role or of the EC2 instance profile.
+func (p *awsCredentialsProvider) resolve() (awsCredentials, error) {
+	credentials := awsCredentials{
+		AccessKeyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID != "" && credentials.SecretKey != "" {
+		return credentials, nil
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return p.fetch(p.containerHost+uri, nil)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		header := http.Header{}
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			header.Set("Authorization", token)
+		}
+		return p.fetch(uri, header)
+	}
+	credentials, err := p.instanceCredentials()
+	if err != nil {
+		return credentials, fmt.Errorf("AWS credentials not found in the "+
+			"environment, nor from the instance profile. Details: %s", err)
+	}
+	return credentials, nil
+}
+
+// Fetches the credentials of the role of the EC2 instance, using a session
+// token of the instance metadata service when it issues one.
+func (p *awsCredentialsProvider) instanceCredentials() (awsCredentials, error) {
+	header := http.Header{}
+	request, err := http.NewRequest("PUT", p.instanceHost+"/latest/api/token",
+		nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if token, err := p.read(request); err == nil {
+		header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	url := p.instanceHost + "/latest/meta-data/iam/security-credentials/"
+	request, err = http.NewRequest("GET", url, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	request.Header = header
+	roles, err := p.read(request)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, fmt.Errorf("No role attached to the instance")
+	}
+	return p.fetch(url+role, header)
+}
+
+// Fetches a credentials document from the URL.
+func (p *awsCredentialsProvider) fetch(url string, header http.Header) (
+	awsCredentials, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if header != nil {
+		request.Header = header
+	}
+	body, err := p.read(request)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var document awsCredentialsDocument
+	if err := json.Unmarshal([]byte(body), &document); err != nil {
+		return awsCredentials{}, fmt.Errorf("Error while parsing AWS "+
+			"credentials. Details: %s", err)
+	}
+	if document.AccessKeyID == "" || document.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("Incomplete AWS credentials "+
+			"from %s", url)
+	}
+	return awsCredentials{
+		AccessKeyID:  document.AccessKeyID,
+		SecretKey:    document.SecretAccessKey,
+		SessionToken: document.Token,
+		Expiration:   document.Expiration,
+	}, nil
+}
+
+// Sends the request and returns the body of a successful response.
+func (p *awsCredentialsProvider) read(request *http.Request) (string, error) {
+	response, err := p.HTTPClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error response from %s: %s %s",
+			request.URL, response.Status, body)
+	}
+	return string(body), nil
+}
@@ -0,0 +1,97 @@
+package monitor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWSCredentialsEnv(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+	credentials, err := newAWSCredentialsProvider().get(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, awsCredentials{AccessKeyID: "AKIDEXAMPLE",
+		SecretKey: "secret", SessionToken: "token"}, credentials)
+}
+
+func TestAWSCredentialsContainer(t *testing.T) {
+	expiration := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			assert.Equal(t, "/v2/credentials/task", r.URL.Path)
+			assert.Equal(t, "auth", r.Header.Get("Authorization"))
+			fmt.Fprintf(w, `{"AccessKeyId": "ASIA%d", "SecretAccessKey": "s",`+
+				` "Token": "t", "Expiration": "%s"}`, requests,
+				expiration.Format(time.RFC3339))
+		}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		server.URL+"/v2/credentials/task")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "auth")
+
+	provider := newAWSCredentialsProvider()
+	credentials, err := provider.get(expiration.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, awsCredentials{AccessKeyID: "ASIA1", SecretKey: "s",
+		SessionToken: "t", Expiration: expiration}, credentials)
+
+	// The credentials are cached until they are about to expire.
+	credentials, err = provider.get(expiration.Add(-10 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, "ASIA1", credentials.AccessKeyID)
+	credentials, err = provider.get(expiration.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, "ASIA2", credentials.AccessKeyID)
+}
+
+func TestAWSCredentialsInstance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/latest/api/token" {
+				assert.Equal(t, "PUT", r.Method)
+				fmt.Fprint(w, "session")
+				return
+			}
+			const path = "/latest/meta-data/iam/security-credentials/"
+			if r.URL.Path == path || r.URL.Path == path+"kqm-role" {
+				assert.Equal(t, "session",
+					r.Header.Get("X-aws-ec2-metadata-token"))
+			}
+			switch r.URL.Path {
+			case path:
+				fmt.Fprint(w, "kqm-role\n")
+			case path + "kqm-role":
+				fmt.Fprint(w, `{"AccessKeyId": "ASIA", "SecretAccessKey": "s",`+
+					` "Token": "t", "Expiration": "2026-10-16T12:00:00Z"}`)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+
+	provider := newAWSCredentialsProvider()
+	provider.instanceHost = server.URL
+	credentials, err := provider.get(time.Date(2026, 10, 16, 0, 0, 0, 0,
+		time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, "ASIA", credentials.AccessKeyID)
+	assert.Equal(t, "t", credentials.SessionToken)
+
+	// Without an instance profile, no credentials are found.
+	provider = newAWSCredentialsProvider()
+	provider.instanceHost = server.URL + "/missing"
+	_, err = provider.get(time.Now())
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package monitor
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Defaults of the waits between the attempts to reach the brokers.
+const (
+	DefaultReconnectBackoff    = time.Second
+	DefaultMaxReconnectBackoff = 2 * time.Minute
+)
+
+// Backoff : Computes the waits between the attempts to reach the brokers,
+// which double after every attempt up to a maximum. Half of each wait is
+// random, so that several instances don't retry in lockstep.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt uint
+	jitter  func() float64
+}
+
+// NewBackoff : Returns a Backoff using the reconnect backoffs of the config,
+// or their defaults when not set.
+func NewBackoff(cfg *QMConfig) *Backoff {
+	backoff := &Backoff{
+		Min:    cfg.ReconnectBackoff,
+		Max:    cfg.MaxReconnectBackoff,
+		jitter: rand.Float64,
+	}
+	if backoff.Min <= 0 {
+		backoff.Min = DefaultReconnectBackoff
+	}
+	if backoff.Max < backoff.Min {
+		backoff.Max = DefaultMaxReconnectBackoff
+		if backoff.Max < backoff.Min {
+			backoff.Max = backoff.Min
+		}
+	}
+	return backoff
+}
+
+// Next : Returns the wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	wait := b.Min << b.attempt
+	if wait <= 0 || wait >= b.Max {
+		wait = b.Max
+	} else {
+		b.attempt++
+	}
+	return wait/2 + time.Duration(b.jitter()*float64(wait/2))
+}
+
+// Reset : Starts the waits from the minimum again.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Reports whether the error means that none of the brokers can be reached,
+// or that the client is closed.
+func unreachable(err error) bool {
+	return err == sarama.ErrOutOfBrokers || err == sarama.ErrClosedClient
+}
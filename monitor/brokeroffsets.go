@@ -0,0 +1,86 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BrokerOffsetStore : Stores the latest broker offset fetched for each
+// partition along with the time it was fetched at, so that an offset can be
+// used for a limited time when fetching it fails in later cycles.
+type BrokerOffsetStore struct {
+	mutex   sync.RWMutex
+	offsets map[string]map[int32]brokerOffsetEntry
+}
+
+type brokerOffsetEntry struct {
+	offset  int64
+	updated time.Time
+}
+
+// NewBrokerOffsetStore : Returns an empty BrokerOffsetStore.
+func NewBrokerOffsetStore() *BrokerOffsetStore {
+	return &BrokerOffsetStore{
+		offsets: make(map[string]map[int32]brokerOffsetEntry),
+	}
+}
+
+// Store : Stores the broker offset of a partition fetched at the time passed.
+func (s *BrokerOffsetStore) Store(topic string, partition int32,
+	offset int64, updated time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.offsets[topic]; !ok {
+		s.offsets[topic] = make(map[int32]brokerOffsetEntry)
+	}
+	s.offsets[topic][partition] = brokerOffsetEntry{offset, updated}
+}
+
+// Load : Loads the broker offset of a partition, which is treated as unknown
+// if it was fetched more than maxAge before now.
+func (s *BrokerOffsetStore) Load(topic string, partition int32,
+	now time.Time, maxAge time.Duration) (int64, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, ok := s.offsets[topic][partition]
+	if !ok || now.Sub(entry.updated) > maxAge {
+		return 0, false
+	}
+	return entry.offset, true
+}
+
+// Snapshot : Returns a copy of the broker offsets fetched at most maxAge
+// before now, by topic and partition. The lock is only held while copying,
+// so the copy can be used without blocking the fetches storing offsets.
+func (s *BrokerOffsetStore) Snapshot(now time.Time,
+	maxAge time.Duration) map[string]map[int32]int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	snapshot := make(map[string]map[int32]int64)
+	for topic, partitionMap := range s.offsets {
+		for partition, entry := range partitionMap {
+			if now.Sub(entry.updated) > maxAge {
+				continue
+			}
+			if _, ok := snapshot[topic]; !ok {
+				snapshot[topic] = make(map[int32]int64)
+			}
+			snapshot[topic][partition] = entry.offset
+		}
+	}
+	return snapshot
+}
+
+// Sends the log end offset of each partition of the BrokerOffsetStore, which
+// is known whether or not a group consumes the partition. The gauges are
+// sent from a snapshot of the store.
+func (qm *QueueMonitor) emitBrokerOffsets(now time.Time,
+	maxAge time.Duration) {
+	for topic, partitionMap := range qm.BrokerOffsetStore.Snapshot(now, maxAge) {
+		for partition, offset := range partitionMap {
+			stat := fmt.Sprintf(".topic.%s.%d.offset", topic, partition)
+			qm.sendGaugeToStatsd(stat, offset)
+		}
+	}
+}
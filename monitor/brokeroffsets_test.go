@@ -0,0 +1,174 @@
+package monitor
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerOffsetStoreMaxAge(t *testing.T) {
+	store := NewBrokerOffsetStore()
+	fetched := time.Unix(1508140800, 0)
+	store.Store("topic1", 0, 42, fetched)
+
+	offset, ok := store.Load("topic1", 0, fetched, 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), offset)
+
+	offset, ok = store.Load("topic1", 0, fetched.Add(time.Minute), 2*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), offset)
+
+	_, ok = store.Load("topic1", 0, fetched.Add(3*time.Minute), 2*time.Minute)
+	assert.False(t, ok)
+
+	_, ok = store.Load("topic1", 1, fetched, 2*time.Minute)
+	assert.False(t, ok)
+}
+
+func TestEmitBrokerOffsets(t *testing.T) {
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm"},
+	})
+	now := time.Unix(1508140800, 0)
+	qm.BrokerOffsetStore.Store("orders", 0, 100, now)
+	qm.BrokerOffsetStore.Store("orders", 1, 250, now)
+	qm.BrokerOffsetStore.Store("payments", 0, 7, now)
+	qm.BrokerOffsetStore.Store("stale", 0, 1, now.Add(-time.Hour))
+
+	qm.emitBrokerOffsets(now, time.Minute)
+	sort.Strings(recorder.gauges)
+	assert.Equal(t, []string{
+		"kqm.topic.orders.0.offset=100",
+		"kqm.topic.orders.1.offset=250",
+		"kqm.topic.payments.0.offset=7",
+	}, recorder.gauges)
+}
+
+func TestGetBrokerOffsetsLogStart(t *testing.T) {
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100).
+			SetOffset("t1", 0, sarama.OffsetOldest, 40).
+			SetOffset("t1", 1, sarama.OffsetNewest, 50).
+			SetOffset("t1", 1, sarama.OffsetOldest, 50),
+	})
+
+	emitter := &recordingStatsd{}
+	qm, err := NewQueueMonitorWithClient(&leaderClient{cached: broker},
+		[]StatsdEmitter{emitter}, &QMConfig{
+			KafkaCfg:             KafkaConfig{OffsetFormat: BurrowOffsetFormat},
+			StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+			MaxBrokerConcurrency: 1,
+			TrackLogStart:        true,
+		})
+	if !assert.NoError(t, err) {
+		return
+	}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g1", Offset: 45})
+
+	// The log end and log start offsets are requested separately.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Len(t, leader.History(), 2)
+	now := time.Now()
+	assert.Equal(t, map[string]map[int32]int64{"t1": {0: 100, 1: 50}},
+		qm.BrokerOffsetStore.Snapshot(now, time.Minute))
+	assert.Equal(t, map[string]map[int32]int64{"t1": {0: 40, 1: 50}},
+		qm.LogStartStore.Snapshot(now, time.Minute))
+	assert.Contains(t, emitter.gauges, "kqm.topic.t1.0.log_start=40")
+	assert.Contains(t, emitter.gauges, "kqm.topic.t1.1.log_start=50")
+	assert.Contains(t, emitter.gauges, "kqm.topic.t1.0.offset=100")
+}
+
+// storingStatsd : Statsd client storing a broker offset for every gauge
+// sent, as a fetch of the next cycle would while the gauges are sent.
+type storingStatsd struct {
+	recordingStatsd
+	store *BrokerOffsetStore
+}
+
+func (s *storingStatsd) Gauge(stat string, value int64) error {
+	s.store.Store("new", 0, value, time.Now())
+	return s.recordingStatsd.Gauge(stat, value)
+}
+
+func TestEmitBrokerOffsetsSnapshot(t *testing.T) {
+	store := NewBrokerOffsetStore()
+	now := time.Now()
+	store.Store("orders", 0, 100, now)
+	store.Store("orders", 1, 250, now)
+	snapshot := store.Snapshot(now, time.Minute)
+	assert.Equal(t, map[string]map[int32]int64{
+		"orders": {0: 100, 1: 250},
+	}, snapshot)
+
+	// The gauges are sent from a snapshot, without holding the lock of the
+	// store, which the emitter can then write to.
+	emitter := &storingStatsd{store: store}
+	qm, _ := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm"},
+	})
+	qm.StatsdClients = []StatsdEmitter{emitter}
+	qm.BrokerOffsetStore = store
+	qm.emitBrokerOffsets(now, time.Minute)
+	sort.Strings(emitter.gauges)
+	assert.Equal(t, []string{
+		"kqm.topic.orders.0.offset=100",
+		"kqm.topic.orders.1.offset=250",
+	}, emitter.gauges)
+
+	// The snapshot taken before isn't changed by the offsets stored since.
+	assert.Equal(t, map[string]map[int32]int64{
+		"orders": {0: 100, 1: 250},
+	}, snapshot)
+	offset, ok := store.Load("new", 0, time.Now(), time.Minute)
+	assert.True(t, ok)
+	assert.Contains(t, []int64{100, 250}, offset)
+}
+
+func TestComputeLagsConcurrentStore(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	for partition := int32(0); partition < 4; partition++ {
+		qm.storeConsumerOffset(&PartitionOffset{Topic: "t1",
+			Partition: partition, Group: "g1", Offset: 1})
+	}
+	tpMap := qm.getTopicsAndPartitions(qm.OffsetStore)
+
+	// The broker offsets are stored by the fetches of a cycle while the
+	// lags are computed, e.g. for the /lag API.
+	const offsets = 500
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for offset := int64(1); offset <= offsets; offset++ {
+			for partition := int32(0); partition < 4; partition++ {
+				qm.BrokerOffsetStore.Store("t1", partition, offset, time.Now())
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < offsets; i++ {
+			lags, _, _ := qm.computeLags(tpMap, time.Now(), time.Minute)
+			for _, lag := range lags {
+				assert.True(t, lag.Lag >= 0 && lag.Lag < offsets)
+			}
+		}
+	}()
+	wg.Wait()
+
+	lags, missing, total := qm.computeLags(tpMap, time.Now(), time.Minute)
+	assert.Equal(t, 0, missing)
+	assert.Equal(t, 4, total)
+	for _, lag := range lags {
+		assert.Equal(t, int64(offsets-1), lag.Lag)
+	}
+}
@@ -0,0 +1,17 @@
+package monitor
+
+import "fmt"
+
+// Version, Commit and BuildDate : Build metadata, injected when building with
+// -ldflags "-X github.com/activesphere/kqm/monitor.Version=...".
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// BuildInfo : Returns the version, git commit and build date on one line.
+func BuildInfo() string {
+	return fmt.Sprintf("version: %s commit: %s built: %s", Version, Commit,
+		BuildDate)
+}
@@ -0,0 +1,246 @@
+package monitor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of metrics CloudWatch accepts in a PutMetricData call.
+const cloudWatchBatchSize = 20
+
+// Maximum number of PutMetricData calls made at the same time.
+const cloudWatchConcurrency = 4
+
+// Dimension : Name and value of a CloudWatch metric dimension.
+type Dimension struct {
+	Name  string
+	Value string
+}
+
+// MetricDatum : A value of a CloudWatch metric.
+type MetricDatum struct {
+	MetricName string
+	Dimensions []Dimension
+	Value      float64
+	Timestamp  time.Time
+}
+
+// CloudWatchClient : Defines the interface of a client sending metrics to
+// CloudWatch.
+type CloudWatchClient interface {
+	PutMetricData(namespace string, data []MetricDatum) error
+}
+
+// CloudWatchReporter : Defines a Reporter sending the lags of every cycle to
+// CloudWatch as a ConsumerLag metric, dimensioned by Group, Topic and
+// Partition in addition to the configured dimensions.
+type CloudWatchReporter struct {
+	Client     CloudWatchClient
+	Namespace  string
+	Dimensions []Dimension
+}
+
+// NewCloudWatchReporter : Returns a CloudWatchReporter sending the metrics
+// to the namespace with the client passed as argument. The dimensions are of
+// the form "name=value".
+func NewCloudWatchReporter(client CloudWatchClient, cfg CloudWatchConfig) (
+	*CloudWatchReporter, error) {
+	reporter := &CloudWatchReporter{Client: client, Namespace: cfg.Namespace}
+	for _, dimension := range cfg.Dimensions {
+		parts := strings.SplitN(dimension, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid dimension, expected name=value: %s",
+				dimension)
+		}
+		reporter.Dimensions = append(reporter.Dimensions,
+			Dimension{parts[0], parts[1]})
+	}
+	return reporter, nil
+}
+
+// Report : Sends the lags in batches of at most 20 metrics, a few batches at
+// a time. A failed batch doesn't stop the others from being sent.
+func (r *CloudWatchReporter) Report(timestamp time.Time, lags []PartitionLag) error {
+	data := make([]MetricDatum, 0, len(lags))
+	for _, lag := range lags {
+		dimensions := append([]Dimension{
+			{"Group", lag.Group},
+			{"Topic", lag.Topic},
+			{"Partition", strconv.Itoa(int(lag.Partition))},
+		}, r.Dimensions...)
+		data = append(data, MetricDatum{
+			MetricName: "ConsumerLag",
+			Dimensions: dimensions,
+			Value:      float64(lag.Lag),
+			Timestamp:  timestamp,
+		})
+	}
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		errs  []error
+	)
+	sem := make(chan struct{}, cloudWatchConcurrency)
+	for start := 0; start < len(data); start += cloudWatchBatchSize {
+		end := start + cloudWatchBatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch []MetricDatum) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := r.Client.PutMetricData(r.Namespace, batch); err != nil {
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+			}
+		}(data[start:end])
+	}
+	wg.Wait()
+	return joinErrors(errs)
+}
+
+// Close : Nothing to close for the CloudWatchReporter.
+func (r *CloudWatchReporter) Close() error {
+	return nil
+}
+
+// HTTPCloudWatchClient : CloudWatchClient calling the PutMetricData action of
+// the CloudWatch Query API, signing the requests with Signature Version 4.
+type HTTPCloudWatchClient struct {
+	Region     string
+	HTTPClient *http.Client
+
+	credentials *awsCredentialsProvider
+}
+
+// NewHTTPCloudWatchClient : Returns an HTTPCloudWatchClient for the region.
+// The credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables, or else fetched for the role
+// of the ECS task or of the EC2 instance, and refreshed before they expire.
+func NewHTTPCloudWatchClient(region string) (*HTTPCloudWatchClient, error) {
+	if region == "" {
+		return nil, fmt.Errorf("Please specify the CloudWatch region")
+	}
+	client := &HTTPCloudWatchClient{
+		Region:      region,
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+		credentials: newAWSCredentialsProvider(),
+	}
+	if _, err := client.credentials.get(time.Now()); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// PutMetricData : Sends the metrics to the namespace.
+func (c *HTTPCloudWatchClient) PutMetricData(namespace string,
+	data []MetricDatum) error {
+	form := url.Values{}
+	form.Set("Action", "PutMetricData")
+	form.Set("Version", "2010-08-01")
+	form.Set("Namespace", namespace)
+	for i, datum := range data {
+		member := fmt.Sprintf("MetricData.member.%d.", i+1)
+		form.Set(member+"MetricName", datum.MetricName)
+		form.Set(member+"Value", strconv.FormatFloat(datum.Value, 'f', -1, 64))
+		form.Set(member+"Unit", "Count")
+		form.Set(member+"Timestamp", datum.Timestamp.UTC().Format(time.RFC3339))
+		for j, dimension := range datum.Dimensions {
+			prefix := fmt.Sprintf("%sDimensions.member.%d.", member, j+1)
+			form.Set(prefix+"Name", dimension.Name)
+			form.Set(prefix+"Value", dimension.Value)
+		}
+	}
+	body := form.Encode()
+
+	now := time.Now()
+	credentials, err := c.credentials.get(now)
+	if err != nil {
+		return err
+	}
+	host := fmt.Sprintf("monitoring.%s.amazonaws.com", c.Region)
+	request, err := http.NewRequest("POST", "https://"+host+"/",
+		strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type",
+		"application/x-www-form-urlencoded; charset=utf-8")
+	signV4(request, credentials, c.Region, "monitoring", host, body, now)
+
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Error response from CloudWatch: %s %s",
+			response.Status, message)
+	}
+	return nil
+}
+
+// Signs the POST request to the root path of the service in the region
+// with Signature Version 4.
+func signV4(request *http.Request, credentials awsCredentials, region,
+	service, host, body string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	headers := []string{"content-type", "host", "x-amz-date"}
+	values := map[string]string{
+		"content-type": request.Header.Get("Content-Type"),
+		"host":         host,
+		"x-amz-date":   amzDate,
+	}
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+		headers = append(headers, "x-amz-security-token")
+		values["x-amz-security-token"] = credentials.SessionToken
+	}
+
+	var canonicalHeaders string
+	for _, header := range headers {
+		canonicalHeaders += header + ":" + values[header] + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{"POST", "/", "",
+		canonicalHeaders, signedHeaders, sha256Hex(body)}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope,
+		sha256Hex(canonicalRequest)}, "\n")
+	key := []byte("AWS4" + credentials.SecretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,122 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingCloudWatch : CloudWatchClient recording the calls made to it,
+// and failing the batches starting with the partition to fail.
+type recordingCloudWatch struct {
+	mutex      sync.Mutex
+	namespaces []string
+	batches    [][]MetricDatum
+	fail       string
+}
+
+func (c *recordingCloudWatch) PutMetricData(namespace string,
+	data []MetricDatum) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if data[0].Dimensions[2].Value == c.fail {
+		return errors.New("throttled")
+	}
+	c.namespaces = append(c.namespaces, namespace)
+	c.batches = append(c.batches, data)
+	return nil
+}
+
+// Returns the batches sent, ordered by their first partition.
+func (c *recordingCloudWatch) sortedBatches() [][]MetricDatum {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	batches := append([][]MetricDatum(nil), c.batches...)
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i][0].Dimensions[2].Value <
+			batches[j][0].Dimensions[2].Value
+	})
+	return batches
+}
+
+func TestCloudWatchReporter(t *testing.T) {
+	client := &recordingCloudWatch{}
+	reporter, err := NewCloudWatchReporter(client, CloudWatchConfig{
+		Namespace:  "KQM",
+		Dimensions: []string{"Cluster=msk-prod"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var lags []PartitionLag
+	for partition := int32(0); partition < 45; partition++ {
+		lags = append(lags, PartitionLag{Group: "g1", Topic: "t1",
+			Partition: partition, Lag: int64(partition) * 10})
+	}
+	now := time.Now()
+	assert.NoError(t, reporter.Report(now, lags))
+
+	assert.Equal(t, []string{"KQM", "KQM", "KQM"}, client.namespaces)
+	batches := client.sortedBatches()
+	if !assert.Len(t, batches, 3) {
+		return
+	}
+	assert.Len(t, batches[0], 20)
+	assert.Len(t, batches[1], 20)
+	assert.Len(t, batches[2], 5)
+	assert.Equal(t, MetricDatum{
+		MetricName: "ConsumerLag",
+		Dimensions: []Dimension{
+			{"Group", "g1"},
+			{"Topic", "t1"},
+			{"Partition", "42"},
+			{"Cluster", "msk-prod"},
+		},
+		Value:     420,
+		Timestamp: now,
+	}, batches[2][2])
+	for index, datum := range batches[1] {
+		assert.Equal(t, fmt.Sprint(20+index), datum.Dimensions[2].Value)
+	}
+
+	// A failed batch doesn't stop the others from being sent.
+	client = &recordingCloudWatch{fail: "20"}
+	reporter.Client = client
+	assert.EqualError(t, reporter.Report(now, lags), "throttled")
+	assert.Len(t, client.sortedBatches(), 2)
+
+	_, err = NewCloudWatchReporter(client, CloudWatchConfig{
+		Dimensions: []string{"Cluster"},
+	})
+	assert.Error(t, err)
+}
+
+func TestSignV4(t *testing.T) {
+	// The post-x-www-form-urlencoded request of the AWS Signature Version 4
+	// test suite.
+	request, err := http.NewRequest("POST", "https://example.amazonaws.com/",
+		strings.NewReader("Param1=value1"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signV4(request, awsCredentials{
+		AccessKeyID: "AKIDEXAMPLE",
+		SecretKey:   "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, "us-east-1", "service", "example.amazonaws.com", "Param1=value1",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "20150830T123600Z", request.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 "+
+		"Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		request.Header.Get("Authorization"))
+}
@@ -0,0 +1,26 @@
+package monitor
+
+import "time"
+
+// Sends the time elapsed since each group last committed an offset at each
+// partition, from the timestamp of the commit kept in the Offset Store. A
+// growing age flags a consumer that stopped committing, even when no
+// messages are produced and its lag stays at zero. Commits without a known
+// timestamp are skipped.
+func (qm *QueueMonitor) sendCommitAges(lags []PartitionLag, now time.Time) {
+	for _, lag := range lags {
+		commit, ok := qm.loadConsumerCommit(lag.Topic, lag.Partition, lag.Group)
+		if !ok {
+			continue
+		}
+		age, ok := TimestampAge(commit.Timestamp, now)
+		if !ok {
+			continue
+		}
+		if age < 0 {
+			age = 0
+		}
+		qm.sendGauge(qm.partitionStat(lag.Group, lag.Topic, lag.Partition,
+			".commit_age_seconds"), int64(age.Seconds()))
+	}
+}
@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendCommitAges(t *testing.T) {
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm"},
+	})
+	now := time.Unix(1508140800, 0)
+	millis := func(t time.Time) int64 {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "orders", Partition: 0,
+		Group: "g1", Offset: 10, Timestamp: millis(now.Add(-90 * time.Second))})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "orders", Partition: 1,
+		Group: "g1", Offset: 20, Timestamp: millis(now.Add(-5 * time.Second))})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "orders", Partition: 2,
+		Group: "g1", Offset: 30, Timestamp: UnknownTimestamp})
+
+	commit, ok := qm.loadConsumerCommit("orders", 0, "g1")
+	assert.True(t, ok)
+	assert.Equal(t, ConsumerOffset{10, millis(now.Add(-90 * time.Second))},
+		commit)
+
+	qm.sendCommitAges([]PartitionLag{
+		{Group: "g1", Topic: "orders", Partition: 0, Lag: 0},
+		{Group: "g1", Topic: "orders", Partition: 1, Lag: 3},
+		{Group: "g1", Topic: "orders", Partition: 2, Lag: 1},
+		{Group: "g2", Topic: "orders", Partition: 0, Lag: 1},
+	}, now)
+	sort.Strings(recorder.gauges)
+	assert.Equal(t, []string{
+		"kqm.group.g1.orders.0.commit_age_seconds=90",
+		"kqm.group.g1.orders.1.commit_age_seconds=5",
+	}, recorder.gauges)
+}
@@ -0,0 +1,124 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSaramaConfigSASL(t *testing.T) {
+	cfg := &QMConfig{
+		KafkaCfg: KafkaConfig{
+			Brokers:      []string{"localhost:9092"},
+			SASLEnabled:  true,
+			SASLUser:     "kqm",
+			SASLPassword: "secret",
+		},
+	}
+	config, err := NewSaramaConfig(&cfg.KafkaCfg)
+	assert.NoError(t, err)
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, "kqm", config.Net.SASL.User)
+	assert.Equal(t, "secret", config.Net.SASL.Password)
+	assert.NoError(t, config.Validate())
+
+	config, err = NewSaramaConfig(&KafkaConfig{})
+	assert.NoError(t, err)
+	assert.False(t, config.Net.SASL.Enable)
+}
+
+func TestNewSaramaConfigTLS(t *testing.T) {
+	cfg := &KafkaConfig{
+		TLSEnabled:  true,
+		TLSCAFile:   "testdata/cert.pem",
+		TLSCertFile: "testdata/cert.pem",
+		TLSKeyFile:  "testdata/key.pem",
+	}
+	config, err := NewSaramaConfig(cfg)
+	assert.NoError(t, err)
+	assert.True(t, config.Net.TLS.Enable)
+	assert.NotNil(t, config.Net.TLS.Config.RootCAs)
+	assert.Len(t, config.Net.TLS.Config.Certificates, 1)
+
+	assert.False(t, config.Net.TLS.Config.InsecureSkipVerify)
+
+	cfg.TLSSkipVerify = true
+	config, err = NewSaramaConfig(cfg)
+	assert.NoError(t, err)
+	assert.True(t, config.Net.TLS.Config.InsecureSkipVerify)
+
+	cfg.TLSCertFile = "testdata/missing.pem"
+	_, err = NewSaramaConfig(cfg)
+	assert.Error(t, err)
+}
+
+func TestNewTLSConfigClientCertificate(t *testing.T) {
+	tlsConfig, err := NewTLSConfig(&KafkaConfig{
+		TLSCertFile: "testdata/cert.pem",
+		TLSKeyFile:  "testdata/key.pem",
+	})
+	if assert.NoError(t, err) && assert.Len(t, tlsConfig.Certificates, 1) {
+		assert.NotNil(t, tlsConfig.Certificates[0].PrivateKey)
+	}
+
+	_, err = NewTLSConfig(&KafkaConfig{
+		TLSCertFile: "testdata/cert.pem",
+		TLSKeyFile:  "testdata/other_key.pem",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "which must match")
+	}
+
+	_, err = NewTLSConfig(&KafkaConfig{TLSCertFile: "testdata/cert.pem"})
+	assert.EqualError(t, err, "Both the TLS certificate and key files are "+
+		"required for a client certificate")
+}
+
+func TestValidateSASL(t *testing.T) {
+	assert.NoError(t, ValidateSASL(&KafkaConfig{SASLEnabled: true,
+		SASLUser: "kqm", SASLPassword: "secret"}))
+	assert.Error(t, ValidateSASL(&KafkaConfig{SASLEnabled: true,
+		SASLUser: "kqm"}))
+	assert.NoError(t, ValidateSASL(&KafkaConfig{}))
+}
+
+func TestNewSaramaConfigFetchBytes(t *testing.T) {
+	config, err := NewSaramaConfig(&KafkaConfig{FetchDefault: 1 << 20,
+		FetchMax: 10 << 20})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1<<20), config.Consumer.Fetch.Default)
+	assert.Equal(t, int32(10<<20), config.Consumer.Fetch.Max)
+	assert.True(t, config.Consumer.Return.Errors)
+	assert.NoError(t, config.Validate())
+
+	config, err = NewSaramaConfig(&KafkaConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.NewConfig().Consumer.Fetch, config.Consumer.Fetch)
+}
+
+func TestNewSaramaConfigTimeouts(t *testing.T) {
+	config, err := NewSaramaConfig(&KafkaConfig{
+		MaxWaitTime: time.Second,
+		ReadTimeout: 5 * time.Second,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, config.Consumer.MaxWaitTime)
+	assert.Equal(t, 5*time.Second, config.Net.ReadTimeout)
+	assert.NoError(t, config.Validate())
+}
+
+func TestNewSaramaConfigMetadata(t *testing.T) {
+	config, err := NewSaramaConfig(&KafkaConfig{
+		MetadataRefresh:  time.Minute,
+		MetadataRetryMax: 7,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, config.Metadata.RefreshFrequency)
+	assert.Equal(t, 7, config.Metadata.Retry.Max)
+
+	config, err = NewSaramaConfig(&KafkaConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.NewConfig().Metadata, config.Metadata)
+}
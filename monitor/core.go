@@ -3,6 +3,12 @@ package monitor
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -15,80 +21,351 @@ import (
 const ConsumerOffsetTopic = "__consumer_offsets"
 
 // Retry : It retries the func passed an argument based on the whether or not
-// the the fn returns an error.
-func Retry(cfg *QMConfig, title string, fn func() error) {
-	for {
+// the the fn returns an error. It waits for the RetryInterval between the
+// attempts and gives up after MaxRetries retries, returning the last error.
+// With MaxRetries set to 0, it retries until the fn succeeds. It stops
+// retrying when the context is done, returning the error of the context.
+// While the brokers are unreachable, it backs off exponentially instead of
+// waiting for the RetryInterval.
+func Retry(ctx context.Context, cfg *QMConfig, title string,
+	fn func() error) error {
+	backoff := NewBackoff(cfg)
+	for retries := 0; ; retries++ {
 		err := fn()
-		if err != nil {
+		if err == nil {
+			log.Infoln("Completed Execution Successfully:", title)
+			return nil
+		}
+		if cfg.MaxRetries > 0 && retries >= cfg.MaxRetries {
+			log.Errorf("Giving up after %d retries: %s", retries, title)
+			return err
+		}
+		wait := cfg.retryInterval()
+		if unreachable(err) {
+			wait = backoff.Next()
+			log.Errorf("Brokers unreachable, retrying in %s: %s", wait, title)
+		} else {
+			backoff.Reset()
 			log.Errorln("Retrying due to a sychronous error:", title)
-			time.Sleep(cfg.Interval)
-			continue
 		}
-		log.Infoln("Completed Execution Successfully:", title)
-		break
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// DefaultInterval : Interval of the cycles used when none is configured.
+const DefaultInterval = 60 * time.Second
+
+// Sets the options an embedder may leave to their zero value, and which are
+// required to run, to their defaults.
+func (cfg *QMConfig) setDefaults() {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if len(cfg.Granularity) == 0 {
+		cfg.Granularity = map[string]bool{PartitionGranularity: true}
+	}
+	if cfg.KafkaCfg.OffsetFormat == "" {
+		cfg.KafkaCfg.OffsetFormat = BurrowOffsetFormat
 	}
 }
 
+// Returns the time to wait for between the retries, which defaults to the
+// Interval.
+func (cfg *QMConfig) retryInterval() time.Duration {
+	if cfg.RetryInterval > 0 {
+		return cfg.RetryInterval
+	}
+	return cfg.Interval
+}
+
 // RetryWithContext : It retries the func passed an argument
-// based on the Go's context construct.
-func RetryWithContext(cfg *QMConfig, title string,
+// based on the Go's context construct. When the context passed as argument is
+// done, the context passed to fn is cancelled and it returns once the context
+// returned by fn is done.
+func RetryWithContext(ctx context.Context, cfg *QMConfig, title string,
 	fn func(pCtx context.Context) (context.Context, error)) {
-	handleError := func(cancel func(), fromContext bool) {
+	handleError := func(cancel func(), fromContext bool) bool {
 		if fromContext {
 			log.Errorln("Retrying due to a error received from context:", title)
 		} else {
 			log.Errorln("Retrying due to a error returned by fn:", title)
 		}
 		cancel()
-		time.Sleep(cfg.Interval)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(cfg.retryInterval()):
+			return true
+		}
 	}
 
 	for {
-		pCtx, pCancel := context.WithCancel(context.Background())
-		defer pCancel()
+		pCtx, pCancel := context.WithCancel(ctx)
 
 		cCtx, err := fn(pCtx)
 		if err != nil {
-			handleError(pCancel, false)
-			continue
+			if handleError(pCancel, false) {
+				continue
+			}
+			return
 		}
 
 		if cCtx != nil {
-			<-cCtx.Done()
-			handleError(pCancel, true)
-			continue
+			select {
+			case <-cCtx.Done():
+				if handleError(pCancel, true) {
+					continue
+				}
+			case <-ctx.Done():
+				pCancel()
+				<-cCtx.Done()
+			}
+			return
 		}
 
+		pCancel()
 		log.Infoln("Completed Execution Successfully:", title)
 		break
 	}
 }
 
 // Start : Initiates the monitoring procedure, prints out the lag results
-// and sends the results to Statsd.
-func Start(cfg *QMConfig) {
-	qm, err := NewQueueMonitor(cfg)
+// and sends the results to Statsd. It runs until the context is done, and
+// then closes the QueueMonitor. Creating the QueueMonitor is retried with a
+// backoff while the brokers are unreachable. With Once set, it runs a single
+// cycle instead and returns its error, and with ListGroups set, it prints
+// the consumer groups found instead of monitoring them. Both give up on
+// unreachable brokers after the OnceTimeout, so that they don't hang.
+func Start(ctx context.Context, cfg *QMConfig) error {
+	var qm *QueueMonitor
+	retryCtx := ctx
+	if (cfg.Once || cfg.ListGroups) && cfg.OnceTimeout > 0 {
+		var cancel context.CancelFunc
+		retryCtx, cancel = context.WithTimeout(ctx, cfg.OnceTimeout)
+		defer cancel()
+	}
+	err := retryUnreachable(retryCtx, NewBackoff(cfg), func() error {
+		var err error
+		qm, err = NewQueueMonitor(cfg)
+		return err
+	})
 	if err != nil {
 		log.Errorln("Error while creating QueueMonitor instance.", err)
-		return
+		return err
+	}
+	defer qm.Close()
+	if cfg.ListGroups {
+		return qm.ListGroups(ctx, os.Stdout)
+	}
+	if cfg.Once {
+		return qm.RunOnce(ctx)
+	}
+	qm.Start(ctx)
+	return nil
+}
+
+// Calls fn until it returns an error other than the brokers being
+// unreachable, waiting for the backoff between the calls. It returns the
+// last error once the context is done.
+func retryUnreachable(ctx context.Context, backoff *Backoff,
+	fn func() error) error {
+	for {
+		err := fn()
+		if !unreachable(err) {
+			return err
+		}
+		wait := backoff.Next()
+		log.Errorf("Brokers unreachable, retrying in %s: %s", wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Start : Runs the monitoring cycles of the QueueMonitor until the context is
+// done, and then waits for the consumption of the Offset Topic, the refresh
+// of the allowlist and the API server to stop.
+func (qm *QueueMonitor) Start(ctx context.Context) {
+	cfg := qm.Config
+	atomic.StoreInt32(&qm.running, 1)
+	defer atomic.StoreInt32(&qm.running, 0)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if cfg.AllowlistURL != "" {
+		// The first cycle only monitors the allowed topics.
+		qm.loadAllowlist()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qm.refreshAllowlist(ctx)
+		}()
+	}
+
+	if cfg.APIAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qm.ServeAPI(ctx)
+		}()
 	}
 
+	qm.consumeOffsetTopic(ctx, &wg)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	runOnTicks(ctx, cfg.Interval, ticker.C, func() {
+		err := Retry(ctx, cfg, "REPORT_LAG", func() error {
+			err := qm.runCycle()
+			qm.Status.cycleFinished(err)
+			return err
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Errorln("Skipping the cycle due to an error:", err)
+		}
+	})
+}
+
+// RunOnce : Runs a single monitoring cycle and returns its error. The Offset
+// Topic is read up to the offsets it has when called, or for at most the
+// OnceTimeout, and the allowlist is loaded before the cycle.
+func (qm *QueueMonitor) RunOnce(ctx context.Context) error {
+	qm.loadAllowlist()
+	cCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	if qm.consumeOffsetTopic(cCtx, &wg) {
+		qm.waitConsumed(ctx, qm.Config.OnceTimeout)
+	}
+	err := qm.runCycle()
+	qm.Status.cycleFinished(err)
+	return err
+}
+
+// Consumes the Offset Topic until the context is done, unless the consumer
+// offsets are fetched from the coordinators. The consumption is tracked by
+// the WaitGroup. It reports whether the Offset Topic is consumed.
+func (qm *QueueMonitor) consumeOffsetTopic(ctx context.Context,
+	wg *sync.WaitGroup) bool {
+	if qm.Config.KafkaCfg.OffsetSource == AdminOffsetSource {
+		return false
+	}
+	wg.Add(1)
 	go func() {
-		RetryWithContext(cfg, "CONSUMER_OFFSETS",
+		defer wg.Done()
+		RetryWithContext(ctx, qm.Config, "CONSUMER_OFFSETS",
 			func(pCtx context.Context) (context.Context, error) {
 				return qm.GetConsumerOffsets(pCtx)
 			})
+		// RetryWithContext returns once a consumer has stopped, the
+		// others are waited for here.
+		qm.consumers.Wait()
 	}()
+	return true
+}
+
+// Runs a monitoring cycle: fetches the broker offsets, and the consumer
+// offsets when they come from the coordinators, and sends the lags along
+// with the optional reports.
+func (qm *QueueMonitor) runCycle() error {
+	cfg := qm.Config
+	if cfg.StaleTimeout > 0 {
+		qm.evictStaleGroups(time.Now())
+	}
+	var err error
+	if cfg.KafkaCfg.OffsetSource == AdminOffsetSource {
+		err = qm.GetAdminOffsets()
+	}
+	if err == nil {
+		err = qm.GetBrokerOffsets()
+	}
+	if err != nil {
+		if err == sarama.ErrOutOfBrokers && cfg.KafkaCfg.ResolveBrokers ||
+			qm.clientClosed() {
+			if rErr := qm.RebuildClient(); rErr != nil {
+				log.Errorln("Error while rebuilding Kafka client.", rErr)
+			}
+		}
+		return err
+	}
+	if atomic.LoadInt32(&qm.offsetStored) == 1 {
+		atomic.StoreInt32(&qm.ready, 1)
+	}
+	if cfg.EmitAssigned {
+		err = qm.emitAssignedPartitions()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.ReportCoordinators {
+		qm.emitCoordinators()
+	}
+	if cfg.OffsetsRetention > 0 {
+		qm.emitRetentionRisk(time.Now())
+	}
+	return nil
+}
 
+// Runs the cycle right away and then on every tick, until the context is
+// done, so that the cycles start at a fixed interval whatever their
+// duration. When a cycle overruns the interval, the tick it missed is
+// skipped rather than starting the next cycle right after it.
+func runOnTicks(ctx context.Context, interval time.Duration,
+	ticks <-chan time.Time, cycle func()) {
 	for {
-		Retry(cfg, "REPORT_LAG", func() error {
-			err := qm.GetBrokerOffsets()
-			if err != nil {
-				return err
+		start := time.Now()
+		cycle()
+		if elapsed := time.Since(start); elapsed > interval {
+			log.Warningf("Cycle took %s, longer than the interval of %s; "+
+				"skipping the next tick", elapsed, interval)
+			select {
+			case <-ticks:
+			default:
 			}
-			time.Sleep(cfg.Interval)
-			return nil
-		})
+		}
+		select {
+		case <-ctx.Done():
+			log.Infoln("Shutting down:", ctx.Err())
+			return
+		case <-ticks:
+		}
+	}
+}
+
+// Close : Closes the reporters, the Kafka client and the Statsd client.
+func (qm *QueueMonitor) Close() {
+	closeReporters(qm.Reporters)
+	qm.clientMutex.Lock()
+	client, users := qm.Client, qm.clientUsers
+	qm.clientMutex.Unlock()
+	if err := closeClient(client, users); err != nil {
+		log.Errorln("Error while closing Kafka client.", err)
+	}
+	for _, statsdClient := range qm.StatsdClients {
+		closer, ok := statsdClient.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			log.Errorln("Error while closing Statsd client.", err)
+		}
+	}
+}
+
+// Closes the reporters, logging the errors.
+func closeReporters(reporters []Reporter) {
+	for _, reporter := range reporters {
+		if err := reporter.Close(); err != nil {
+			log.Errorf("Error while closing reporter %s: %s",
+				reporterName(reporter), err)
+		}
 	}
 }
 
@@ -96,24 +373,205 @@ func Start(cfg *QMConfig) {
 // based on the comma-separated brokers (eg. "localhost:9092") along with
 // the Statsd instance address (eg. "localhost:8125").
 func NewQueueMonitor(cfg *QMConfig) (*QueueMonitor, error) {
-
-	config := sarama.NewConfig()
-	client, err := sarama.NewClient(cfg.KafkaCfg.Brokers, config)
+	cfg.setDefaults()
+	client, err := newClient(cfg)
 	if err != nil {
 		return nil, err
 	}
-	statsdClient := statsd.NewStatsdClient(cfg.StatsdCfg.Addr,
-		cfg.StatsdCfg.Prefix)
-	err = statsdClient.CreateSocket()
+	var emitters []StatsdEmitter
+	if cfg.ListGroups {
+		// No gauges are sent while listing the groups.
+		emitters = []StatsdEmitter{&statsd.NoopClient{}}
+	} else if cfg.DryRun {
+		emitters = []StatsdEmitter{NewDryRunStatsdClient(os.Stdout)}
+	} else {
+		statsdClients, err := newStatsdClients(cfg.StatsdCfg, cfg.Interval)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		for _, statsdClient := range statsdClients {
+			emitters = append(emitters, statsdClient)
+		}
+	}
+	qm, err := NewQueueMonitorWithClient(client, emitters, cfg)
 	if err != nil {
+		client.Close()
+		for _, emitter := range emitters {
+			if closer, ok := emitter.(io.Closer); ok {
+				closer.Close()
+			}
+		}
 		return nil, err
 	}
+	return qm, nil
+}
+
+// NewQueueMonitorWithClient : Returns a QueueMonitor using the Kafka client
+// and the Statsd emitters passed as argument, which are closed along with
+// the QueueMonitor. The required options left to their zero value in the
+// configuration, such as the Interval, are set to their defaults.
+func NewQueueMonitorWithClient(client sarama.Client,
+	emitters []StatsdEmitter, cfg *QMConfig) (*QueueMonitor, error) {
+	cfg.setDefaults()
 	qm := &QueueMonitor{}
 	qm.Client = client
 	qm.OffsetStore = new(syncmap.Map)
+	qm.CommitTimestamps = new(syncmap.Map)
+	qm.LastSeen = new(syncmap.Map)
+	qm.Coordinators = new(syncmap.Map)
+	qm.BrokerOffsetStore = NewBrokerOffsetStore()
+	qm.LogStartStore = NewBrokerOffsetStore()
+	qm.Allowlist = new(Allowlist)
+	qm.Status = NewStatus()
+	qm.Parser = OffsetParsers[cfg.KafkaCfg.OffsetFormat]
+	if qm.Parser == nil {
+		return nil, fmt.Errorf("Unknown offset format: %s", cfg.KafkaCfg.OffsetFormat)
+	}
+	if cfg.LagSmoothingAlpha > 0 {
+		qm.LagSmoother = NewLagSmoother(cfg.LagSmoothingAlpha)
+	}
+	if cfg.PausedAfter > 0 {
+		qm.PauseDetector = NewPauseDetector(cfg.PausedAfter)
+	}
 	qm.Config = cfg
-	qm.StatsdClient = statsdClient
-	return qm, err
+	qm.StatsdClients = emitters
+	err := qm.validateShards()
+	if err != nil {
+		return nil, err
+	}
+	qm.Reporters, err = newReporters(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return qm, nil
+}
+
+// Creates the reporters enabled in the configuration. When one of them
+// can't be created, the ones created before it are closed.
+func newReporters(cfg *QMConfig) ([]Reporter, error) {
+	var reporters []Reporter
+	if cfg.FileCfg.Path != "" {
+		fileReporter, err := NewFileReporter(cfg.FileCfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, fileReporter)
+	}
+	if cfg.OpenMetricsTopic != "" {
+		// The reporter has a Kafka client of its own, since the one of the
+		// QueueMonitor is closed when it is rebuilt.
+		omClient, err := newClient(cfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		omReporter, err := NewOpenMetricsReporter(omClient, cfg.OpenMetricsTopic)
+		if err != nil {
+			omClient.Close()
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, omReporter)
+	}
+	if cfg.PrometheusCfg.Addr != "" {
+		promReporter, err := NewPrometheusReporter(cfg.PrometheusCfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, promReporter)
+	}
+	if cfg.CloudWatchCfg.Namespace != "" {
+		cwClient, err := NewHTTPCloudWatchClient(cfg.CloudWatchCfg.Region)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		cwReporter, err := NewCloudWatchReporter(cwClient, cfg.CloudWatchCfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, cwReporter)
+	}
+	if cfg.OTLPCfg.Endpoint != "" {
+		otlpReporter, err := NewOTLPReporter(cfg.OTLPCfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, otlpReporter)
+	}
+	if cfg.GraphiteCfg.Addr != "" {
+		graphiteReporter, err := NewGraphiteReporter(cfg.GraphiteCfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, graphiteReporter)
+	}
+	if cfg.WebhookCfg.URL != "" {
+		webhookReporter, err := NewWebhookReporter(cfg.WebhookCfg)
+		if err != nil {
+			closeReporters(reporters)
+			return nil, err
+		}
+		reporters = append(reporters, webhookReporter)
+	}
+	return reporters, nil
+}
+
+// RebuildClient : Replaces the Kafka client with a new one created from the
+// configured brokers, so that their addresses are resolved again. The old
+// client is closed, which also closes the consumers created from it.
+func (qm *QueueMonitor) RebuildClient() error {
+	log.Infoln("Rebuilding the Kafka client.")
+	client, err := newClient(qm.Config)
+	if err != nil {
+		return err
+	}
+	qm.clientMutex.Lock()
+	oldClient, oldUsers := qm.Client, qm.clientUsers
+	qm.Client, qm.clientUsers = client, nil
+	qm.clientMutex.Unlock()
+	err = closeClient(oldClient, oldUsers)
+	if err != nil {
+		log.Errorln("Error while closing the old Kafka client.", err)
+	}
+	return nil
+}
+
+// Returns the Kafka client, which RebuildClient may replace while it is in
+// use by the cycles and the status, along with the function releasing it.
+// A replaced client is only closed once all its users have released it,
+// since sarama doesn't synchronize closing the client with its use. The
+// consumers of the Offset Topic don't hold the client, and stop once it is
+// closed.
+func (qm *QueueMonitor) acquireClient() (sarama.Client, func()) {
+	qm.clientMutex.Lock()
+	defer qm.clientMutex.Unlock()
+	if qm.clientUsers == nil {
+		qm.clientUsers = new(sync.WaitGroup)
+	}
+	qm.clientUsers.Add(1)
+	return qm.Client, qm.clientUsers.Done
+}
+
+// Closes the client once the users it was acquired by have released it.
+func closeClient(client sarama.Client, users *sync.WaitGroup) error {
+	if users != nil {
+		users.Wait()
+	}
+	return client.Close()
+}
+
+// Returns whether the Kafka client has been closed.
+func (qm *QueueMonitor) clientClosed() bool {
+	client, release := qm.acquireClient()
+	defer release()
+	return client.Closed()
 }
 
 // GetConsumerOffsets : Subcribes to Offset Topic and parses messages to
@@ -129,22 +587,32 @@ func (qm *QueueMonitor) GetConsumerOffsets(pCtx context.Context) (
 	}()
 	log.Infoln("Started getting consumer partition offsets.")
 
-	partitions, err := qm.Client.Partitions(ConsumerOffsetTopic)
+	partitions, err := qm.offsetTopicPartitions(pCtx)
 	if err != nil {
-		log.Errorln("Error occured while getting client partitions.", err)
 		return cCtx, err
 	}
-	consumer, err := sarama.NewConsumerFromClient(qm.Client)
+	partitions = qm.Config.KafkaCfg.ShardPartitions(partitions)
+	if len(partitions) == 0 {
+		err = fmt.Errorf("No partitions of the Offset Topic to consume")
+		log.Errorln(err)
+		return cCtx, err
+	}
+	client, release := qm.acquireClient()
+	defer release()
+	consumer, err := sarama.NewConsumerFromClient(client)
 	if err != nil {
 		log.Errorln("Error occured while creating new client consumer.", err)
 		return cCtx, err
 	}
 
 	pConsumers := make([]sarama.PartitionConsumer, len(partitions))
+	startOffset, ok := OffsetStarts[qm.Config.KafkaCfg.OffsetStart]
+	if !ok {
+		startOffset = sarama.OffsetOldest
+	}
 
 	for index, partition := range partitions {
-		pConsumer, err := consumer.ConsumePartition(ConsumerOffsetTopic,
-			partition, sarama.OffsetNewest)
+		pConsumer, err := qm.consumePartition(consumer, partition, startOffset)
 		if err != nil {
 			log.Errorln("Error occured while creating Consumer Partition.", err)
 			return cCtx, err
@@ -152,47 +620,182 @@ func (qm *QueueMonitor) GetConsumerOffsets(pCtx context.Context) (
 		pConsumers[index] = pConsumer
 	}
 
-	for _, pConsumer := range pConsumers {
-		go qm.consumeMessage(pConsumer, cCancel)
-		go closeConsumer(pCtx, pConsumer)
-	}
+	qm.startConsumers(pCtx, pConsumers, partitions, cCancel)
 	return cCtx, nil
 }
 
+// Consumes the Offset Topic partition from the position reached before the
+// consumer was restarted, so that the topic isn't replayed on a reconnect.
+// The start offset is only used the first time, or when the position is no
+// longer in the partition, e.g. after it was deleted by the retention.
+func (qm *QueueMonitor) consumePartition(consumer sarama.Consumer,
+	partition int32, startOffset int64) (sarama.PartitionConsumer, error) {
+	if position, ok := qm.positions.Load(partition); ok {
+		pConsumer, err := consumer.ConsumePartition(ConsumerOffsetTopic,
+			partition, position.(int64))
+		if err != sarama.ErrOffsetOutOfRange {
+			return pConsumer, err
+		}
+		log.Warningf("Position %d of the Offset Topic partition %d is out "+
+			"of range, consuming from %s.", position, partition,
+			qm.Config.KafkaCfg.OffsetStart)
+	}
+	return consumer.ConsumePartition(ConsumerOffsetTopic, partition,
+		startOffset)
+}
+
+// Starts the goroutines reading the messages and errors of each partition
+// consumer, and closing it once the context is done. They are tracked by
+// the consumers WaitGroup, which is added to for all of them before any is
+// started, so that it can't be waited on while a goroutine is starting.
+func (qm *QueueMonitor) startConsumers(ctx context.Context,
+	pConsumers []sarama.PartitionConsumer, partitions []int32,
+	cCancel func()) {
+	qm.consumers.Add(3 * len(pConsumers))
+	for index, pConsumer := range pConsumers {
+		go func(pConsumer sarama.PartitionConsumer, partition int32) {
+			defer qm.consumers.Done()
+			qm.consumeMessage(pConsumer, partition, cCancel)
+		}(pConsumer, partitions[index])
+		go func(pConsumer sarama.PartitionConsumer) {
+			defer qm.consumers.Done()
+			qm.consumeErrors(pConsumer)
+		}(pConsumer)
+		go func(pConsumer sarama.PartitionConsumer) {
+			defer qm.consumers.Done()
+			closeConsumer(ctx, pConsumer)
+		}(pConsumer)
+	}
+}
+
+// Returns the partitions of the Offset Topic. On a new cluster the topic is
+// only created once a group commits its offsets, so until it has partitions
+// the metadata is refreshed every RetryInterval. It returns the error of the
+// context if it is done first.
+func (qm *QueueMonitor) offsetTopicPartitions(ctx context.Context) (
+	[]int32, error) {
+	for refresh := false; ; refresh = true {
+		partitions, err := qm.fetchOffsetTopicPartitions(refresh)
+		if err == nil && len(partitions) > 0 {
+			return partitions, nil
+		}
+		if err != nil && err != sarama.ErrUnknownTopicOrPartition {
+			log.Errorln("Error occured while getting client partitions.", err)
+			return nil, err
+		}
+		log.Warningln("Waiting for the Offset Topic to be created:",
+			ConsumerOffsetTopic)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(qm.Config.retryInterval()):
+		}
+	}
+}
+
+// Returns the partitions of the Offset Topic, refreshing its metadata first
+// when refresh is set.
+func (qm *QueueMonitor) fetchOffsetTopicPartitions(refresh bool) ([]int32,
+	error) {
+	client, release := qm.acquireClient()
+	defer release()
+	if refresh {
+		err := client.RefreshMetadata(ConsumerOffsetTopic)
+		if err != nil && err != sarama.ErrUnknownTopicOrPartition {
+			log.Errorln("Error while refreshing the topic metadata.", err)
+		}
+	}
+	return client.Partitions(ConsumerOffsetTopic)
+}
+
 // GetBrokerOffsets : Finds out the leader brokers for the partitions and
-// gets the latest commited offsets.
+// gets the latest commited offsets. The partitions are grouped by leader, so
+// that a single offset request is sent to each leader broker per cycle,
+// whatever the number of topics and partitions it leads.
 func (qm *QueueMonitor) GetBrokerOffsets() error {
+	client, release := qm.acquireClient()
+	defer release()
 
+	start := time.Now()
+	defer qm.emitInternalMetrics(start)
 	tpMap := qm.getTopicsAndPartitions(qm.OffsetStore)
-	brokerOffsetRequests := make(map[int32]BrokerOffsetRequest)
+	fetchMap := tpMap
+	if qm.Config.ReportMissing {
+		fetchMap = qm.withAllPartitions(tpMap)
+	}
+	if len(qm.Config.Topics) > 0 {
+		fetchMap = qm.withTopics(fetchMap)
+	}
+	brokerOffsetRequests, partitionCounts, noLeader, err :=
+		qm.groupByLeader(client, fetchMap, tpMap)
+	if err != nil {
+		return err
+	}
+	health := HealthCounts{NoLeader: noLeader}
 
-	for topic, partitions := range tpMap {
-		for _, partition := range partitions {
-			leaderBroker, err := qm.Client.Leader(topic, partition)
-			if err != nil {
-				log.Errorln("Error occured while fetching leader broker:", err)
-				return err
-			}
-			leaderBrokerID := leaderBroker.ID()
+	if qm.Config.PartitionCounts {
+		qm.sendPartitionCounts(fetchMap)
+	}
+	for brokerID, count := range partitionCounts {
+		stat := fmt.Sprintf(".broker.%d.partition_count", brokerID)
+		qm.sendGaugeToStatsd(stat, count)
+	}
 
-			if _, ok := brokerOffsetRequests[leaderBrokerID]; !ok {
-				brokerOffsetRequests[leaderBrokerID] = BrokerOffsetRequest{
-					Broker:        leaderBroker,
-					OffsetRequest: &sarama.OffsetRequest{},
-				}
-			} else {
-				brokerOffsetRequests[leaderBrokerID].OffsetRequest.
-					AddBlock(topic, partition, sarama.OffsetNewest, 1)
-			}
+	if qm.Config.CloseBrokers {
+		openBrokerConns(brokerOffsetRequests, client.Config())
+	}
+	brokerOffsets, fetchErr := qm.fetchBrokerOffsets(brokerOffsetRequests)
+	if qm.Config.CloseBrokers {
+		closeBrokerConns(brokerOffsetRequests)
+	}
+	// Without a maximum age for the broker offsets, only the offsets fetched
+	// in this cycle can be used, so a failed fetch fails the cycle.
+	maxAge := qm.Config.BrokerOffsetMaxAge
+	if fetchErr != nil && maxAge == 0 {
+		return fetchErr
+	}
+	now := time.Now()
+	for topic, partitionMap := range brokerOffsets {
+		for partition, offset := range partitionMap {
+			qm.BrokerOffsetStore.Store(topic, partition, offset, now)
 		}
 	}
+	qm.emitBrokerOffsets(now, maxAge)
 
-	for _, brokerOffsetRequest := range brokerOffsetRequests {
-		err := qm.sendBrokerOffsets(&brokerOffsetRequest)
+	lags, missing, total := qm.computeLags(tpMap, now, maxAge)
+	qm.sendGaugeToStatsd(".missing_broker_offset", int64(missing))
+	health.Partitions = total
+	health.MissingOffsets = missing - health.NoLeader
+	qm.countLagProblems(&health, lags, now)
+	qm.sendGaugeToStatsd(".cluster.health_score", HealthScore(health))
+	qm.Status.cycleCompleted(start, total, total-missing)
+	sortLags(lags)
+	qm.sendLags(lags)
+	qm.sendNegativeLags(lags)
+	if qm.Config.Thresholds != nil {
+		qm.sendLevels(lags)
+	}
+	if qm.Config.TimeLag {
+		qm.sendTimeLags(lags)
+	}
+	if qm.Config.CommitAge {
+		qm.sendCommitAges(lags, now)
+	}
+	qm.report(lags)
+	if qm.Config.ReportMissing {
+		qm.sendMissingCommits(fetchMap, now, maxAge)
+	}
+	if qm.PauseDetector != nil {
+		err := qm.detectPaused(lags)
 		if err != nil {
-			return err
+			log.Errorln("Error while detecting paused partitions:", err)
 		}
 	}
+	// The lags have been sent with the stored offsets of the brokers that
+	// failed, so the cycle isn't retried, which would send them twice.
+	if fetchErr != nil {
+		log.Errorln("Broker offsets older than this cycle were used:", fetchErr)
+	}
 	return nil
 }
 
@@ -200,12 +803,18 @@ func (qm *QueueMonitor) GetBrokerOffsets() error {
 // parses the received messages and store it in the offset store. If the
 // DueForRemoval flag is set, then the Consumer Group is marked for deletion.
 func (qm *QueueMonitor) consumeMessage(pConsumer sarama.PartitionConsumer,
-	cCancel func()) {
+	partition int32, cCancel func()) {
 	defer cCancel()
+	qm.Status.consumerRunning(partition, true)
+	defer qm.Status.consumerRunning(partition, false)
 	for message := range pConsumer.Messages() {
-		partitionOffset, err := ParseConsumerMessage(message)
+		qm.Status.setConsumerLag(partition,
+			pConsumer.HighWaterMarkOffset()-message.Offset-1)
+		qm.positions.Store(partition, message.Offset+1)
+		partitionOffset, err := qm.Parser(message)
 		if err != nil {
 			log.Errorln("Error while parsing consumer message:", err)
+			atomic.AddInt64(&qm.parseErrors, 1)
 			continue
 		}
 		if partitionOffset != nil {
@@ -218,31 +827,452 @@ func (qm *QueueMonitor) consumeMessage(pConsumer sarama.PartitionConsumer,
 	}
 }
 
+// Computes the lags of the partitions passed as argument from the Offset
+// Store and the broker offsets fetched within maxAge before now. It also
+// returns the number of partitions without a broker offset and the total
+// number of partitions.
+func (qm *QueueMonitor) computeLags(tpMap map[string][]int32, now time.Time,
+	maxAge time.Duration) ([]PartitionLag, int, int) {
+	var lags []PartitionLag
+	missing, total := 0, 0
+	for topic, partitions := range tpMap {
+		for _, partition := range partitions {
+			if !qm.Config.PartitionFilter.Allowed(topic, partition) {
+				continue
+			}
+			total++
+			brokerOffset, ok := qm.BrokerOffsetStore.Load(topic, partition,
+				now, maxAge)
+			if !ok {
+				log.Debugf("Missing broker offset for topic: %s partition: %d",
+					topic, partition)
+				missing++
+				continue
+			}
+			partitionLags, err := qm.lag(topic, partition, brokerOffset)
+			if err != nil {
+				log.Warningln("Error while computing lag:", err)
+				continue
+			}
+			lags = append(lags, partitionLags...)
+		}
+	}
+	return lags, missing, total
+}
+
+// Sends the offset requests to their brokers and merges the offsets in the
+// responses. The requests are sent by a pool of at most MaxBrokerConcurrency
+// workers. The metadata of the topics whose leaders turned out to be stale
+// is refreshed afterwards, so that the next cycle asks the new leaders.
+func (qm *QueueMonitor) fetchBrokerOffsets(
+	requests map[int32]*BrokerOffsetRequest) (map[string]map[int32]int64, error) {
+	var (
+		mutex     sync.Mutex
+		fetchErrs []error
+	)
+	brokerOffsets := make(map[string]map[int32]int64)
+	staleTopics := make(map[string]bool)
+	runWorkers(qm.Config.MaxBrokerConcurrency, requests,
+		func(request *BrokerOffsetRequest) {
+			offsets := make(map[string]map[int32]int64)
+			stale, err := qm.sendBrokerOffsets(request, offsets)
+			if err != nil {
+				atomic.AddInt64(&qm.brokerErrors, 1)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, topic := range stale {
+				staleTopics[topic] = true
+			}
+			if err != nil {
+				fetchErrs = append(fetchErrs, fmt.Errorf("Broker %d: %s",
+					request.Broker.ID(), err))
+				return
+			}
+			for topic, partitionMap := range offsets {
+				if _, ok := brokerOffsets[topic]; !ok {
+					brokerOffsets[topic] = make(map[int32]int64)
+				}
+				for partition, offset := range partitionMap {
+					brokerOffsets[topic][partition] = offset
+				}
+			}
+		})
+	if len(staleTopics) > 0 {
+		qm.refreshLeaders(staleTopics)
+	}
+	return brokerOffsets, joinErrors(fetchErrs)
+}
+
+// Refreshes the metadata of the topics, which holds their partition leaders.
+func (qm *QueueMonitor) refreshLeaders(topics map[string]bool) {
+	client, release := qm.acquireClient()
+	defer release()
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+	log.Infoln("Refreshing the leaders of topics:", names)
+	err := client.RefreshMetadata(names...)
+	if err != nil {
+		log.Errorln("Error while refreshing the topic metadata.", err)
+	}
+}
+
+// Number of times the partitions failing with a transient error are retried
+// within a cycle, and the time to wait for before each retry.
+const transientRetries = 2
+
+var transientBackoff = 100 * time.Millisecond
+
+// Reports whether the error of a response block is transient, as when a
+// broker has just restarted and is still loading the offsets or electing
+// the leaders, so that the request is worth retrying within the cycle. A
+// broker that doesn't lead the partition anymore would fail the retry as
+// well, so its leaders are refreshed for the next cycle instead.
+func transientError(err sarama.KError) bool {
+	return err == sarama.ErrOffsetsLoadInProgress ||
+		err == sarama.ErrLeaderNotAvailable
+}
+
+// Requests again the partitions of the offset response failing with a
+// transient error, and replaces their blocks with those of the retry. The
+// blocks still failing after the last retry are left for the caller.
+func (qm *QueueMonitor) retryTransientBlocks(broker *sarama.Broker,
+	response *sarama.OffsetResponse) {
+	for attempt := 1; attempt <= transientRetries; attempt++ {
+		retry := &sarama.OffsetRequest{}
+		count := 0
+		for topic, partitionMap := range response.Blocks {
+			for partition, block := range partitionMap {
+				if transientError(block.Err) {
+					retry.AddBlock(topic, partition, sarama.OffsetNewest, 1)
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			return
+		}
+		log.Warningf("Retrying %d partitions with transient errors on "+
+			"broker %d, attempt %d", count, broker.ID(), attempt)
+		time.Sleep(transientBackoff)
+		retryResponse, err := qm.getAvailableOffsets(broker, retry)
+		if err != nil {
+			log.Errorln("Error while retrying available offsets from broker.",
+				err)
+			return
+		}
+		for topic, partitionMap := range retryResponse.Blocks {
+			for partition, block := range partitionMap {
+				response.Blocks[topic][partition] = block
+			}
+		}
+	}
+}
+
+// Reports whether the error of an offset response block means that the
+// broker doesn't lead the partition anymore.
+func leadershipError(err sarama.KError) bool {
+	return err == sarama.ErrNotLeaderForPartition ||
+		err == sarama.ErrLeaderNotAvailable ||
+		err == sarama.ErrUnknownTopicOrPartition
+}
+
+// Calls fn for each of the requests from a pool of workers, and returns once
+// all the calls are done. There's a worker per request when the number of
+// workers is not positive.
+func runWorkers(workers int, requests map[int32]*BrokerOffsetRequest,
+	fn func(request *BrokerOffsetRequest)) {
+	if workers <= 0 || workers > len(requests) {
+		workers = len(requests)
+	}
+	queue := make(chan *BrokerOffsetRequest)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for request := range queue {
+				fn(request)
+			}
+		}()
+	}
+	for _, request := range requests {
+		queue <- request
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// Adds a block for the topic and partition to the offset request of its
+// leader broker, creating the request if it is the first partition of the
+// broker.
+func addBrokerOffsetBlock(requests map[int32]*BrokerOffsetRequest,
+	brokerID int32, broker *sarama.Broker, topic string, partition int32) {
+	request, ok := requests[brokerID]
+	if !ok {
+		request = &BrokerOffsetRequest{
+			Broker:        broker,
+			OffsetRequest: &sarama.OffsetRequest{},
+		}
+		requests[brokerID] = request
+	}
+	request.AddBlock(topic, partition)
+}
+
 // sendBrokerOffsets : Makes the actual networks call to the broker using the
 // offset request passed as argument to it. On receiving response, it parses
-// through the response blocks and calls the lag() method for each broker
-// offset.
-func (qm *QueueMonitor) sendBrokerOffsets(request *BrokerOffsetRequest) error {
-	response, err := request.Broker.GetAvailableOffsets(request.OffsetRequest)
+// through the response blocks and stores the offset of each partition in the
+// broker offsets map passed as argument. Requested partitions missing from
+// the response are logged and counted. It returns the topics for which the
+// broker may not be the leader anymore: those of the partitions with a
+// leadership error or missing from the response, or all of them when the
+// request fails.
+func (qm *QueueMonitor) sendBrokerOffsets(request *BrokerOffsetRequest,
+	brokerOffsets map[string]map[int32]int64) ([]string, error) {
+	var stale []string
+	response, err := qm.getAvailableOffsets(request.conn(),
+		request.OffsetRequest)
 	if err != nil {
 		log.Errorln("Error while getting available offsets from broker.", err)
-		return err
+		for topic := range request.Partitions {
+			stale = append(stale, topic)
+		}
+		return stale, err
 	}
+	qm.retryTransientBlocks(request.conn(), response)
 
 	for topic, partitionMap := range response.Blocks {
 		for partition, offsetResponseBlock := range partitionMap {
 			if offsetResponseBlock.Err != sarama.ErrNoError {
 				log.Errorln("Error in offset response block.",
 					offsetResponseBlock.Err.Error())
+				if leadershipError(offsetResponseBlock.Err) {
+					stale = append(stale, topic)
+				}
+				continue
+			}
+			if len(offsetResponseBlock.Offsets) == 0 {
+				log.Errorln("No offsets in offset response block.")
+				continue
+			}
+			if _, ok := brokerOffsets[topic]; !ok {
+				brokerOffsets[topic] = make(map[int32]int64)
+			}
+			brokerOffsets[topic][partition] = offsetResponseBlock.Offsets[0]
+		}
+	}
+
+	// A broker omits the partitions it no longer leads from the response.
+	// Those are left out of the broker offsets map and counted, so that no
+	// lag is computed for them in this cycle.
+	missing := 0
+	for topic, partitions := range request.Partitions {
+		for _, partition := range partitions {
+			if response.GetBlock(topic, partition) == nil {
+				log.Warningf("Broker %d omitted offset for topic: %s "+
+					"partition: %d", request.Broker.ID(), topic, partition)
+				missing++
+				stale = append(stale, topic)
+			}
+		}
+	}
+	stat := fmt.Sprintf(".broker.%d.missing_offsets", request.Broker.ID())
+	qm.sendGaugeToStatsd(stat, int64(missing))
+	if request.LogStartRequest != nil {
+		qm.sendLogStartOffsets(request)
+	}
+	return stale, nil
+}
+
+// Requests the log start offsets of the partitions led by the broker, then
+// stores them in the LogStartStore and sends them. Failing to get them
+// doesn't fail the cycle, whose lags only need the log end offsets.
+func (qm *QueueMonitor) sendLogStartOffsets(request *BrokerOffsetRequest) {
+	response, err := qm.getAvailableOffsets(request.conn(),
+		request.LogStartRequest)
+	if err != nil {
+		log.Errorln("Error while getting log start offsets from broker.", err)
+		return
+	}
+	now := time.Now()
+	for topic, partitionMap := range response.Blocks {
+		for partition, block := range partitionMap {
+			if block.Err != sarama.ErrNoError || len(block.Offsets) == 0 {
+				log.Warningf("No log start offset for topic: %s partition: %d",
+					topic, partition)
 				continue
 			}
-			brokerOffset := offsetResponseBlock.Offsets[0]
-			qm.lag(topic, partition, brokerOffset)
+			qm.LogStartStore.Store(topic, partition, block.Offsets[0], now)
+			qm.sendGaugeToStatsd(fmt.Sprintf(".topic.%s.%d.log_start", topic,
+				partition), block.Offsets[0])
+		}
+	}
+}
+
+// Sends the offset request to the broker, giving up after the FetchTimeout
+// if it is set, so that a stalled broker doesn't block the cycle. The
+// response of a request that timed out is dropped once it arrives.
+func (qm *QueueMonitor) getAvailableOffsets(broker *sarama.Broker,
+	request *sarama.OffsetRequest) (*sarama.OffsetResponse, error) {
+	timeout := qm.Config.FetchTimeout
+	if timeout <= 0 {
+		return broker.GetAvailableOffsets(request)
+	}
+	type result struct {
+		response *sarama.OffsetResponse
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := broker.GetAvailableOffsets(request)
+		results <- result{response, err}
+	}()
+	select {
+	case r := <-results:
+		return r.response, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Offset request timed out after %s", timeout)
+	}
+}
+
+// Creates a Kafka client for the configured brokers. If ResolveBrokers is set,
+// the broker hostnames are looked up first so that a client is only created
+// once at least one of them resolves.
+func newClient(cfg *QMConfig) (sarama.Client, error) {
+	if cfg.KafkaCfg.ResolveBrokers {
+		err := resolveBrokers(cfg.KafkaCfg.Brokers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config, err := NewSaramaConfig(&cfg.KafkaCfg)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewClient(cfg.KafkaCfg.Brokers, config)
+}
+
+// NewSaramaConfig : Returns the sarama configuration for the Kafka client
+// based on the KafkaConfig.
+func NewSaramaConfig(cfg *KafkaConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	// Required for the producers built from the client.
+	config.Producer.Return.Successes = true
+	if cfg.ClientID != "" {
+		config.ClientID = cfg.ClientID
+	}
+	// The zero version keeps the sarama default.
+	if cfg.Version != (sarama.KafkaVersion{}) {
+		config.Version = cfg.Version
+	}
+	// The errors of the Offset Topic consumers are counted instead of only
+	// being logged by sarama.
+	config.Consumer.Return.Errors = true
+	if cfg.FetchDefault > 0 {
+		config.Consumer.Fetch.Default = cfg.FetchDefault
+	}
+	if cfg.FetchMax > 0 {
+		config.Consumer.Fetch.Max = cfg.FetchMax
+	}
+	if cfg.MaxWaitTime > 0 {
+		config.Consumer.MaxWaitTime = cfg.MaxWaitTime
+	}
+	if cfg.ReadTimeout > 0 {
+		config.Net.ReadTimeout = cfg.ReadTimeout
+	}
+	if cfg.MetadataRefresh > 0 {
+		config.Metadata.RefreshFrequency = cfg.MetadataRefresh
+	}
+	if cfg.MetadataRetryMax > 0 {
+		config.Metadata.Retry.Max = cfg.MetadataRetryMax
+	}
+	if cfg.SASLEnabled {
+		if err := ValidateSASL(cfg); err != nil {
+			return nil, err
+		}
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = cfg.SASLUser
+		config.Net.SASL.Password = cfg.SASLPassword
+	}
+	if cfg.TLSEnabled {
+		tlsConfig, err := NewTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	return config, nil
+}
+
+// Resolves the broker hostnames and logs the addresses they resolve to.
+func resolveBrokers(brokers []string) error {
+	resolved := 0
+	for _, broker := range brokers {
+		host, _, err := net.SplitHostPort(broker)
+		if err != nil {
+			log.Errorf("Invalid broker address %s: %s", broker, err)
+			continue
 		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			log.Errorf("Error while resolving broker %s: %s", broker, err)
+			continue
+		}
+		log.Infof("Broker %s resolved to %v", broker, addrs)
+		resolved++
+	}
+	if resolved == 0 {
+		return fmt.Errorf("None of the brokers could be resolved: %v", brokers)
 	}
 	return nil
 }
 
+// Opens a connection of its own to the broker of each offset request, so
+// that it can be closed after the cycle without closing the brokers shared
+// by the client. The requests whose connection fails to open are sent to
+// the shared broker instead.
+func openBrokerConns(requests map[int32]*BrokerOffsetRequest,
+	config *sarama.Config) {
+	for _, request := range requests {
+		conn := sarama.NewBroker(request.Broker.Addr())
+		if err := conn.Open(config); err != nil {
+			log.Errorf("Error while connecting to broker %d: %s",
+				request.Broker.ID(), err)
+			continue
+		}
+		request.Conn = conn
+	}
+}
+
+// Closes the connections opened by openBrokerConns.
+func closeBrokerConns(requests map[int32]*BrokerOffsetRequest) {
+	for _, request := range requests {
+		if request.Conn == nil {
+			continue
+		}
+		err := request.Conn.Close()
+		if err != nil && err != sarama.ErrNotConnected {
+			log.Errorf("Error while closing connection to broker %d: %s",
+				request.Broker.ID(), err)
+		}
+		request.Conn = nil
+	}
+}
+
+// Logs and counts the errors of the partition consumer, such as messages
+// failing to decompress or too large for the maximum fetch size, which don't
+// stop the consumer. It returns once the consumer is closed.
+func (qm *QueueMonitor) consumeErrors(pConsumer sarama.PartitionConsumer) {
+	for err := range pConsumer.Errors() {
+		log.Errorln("Error while consuming the Offset Topic:", err)
+		atomic.AddInt64(&qm.consumerErrors, 1)
+	}
+}
+
 // Closes the specified Partition Consumer when the context is done.
 func closeConsumer(ctx context.Context, pConsumer sarama.PartitionConsumer) {
 	<-ctx.Done()
@@ -259,8 +1289,14 @@ func (qm *QueueMonitor) getTopicsAndPartitions(offsetStore *syncmap.Map) map[str
 	tpMap := make(map[string][]int32)
 	offsetStore.Range(func(topicI, tbodyI interface{}) bool {
 		topic := topicI.(string)
+		if !qm.Config.TopicFilter.Allowed(topic) {
+			return true
+		}
 		tbodyI.(*syncmap.Map).Range(func(partitionI, _ interface{}) bool {
-			tpMap[topic] = append(tpMap[topic], partitionI.(int32))
+			partition := partitionI.(int32)
+			if qm.partitionAllowed(topic, partition) {
+				tpMap[topic] = append(tpMap[topic], partition)
+			}
 			return true
 		})
 		return true
@@ -268,61 +1304,233 @@ func (qm *QueueMonitor) getTopicsAndPartitions(offsetStore *syncmap.Map) map[str
 	return tpMap
 }
 
-// Computes the lag and sends the data as a gauge to Statsd.
-func (qm *QueueMonitor) lag(topic string, partition int32, brokerOffset int64) error {
+// Groups the partitions of fetchMap into an offset request per leader broker,
+// and counts the partitions led by each broker. Also returns the number of
+// partitions of tpMap, the ones the lags are computed for, without a leader,
+// so that they can be told apart from the partitions missing a broker offset.
+func (qm *QueueMonitor) groupByLeader(client sarama.Client, fetchMap,
+	tpMap map[string][]int32) (map[int32]*BrokerOffsetRequest,
+	map[int32]int64, int, error) {
+	brokerOffsetRequests := make(map[int32]*BrokerOffsetRequest)
+	partitionCounts := make(map[int32]int64)
+	noLeader := 0
+	for topic, partitions := range fetchMap {
+		for _, partition := range partitions {
+			leaderBroker, err := client.Leader(topic, partition)
+			if err == sarama.ErrLeaderNotAvailable {
+				log.Warningf("No leader for topic: %s partition: %d",
+					topic, partition)
+				if hasPartition(tpMap, topic, partition) {
+					noLeader++
+				}
+				continue
+			}
+			if err != nil {
+				log.Errorln("Error occured while fetching leader broker:", err)
+				return nil, nil, 0, err
+			}
+			leaderBrokerID := leaderBroker.ID()
+			partitionCounts[leaderBrokerID]++
+
+			addBrokerOffsetBlock(brokerOffsetRequests, leaderBrokerID,
+				leaderBroker, topic, partition)
+			if qm.Config.TrackLogStart {
+				brokerOffsetRequests[leaderBrokerID].AddLogStartBlock(topic,
+					partition)
+			}
+		}
+	}
+	return brokerOffsetRequests, partitionCounts, noLeader, nil
+}
+
+// Returns whether the partition of the topic is in the map of topics and
+// partitions.
+func hasPartition(tpMap map[string][]int32, topic string,
+	partition int32) bool {
+	for _, candidate := range tpMap[topic] {
+		if candidate == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// Computes the lag of each group consuming the topic and partition. No lags
+// are computed for the topics not passing the topic filter.
+func (qm *QueueMonitor) lag(topic string, partition int32, brokerOffset int64) (
+	[]PartitionLag, error) {
+	if !qm.Config.TopicFilter.Allowed(topic) {
+		return nil, nil
+	}
 	tmp, ok := qm.OffsetStore.Load(topic)
 	if !ok {
-		return fmt.Errorf("Topic doesn't exist in Offset Store: %s", topic)
+		return nil, fmt.Errorf("Topic doesn't exist in Offset Store: %s", topic)
 	}
 	tpOffsetMap, ok := tmp.(*syncmap.Map)
 	if !ok {
-		return fmt.Errorf("Not a valid syncmap at Topic: %s", topic)
+		return nil, fmt.Errorf("Not a valid syncmap at Topic: %s", topic)
 	}
 	tmp, ok = tpOffsetMap.Load(partition)
 	if !ok {
-		return fmt.Errorf("Partition doesn't exist in syncmap: %d", partition)
+		return nil, fmt.Errorf("Partition doesn't exist in syncmap: %d", partition)
 	}
 	pOffsetMap, ok := tmp.(*syncmap.Map)
 	if !ok {
-		return fmt.Errorf("Not a valid syncmap at Partition: %d", partition)
+		return nil, fmt.Errorf("Not a valid syncmap at Partition: %d", partition)
 	}
+	var lags []PartitionLag
 	pOffsetMap.Range(func(groupI, offsetI interface{}) bool {
 		group, ok := groupI.(string)
 		if !ok {
 			log.Warningln("Invalid cast to string for group.")
 			return false
 		}
-		offset, ok := offsetI.(int64)
+		consumerOffset, ok := offsetI.(ConsumerOffset)
 		if !ok {
-			log.Warningln("Invalid cast to int64 for offset.")
+			log.Warningln("Invalid cast to ConsumerOffset for offset.")
 			return false
 		}
+		offset := consumerOffset.Offset
 		lag := brokerOffset - offset
-		if lag < 0 {
+		if lag < 0 && !qm.Config.AllowNegativeLag {
 			lag = 0
 		}
-		stat := fmt.Sprintf(".group.%s.%s.%d", group, topic, partition)
-		go qm.sendGaugeToStatsd(stat, lag)
+		lags = append(lags, PartitionLag{
+			Group:          group,
+			Topic:          topic,
+			Partition:      partition,
+			BrokerOffset:   brokerOffset,
+			ConsumerOffset: offset,
+			Lag:            lag,
+		})
 		return true
 	})
-	return nil
+	return lags, nil
+}
+
+// Sends the lags as gauges to Statsd at each of the configured granularities.
+// Topic and group level gauges are the sums of the partition lags. When lag
+// smoothing is enabled, the partition gauges carry the smoothed lag and the
+// raw lag is sent with a ".raw" suffix. The lags are expected to be sorted,
+// and the gauges are sent in that order so that the packets are stable
+// across cycles. The total lag of each rollup follows, and with RollupOnly
+// the gauges of the groups mapped to a rollup are left out. Unless
+// AllowNegativeLag is set, no partition gauge is sent where the consumer
+// offset is ahead of the broker offset, those being counted instead.
+func (qm *QueueMonitor) sendLags(lags []PartitionLag) {
+	granularity := qm.Config.Granularity
+	var smoothed []int64
+	if qm.LagSmoother != nil {
+		smoothed = qm.LagSmoother.Smooth(lags)
+	}
+	if granularity[PartitionGranularity] {
+		sampleRate := qm.Config.StatsdCfg.sampleRate()
+		for index, lag := range lags {
+			if qm.rolledUp(lag.Group) || (lag.ConsumerOffset > lag.BrokerOffset &&
+				!qm.Config.AllowNegativeLag) {
+				continue
+			}
+			stat := qm.partitionStat(lag.Group, lag.Topic, lag.Partition, "")
+			if smoothed != nil {
+				qm.sendSampledGauge(stat, smoothed[index], sampleRate)
+				qm.sendSampledGauge(qm.partitionStat(lag.Group, lag.Topic,
+					lag.Partition, ".raw"), lag.Lag, sampleRate)
+			} else {
+				qm.sendSampledGauge(stat, lag.Lag, sampleRate)
+			}
+		}
+	}
+	if granularity[TopicGranularity] {
+		for index := 0; index < len(lags); {
+			group, topic := lags[index].Group, lags[index].Topic
+			var total int64
+			for ; index < len(lags) && lags[index].Group == group &&
+				lags[index].Topic == topic; index++ {
+				total += nonNegative(lags[index].Lag)
+			}
+			if !qm.rolledUp(group) {
+				qm.sendGaugeToStatsd(fmt.Sprintf(".group.%s.%s.total", group,
+					topic), total)
+			}
+		}
+	}
+	if granularity[GroupGranularity] {
+		for index := 0; index < len(lags); {
+			group := lags[index].Group
+			var total int64
+			for ; index < len(lags) && lags[index].Group == group; index++ {
+				total += nonNegative(lags[index].Lag)
+			}
+			if !qm.rolledUp(group) {
+				qm.sendGaugeToStatsd(fmt.Sprintf(".group.%s.total", group), total)
+			}
+		}
+	}
+	if len(qm.Config.Rollups) > 0 {
+		qm.sendRollups(lags)
+	}
+}
+
+// Clamps a lag to zero, so that the totals aren't reduced by the negative
+// lags reported with AllowNegativeLag.
+func nonNegative(lag int64) int64 {
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+// Sorts the lags by group, topic and partition.
+func sortLags(lags []PartitionLag) {
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Group != lags[j].Group {
+			return lags[i].Group < lags[j].Group
+		}
+		if lags[i].Topic != lags[j].Topic {
+			return lags[i].Topic < lags[j].Topic
+		}
+		return lags[i].Partition < lags[j].Partition
+	})
 }
 
-// Store newly received consumer offset.
+// Sends the lags computed in a cycle to all the reporters.
+func (qm *QueueMonitor) report(lags []PartitionLag) {
+	now := time.Now()
+	for _, reporter := range qm.Reporters {
+		err := reporter.Report(now, lags)
+		if err != nil {
+			log.Errorln("Error while reporting lag:", err)
+		}
+		qm.Status.reported(reporterName(reporter), err)
+	}
+}
+
+// Store newly received consumer offset. The offsets of the groups not
+// passing the group filter aren't stored.
 func (qm *QueueMonitor) storeConsumerOffset(newOffset *PartitionOffset) bool {
 	topic, partition, group, offset := newOffset.Topic,
 		newOffset.Partition, newOffset.Group, newOffset.Offset
+	if !qm.Config.GroupFilter.Allowed(group) {
+		return false
+	}
 	tmp, _ := qm.OffsetStore.LoadOrStore(topic, new(syncmap.Map))
 	tpOffsetMap, _ := tmp.(*syncmap.Map)
 
 	tmp, _ = tpOffsetMap.LoadOrStore(partition, new(syncmap.Map))
 	pOffsetMap, _ := tmp.(*syncmap.Map)
 
-	pOffsetMap.Store(group, offset)
+	pOffsetMap.Store(group, ConsumerOffset{offset, newOffset.Timestamp})
+	atomic.StoreInt32(&qm.offsetStored, 1)
+	qm.storeCommitTimestamp(group, newOffset.Timestamp)
+	if qm.Config.StaleTimeout > 0 {
+		qm.touchConsumerOffset(newOffset, time.Now())
+	}
 	return true
 }
 
-// Remove a Consumer Group from the Offset Store.
+// Remove a Consumer Group from the Offset Store, along with its other state
+// once it has no offsets left. The commit timestamp of the group is kept, so
+// that the retention risk of its offsets is still reported.
 func (qm *QueueMonitor) removeConsumerGroup(p *PartitionOffset) bool {
 	topic, partition, group := p.Topic, p.Partition, p.Group
 
@@ -337,22 +1545,116 @@ func (qm *QueueMonitor) removeConsumerGroup(p *PartitionOffset) bool {
 	}
 	pOffsetMap, _ := tmp.(*syncmap.Map)
 	pOffsetMap.Delete(group)
+	qm.LastSeen.Delete(groupPartition{group, topic, partition})
+	if !qm.groupHasOffsets(group) {
+		qm.Coordinators.Delete(group)
+		for _, reporter := range qm.Reporters {
+			if remover, ok := reporter.(GroupRemover); ok {
+				remover.RemoveGroup(group)
+			}
+		}
+	}
 
 	log.Infof("Removed topic: %s partition: %d group: %s",
 		topic, partition, group)
 	return true
 }
 
+// Returns whether the group has a committed offset at any partition.
+func (qm *QueueMonitor) groupHasOffsets(group string) bool {
+	found := false
+	qm.OffsetStore.Range(func(_, tpOffsetMapI interface{}) bool {
+		tpOffsetMapI.(*syncmap.Map).Range(func(_, pOffsetMapI interface{}) bool {
+			_, found = pOffsetMapI.(*syncmap.Map).Load(group)
+			return !found
+		})
+		return !found
+	})
+	return found
+}
+
 // Sends the gauge to Statsd.
 func (qm *QueueMonitor) sendGaugeToStatsd(stat string, value int64) {
-	if qm.StatsdClient == nil {
+	qm.sendGauge(qm.Config.StatsdCfg.Prefix+stat, value)
+}
+
+// Renders the name of a metric of a group at a partition from the metric
+// template, with the suffix appended. In the DogStatsD format, the name is
+// <prefix>.consumer.lag, or <prefix>.consumer with the suffix, and the
+// group, topic and partition are sent as tags instead.
+func (qm *QueueMonitor) partitionStat(group, topic string, partition int32,
+	suffix string) string {
+	if qm.Config.StatsdCfg.Format == DogStatsdFormat {
+		if suffix == "" {
+			suffix = ".lag"
+		}
+		return DogStatsdStat(qm.Config.StatsdCfg.Prefix+".consumer"+suffix,
+			"group:"+group, "topic:"+topic, fmt.Sprint("partition:", partition))
+	}
+	template := qm.Config.StatsdCfg.MetricTemplate
+	if template == "" {
+		template = DefaultMetricTemplate
+	}
+	return RenderMetricTemplate(template, qm.Config.StatsdCfg.Prefix, group,
+		topic, partition) + suffix
+}
+
+// Sends a gauge with its full name, including the prefix, to every Statsd
+// client. A failing client doesn't keep the gauge from the others.
+func (qm *QueueMonitor) sendGauge(name string, value int64) {
+	qm.sendSampledGauge(name, value, 1)
+}
+
+// Sends the gauge to every Statsd client like sendGauge, with the sample
+// rate passed to the clients supporting it.
+func (qm *QueueMonitor) sendSampledGauge(name string, value int64,
+	sampleRate float32) {
+	if len(qm.StatsdClients) == 0 {
 		log.Warningln("Statsd Client not initialized yet.")
 		return
 	}
-	err := qm.StatsdClient.Gauge(stat, value)
-	if err != nil {
-		log.Errorln("Error while sending gauge to statsd:", err)
-		return
+	var sendErr error
+	for _, statsdClient := range qm.StatsdClients {
+		err := sendSampledGauge(statsdClient, name, value, sampleRate)
+		if err != nil {
+			log.Errorln("Error while sending gauge to statsd:", err)
+			sendErr = err
+		}
+	}
+	qm.Status.reported("statsd", sendErr)
+	if sendErr == nil {
+		log.Debugf("Gauge sent to Statsd: %s=%d", name, value)
+	}
+}
+
+// Increments a counter, named after the prefix and the stat, on every Statsd
+// client supporting counters.
+func (qm *QueueMonitor) sendCountToStatsd(stat string, count int64) {
+	name := qm.Config.StatsdCfg.Prefix + stat
+	var sendErr error
+	for _, statsdClient := range qm.StatsdClients {
+		counting, ok := statsdClient.(CountingStatsdEmitter)
+		if !ok {
+			continue
+		}
+		err := counting.Incr(name, count)
+		if err != nil {
+			log.Errorln("Error while sending counter to statsd:", err)
+			sendErr = err
+		}
+	}
+	qm.Status.reported("statsd", sendErr)
+	if sendErr == nil {
+		log.Debugf("Counter sent to Statsd: %s+%d", name, count)
+	}
+}
+
+// Sends the gauge with the sample rate if it is below 1 and the emitter
+// supports sampling, or as a plain gauge otherwise.
+func sendSampledGauge(emitter StatsdEmitter, name string, value int64,
+	sampleRate float32) error {
+	if sampled, ok := emitter.(SampledStatsdEmitter); ok && sampleRate < 1 {
+		return sampled.GaugeWithSampling(name, value, sampleRate)
 	}
-	log.Infof("Gauge sent to Statsd: %s=%d", stat, value)
+	return emitter.Gauge(name, value)
 }
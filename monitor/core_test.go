@@ -0,0 +1,1189 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/quipo/statsd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/syncmap"
+)
+
+// recordingStatsd : Statsd client recording the gauges and counters sent to
+// it.
+type recordingStatsd struct {
+	statsd.NoopClient
+	mutex  sync.Mutex
+	gauges []string
+	counts []string
+}
+
+func (r *recordingStatsd) Gauge(stat string, value int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.gauges = append(r.gauges, fmt.Sprintf("%s=%d", stat, value))
+	return nil
+}
+
+func (r *recordingStatsd) Incr(stat string, count int64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts = append(r.counts, fmt.Sprintf("%s+%d", stat, count))
+	return nil
+}
+
+func newTestMonitor(cfg *QMConfig) (*QueueMonitor, *recordingStatsd) {
+	recorder := &recordingStatsd{}
+	return &QueueMonitor{
+		Config:            cfg,
+		StatsdClients:     []StatsdEmitter{recorder},
+		Status:            NewStatus(),
+		OffsetStore:       &syncmap.Map{},
+		CommitTimestamps:  &syncmap.Map{},
+		LastSeen:          &syncmap.Map{},
+		Coordinators:      &syncmap.Map{},
+		BrokerOffsetStore: NewBrokerOffsetStore(),
+		LogStartStore:     NewBrokerOffsetStore(),
+		Allowlist:         &Allowlist{},
+	}, recorder
+}
+
+// Returns a mock broker serving the responses passed, and a broker connected
+// to it, to be used as the leader of every partition. Both are closed at the
+// end of the test.
+func newLeaderBroker(t *testing.T,
+	handlers map[string]sarama.MockResponse) (*sarama.MockBroker,
+	*sarama.Broker) {
+	leader := sarama.NewMockBroker(t, 1)
+	leader.SetHandlerByMap(handlers)
+	// The fetch requests with timestamps require Kafka 0.10.
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_0_0
+	broker := sarama.NewBroker(leader.Addr())
+	assert.NoError(t, broker.Open(config))
+	t.Cleanup(func() {
+		broker.Close()
+		leader.Close()
+	})
+	return leader, broker
+}
+
+// sampledStatsd : Statsd emitter recording the sample rate of the gauges.
+type sampledStatsd struct {
+	recordingStatsd
+	rates []string
+}
+
+func (r *sampledStatsd) GaugeWithSampling(stat string, value int64,
+	sampleRate float32) error {
+	r.rates = append(r.rates, fmt.Sprintf("%s=%d@%g", stat, value, sampleRate))
+	return nil
+}
+
+func TestSendLagsSampleRate(t *testing.T) {
+	granularity, err := ParseGranularity("partition,topic")
+	assert.NoError(t, err)
+	qm, _ := newTestMonitor(&QMConfig{
+		Granularity: granularity,
+		StatsdCfg:   StatsdConfig{Prefix: "kqm", SampleRate: 0.5},
+	})
+	emitter := &sampledStatsd{}
+	qm.StatsdClients = []StatsdEmitter{emitter}
+	qm.sendLags([]PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: "g1", Topic: "t1", Partition: 1, Lag: 3},
+	})
+	// Only the per partition gauges are sampled.
+	assert.Equal(t, []string{
+		"kqm.group.g1.t1.0=5@0.5",
+		"kqm.group.g1.t1.1=3@0.5",
+	}, emitter.rates)
+	assert.Equal(t, []string{"kqm.group.g1.t1.total=8"}, emitter.gauges)
+}
+
+func TestSendLagsOrder(t *testing.T) {
+	granularity, err := ParseGranularity("partition,topic,group")
+	assert.NoError(t, err)
+	qm, recorder := newTestMonitor(&QMConfig{Granularity: granularity})
+
+	lags := []PartitionLag{
+		{Group: "g2", Topic: "t1", Partition: 0, Lag: 1},
+		{Group: "g1", Topic: "t2", Partition: 1, Lag: 2},
+		{Group: "g1", Topic: "t1", Partition: 1, Lag: 3},
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 4},
+	}
+	sortLags(lags)
+	qm.sendLags(lags)
+
+	assert.Equal(t, []string{
+		".group.g1.t1.0=4",
+		".group.g1.t1.1=3",
+		".group.g1.t2.1=2",
+		".group.g2.t1.0=1",
+		".group.g1.t1.total=7",
+		".group.g1.t2.total=2",
+		".group.g2.t1.total=1",
+		".group.g1.total=9",
+		".group.g2.total=1",
+	}, recorder.gauges)
+}
+
+func TestSendLagsTotalsClampNegative(t *testing.T) {
+	granularity, err := ParseGranularity("topic,group")
+	assert.NoError(t, err)
+	qm, recorder := newTestMonitor(&QMConfig{
+		Granularity:      granularity,
+		AllowNegativeLag: true,
+	})
+	consumerOffsets := map[int32]int64{0: 90, 1: 120, 2: 40}
+	brokerOffsets := map[int32]int64{0: 100, 1: 100, 2: 50}
+	for partition, offset := range consumerOffsets {
+		qm.storeConsumerOffset(&PartitionOffset{Topic: "t1",
+			Partition: partition, Group: "g1", Offset: offset})
+	}
+
+	var lags []PartitionLag
+	for partition, brokerOffset := range brokerOffsets {
+		partitionLags, err := qm.lag("t1", partition, brokerOffset)
+		assert.NoError(t, err)
+		lags = append(lags, partitionLags...)
+	}
+	sortLags(lags)
+	assert.Equal(t, int64(-20), lags[1].Lag)
+	qm.sendLags(lags)
+
+	assert.Equal(t, []string{
+		".group.g1.t1.total=20",
+		".group.g1.total=20",
+	}, recorder.gauges)
+}
+
+func TestAddBrokerOffsetBlock(t *testing.T) {
+	leaders := map[string]map[int32]int32{
+		"t1": {0: 1, 1: 2, 2: 1},
+		"t2": {0: 2},
+		"t3": {0: 3},
+	}
+	requests := make(map[int32]*BrokerOffsetRequest)
+	for topic, partitions := range leaders {
+		for partition, brokerID := range partitions {
+			addBrokerOffsetBlock(requests, brokerID, nil, topic, partition)
+		}
+	}
+
+	assert.Len(t, requests, 3)
+	for topic, partitions := range leaders {
+		for partition, brokerID := range partitions {
+			assert.Contains(t, requests[brokerID].Partitions[topic], partition)
+		}
+	}
+	assert.Len(t, requests[3].Partitions["t3"], 1)
+}
+
+func TestFetchBrokerOffsetsOwnRequests(t *testing.T) {
+	const brokers = 4
+	qm, _ := newTestMonitor(&QMConfig{MaxBrokerConcurrency: brokers})
+	requests := make(map[int32]*BrokerOffsetRequest)
+	expected := make(map[string]map[int32]int64)
+	mockBrokers := make([]*sarama.MockBroker, 0, brokers)
+	for id := int32(1); id <= brokers; id++ {
+		mockBroker := sarama.NewMockBroker(t, id)
+		defer mockBroker.Close()
+		mockBrokers = append(mockBrokers, mockBroker)
+
+		// Each broker only knows the offsets of its own partitions, so a
+		// request for another broker's partition fails the test.
+		topic := fmt.Sprintf("topic-%d", id)
+		response := sarama.NewMockOffsetResponse(t)
+		expected[topic] = make(map[int32]int64)
+		for partition := int32(0); partition < 3; partition++ {
+			offset := int64(id)*100 + int64(partition)
+			response.SetOffset(topic, partition, sarama.OffsetNewest, offset)
+			expected[topic][partition] = offset
+		}
+		mockBroker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"OffsetRequest": response,
+		})
+
+		broker := sarama.NewBroker(mockBroker.Addr())
+		assert.NoError(t, broker.Open(sarama.NewConfig()))
+		defer broker.Close()
+		for partition := int32(0); partition < 3; partition++ {
+			addBrokerOffsetBlock(requests, id, broker, topic, partition)
+		}
+	}
+
+	brokerOffsets, err := qm.fetchBrokerOffsets(requests)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, brokerOffsets)
+	for _, mockBroker := range mockBrokers {
+		assert.Len(t, mockBroker.History(), 1)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	cfg := &QMConfig{
+		Interval:      time.Minute,
+		RetryInterval: 20 * time.Millisecond,
+		MaxRetries:    3,
+	}
+	var attempts []time.Time
+	brokerErr := errors.New("broker unreachable")
+	err := Retry(context.Background(), cfg, "TEST", func() error {
+		attempts = append(attempts, time.Now())
+		return brokerErr
+	})
+	assert.Equal(t, brokerErr, err)
+	if !assert.Len(t, attempts, 4) {
+		return
+	}
+	for i := 1; i < len(attempts); i++ {
+		assert.True(t, attempts[i].Sub(attempts[i-1]) >= cfg.RetryInterval)
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	cfg := &QMConfig{RetryInterval: time.Millisecond, MaxRetries: 3}
+	calls := 0
+	err := Retry(context.Background(), cfg, "TEST", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("broker unreachable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestStartReturnsOnCancel(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	cfg := &QMConfig{
+		KafkaCfg: KafkaConfig{
+			Brokers:      []string{broker.Addr()},
+			OffsetFormat: BurrowOffsetFormat,
+		},
+		StatsdCfg:            StatsdConfig{Addrs: []string{"127.0.0.1:8125"}},
+		Interval:             time.Hour,
+		MaxBrokerConcurrency: 1,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Start(ctx, cfg)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after the context was cancelled")
+	}
+}
+
+func TestRebuildClientDuringCycle(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("t1", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100),
+	})
+
+	cfg := &QMConfig{
+		KafkaCfg:             KafkaConfig{Brokers: []string{broker.Addr()}},
+		MaxBrokerConcurrency: 1,
+	}
+	qm, _ := newTestMonitor(cfg)
+	client, err := newClient(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	qm.Client = client
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+
+	// The cycles and the status read the client while it is replaced, which
+	// the race detector checks. The cycles may fail on a closed client.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			qm.GetBrokerOffsets()
+			qm.Report(time.Now())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, qm.RebuildClient())
+		}
+	}()
+	wg.Wait()
+	assert.False(t, qm.clientClosed())
+	qm.Client.Close()
+}
+
+func TestMonitorInterface(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	qm, err := NewQueueMonitor(&QMConfig{
+		KafkaCfg: KafkaConfig{
+			Brokers:      []string{broker.Addr()},
+			OffsetFormat: BurrowOffsetFormat,
+		},
+		Interval:             time.Hour,
+		MaxBrokerConcurrency: 1,
+		DryRun:               true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var monitor Monitor = qm
+	defer monitor.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		monitor.Start(ctx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after the context was cancelled")
+	}
+	assert.False(t, qm.Status.lastCycle.IsZero())
+}
+
+func TestRunWorkersBounded(t *testing.T) {
+	const workers = 3
+	requests := make(map[int32]*BrokerOffsetRequest)
+	for id := int32(0); id < 20; id++ {
+		requests[id] = &BrokerOffsetRequest{}
+	}
+
+	var (
+		mutex               sync.Mutex
+		running, maxRunning int
+		calls               int
+	)
+	runWorkers(workers, requests, func(request *BrokerOffsetRequest) {
+		mutex.Lock()
+		running++
+		calls++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	})
+
+	assert.Equal(t, len(requests), calls)
+	assert.True(t, maxRunning <= workers, "%d workers running", maxRunning)
+}
+
+func TestGetBrokerOffsetsInternalMetrics(t *testing.T) {
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm"},
+	})
+	qm.parseErrors = 2
+
+	countCycles := func() int {
+		recorder.mutex.Lock()
+		defer recorder.mutex.Unlock()
+		cycles := 0
+		for _, gauge := range recorder.gauges {
+			if strings.HasPrefix(gauge, "kqm.kqm.cycle_duration_ms=") {
+				cycles++
+			}
+		}
+		return cycles
+	}
+	for cycle := 1; cycle <= 2; cycle++ {
+		assert.NoError(t, qm.GetBrokerOffsets())
+		assert.Equal(t, cycle, countCycles())
+	}
+	assert.Contains(t, recorder.gauges, "kqm.kqm.parse_errors=2")
+	assert.Contains(t, recorder.gauges, "kqm.kqm.parse_errors=0")
+	assert.Contains(t, recorder.gauges, "kqm.kqm.broker_errors=0")
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := NewBackoff(&QMConfig{
+		ReconnectBackoff:    time.Second,
+		MaxReconnectBackoff: 5 * time.Second,
+	})
+	backoff.jitter = func() float64 { return 1 }
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		waits = append(waits, backoff.Next())
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second,
+		4 * time.Second, 5 * time.Second, 5 * time.Second}, waits)
+
+	backoff.Reset()
+	backoff.jitter = func() float64 { return 0 }
+	assert.Equal(t, 500*time.Millisecond, backoff.Next())
+}
+
+// flakyClient : Kafka client that is unreachable for a number of calls.
+type flakyClient struct {
+	sarama.Client
+	failures int
+	calls    int
+}
+
+func (c *flakyClient) RefreshMetadata(topics ...string) error {
+	c.calls++
+	if c.calls <= c.failures {
+		return sarama.ErrOutOfBrokers
+	}
+	return nil
+}
+
+func TestRetryUnreachableBacksOff(t *testing.T) {
+	client := &flakyClient{failures: 3}
+	backoff := NewBackoff(&QMConfig{
+		ReconnectBackoff:    10 * time.Millisecond,
+		MaxReconnectBackoff: 20 * time.Millisecond,
+	})
+	backoff.jitter = func() float64 { return 1 }
+	start := time.Now()
+	err := retryUnreachable(context.Background(), backoff, func() error {
+		return client.RefreshMetadata()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, client.calls)
+	// Waits of 10, 20 and 20 milliseconds.
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Other errors are returned without retrying.
+	client = &flakyClient{}
+	configErr := errors.New("unknown offset format")
+	err = retryUnreachable(context.Background(), backoff, func() error {
+		client.calls++
+		return configErr
+	})
+	assert.Equal(t, configErr, err)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestRetryBacksOffWhileUnreachable(t *testing.T) {
+	cfg := &QMConfig{
+		RetryInterval:       time.Hour,
+		ReconnectBackoff:    time.Millisecond,
+		MaxReconnectBackoff: 4 * time.Millisecond,
+	}
+	client := &flakyClient{failures: 3}
+	done := make(chan error)
+	go func() {
+		done <- Retry(context.Background(), cfg, "TEST", func() error {
+			return client.RefreshMetadata()
+		})
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+		assert.Equal(t, 4, client.calls)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retry waited for the retry interval")
+	}
+}
+
+func TestRunOnTicks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan time.Time, 1)
+	cycles := make(chan int)
+	done := make(chan struct{})
+	calls := 0
+	go func() {
+		runOnTicks(ctx, time.Hour, ticks, func() {
+			calls++
+			cycles <- calls
+		})
+		close(done)
+	}()
+
+	// The first cycle runs right away, and then one per tick.
+	assert.Equal(t, 1, <-cycles)
+	for i := 2; i <= 4; i++ {
+		ticks <- time.Now()
+		assert.Equal(t, i, <-cycles)
+	}
+	cancel()
+	<-done
+}
+
+func TestRunOnTicksSkipsOverrun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks := make(chan time.Time, 1)
+	var calls int32
+	done := make(chan struct{})
+	go func() {
+		runOnTicks(ctx, 10*time.Millisecond, ticks, func() {
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				// The tick due during the overrun is pending.
+				ticks <- time.Now()
+				time.Sleep(20 * time.Millisecond)
+			case 2:
+				cancel()
+			}
+		})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	ticks <- time.Now()
+	<-done
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+// leaderClient : Kafka client caching the leader of a partition, which is
+// only updated to the current leader when the metadata is refreshed.
+type leaderClient struct {
+	sarama.Client
+	cached    *sarama.Broker
+	current   *sarama.Broker
+	refreshes int
+}
+
+func (c *leaderClient) Leader(topic string, partition int32) (*sarama.Broker,
+	error) {
+	return c.cached, nil
+}
+
+func (c *leaderClient) RefreshMetadata(topics ...string) error {
+	c.refreshes++
+	c.cached = c.current
+	return nil
+}
+
+func TestGetBrokerOffsetsLeaderChange(t *testing.T) {
+	oldLeader := sarama.NewMockBroker(t, 1)
+	defer oldLeader.Close()
+	notLeader := &sarama.OffsetResponse{}
+	notLeader.AddTopicPartition("t1", 0, 0)
+	notLeader.Blocks["t1"][0].Err = sarama.ErrNotLeaderForPartition
+	oldLeader.SetHandlerByMap(map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockWrapper(notLeader),
+	})
+	newLeader := sarama.NewMockBroker(t, 2)
+	defer newLeader.Close()
+	newLeader.SetHandlerByMap(map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100),
+	})
+
+	client := &leaderClient{}
+	for _, mockBroker := range []*sarama.MockBroker{oldLeader, newLeader} {
+		broker := sarama.NewBroker(mockBroker.Addr())
+		assert.NoError(t, broker.Open(sarama.NewConfig()))
+		defer broker.Close()
+		client.cached, client.current = client.current, broker
+	}
+
+	qm, _ := newTestMonitor(&QMConfig{
+		MaxBrokerConcurrency: 1,
+		BrokerOffsetMaxAge:   time.Minute,
+	})
+	qm.Client = client
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+
+	// The stale leader fails the first cycle, which refreshes the metadata
+	// so that the second cycle asks the new leader.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	_, ok := qm.BrokerOffsetStore.Load("t1", 0, time.Now(), time.Minute)
+	assert.False(t, ok)
+	assert.Equal(t, 1, client.refreshes)
+
+	assert.NoError(t, qm.GetBrokerOffsets())
+	offset, ok := qm.BrokerOffsetStore.Load("t1", 0, time.Now(), time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), offset)
+	assert.Equal(t, 1, client.refreshes)
+}
+
+func TestGetBrokerOffsetsTransientError(t *testing.T) {
+	loading := &sarama.OffsetResponse{}
+	loading.AddTopicPartition("t1", 0, 0)
+	loading.Blocks["t1"][0].Err = sarama.ErrOffsetsLoadInProgress
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockSequence(
+			sarama.NewMockWrapper(loading),
+			sarama.NewMockOffsetResponse(t).
+				SetOffset("t1", 0, sarama.OffsetNewest, 100)),
+	})
+
+	qm, _ := newTestMonitor(&QMConfig{MaxBrokerConcurrency: 1})
+	qm.Client = &leaderClient{cached: broker, current: broker}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+
+	// The partition still loading on the broker is retried within the
+	// cycle, which gets its offset.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	offset, ok := qm.BrokerOffsetStore.Load("t1", 0, time.Now(), time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), offset)
+	assert.Len(t, leader.History(), 2)
+}
+
+func TestNewQueueMonitorWithClient(t *testing.T) {
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100).
+			SetOffset("t1", 1, sarama.OffsetNewest, 50),
+	})
+
+	emitter := &recordingStatsd{}
+	qm, err := NewQueueMonitorWithClient(&leaderClient{cached: broker},
+		[]StatsdEmitter{emitter}, &QMConfig{
+			KafkaCfg:             KafkaConfig{OffsetFormat: BurrowOffsetFormat},
+			StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+			Granularity:          map[string]bool{PartitionGranularity: true},
+			MaxBrokerConcurrency: 1,
+		})
+	if !assert.NoError(t, err) {
+		return
+	}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g1", Offset: 45})
+
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Contains(t, emitter.gauges, "kqm.group.g1.t1.0=10")
+	assert.Contains(t, emitter.gauges, "kqm.group.g1.t1.1=5")
+}
+
+func TestNewQueueMonitorWithClientDefaults(t *testing.T) {
+	qm, err := NewQueueMonitorWithClient(&leaderClient{},
+		[]StatsdEmitter{&recordingStatsd{}}, &QMConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, DefaultInterval, qm.Config.Interval)
+	assert.Equal(t, map[string]bool{PartitionGranularity: true},
+		qm.Config.Granularity)
+	assert.Equal(t, BurrowOffsetFormat, qm.Config.KafkaCfg.OffsetFormat)
+	assert.NotNil(t, qm.Parser)
+}
+
+func TestNewQueueMonitorWithClientClosesReporters(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// The OTLP reporter fails after the Prometheus reporter has started
+	// listening.
+	_, err = NewQueueMonitorWithClient(&leaderClient{},
+		[]StatsdEmitter{&recordingStatsd{}}, &QMConfig{
+			PrometheusCfg: PrometheusConfig{Addr: addr},
+			OTLPCfg:       OTLPConfig{Endpoint: "localhost:4318"},
+		})
+	assert.Error(t, err)
+	listener, err = net.Listen("tcp", addr)
+	if assert.NoError(t, err) {
+		listener.Close()
+	}
+}
+
+// recordingReporter : Reporter recording the lags of every cycle.
+type recordingReporter struct {
+	reports [][]PartitionLag
+}
+
+func (r *recordingReporter) Report(timestamp time.Time,
+	lags []PartitionLag) error {
+	r.reports = append(r.reports, lags)
+	return nil
+}
+
+func (r *recordingReporter) Close() error {
+	return nil
+}
+
+func TestGetBrokerOffsetsReport(t *testing.T) {
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100).
+			SetOffset("t1", 1, sarama.OffsetNewest, 50),
+	})
+
+	qm, err := NewQueueMonitorWithClient(&leaderClient{cached: broker},
+		[]StatsdEmitter{&recordingStatsd{}}, &QMConfig{
+			KafkaCfg:             KafkaConfig{OffsetFormat: BurrowOffsetFormat},
+			MaxBrokerConcurrency: 1,
+		})
+	if !assert.NoError(t, err) {
+		return
+	}
+	reporter := &recordingReporter{}
+	qm.Reporters = []Reporter{reporter}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g1", Offset: 45})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Equal(t, [][]PartitionLag{{
+		{Group: "g1", Topic: "t1", Partition: 0, BrokerOffset: 100,
+			ConsumerOffset: 90, Lag: 10},
+		{Group: "g1", Topic: "t1", Partition: 1, BrokerOffset: 50,
+			ConsumerOffset: 45, Lag: 5},
+	}}, reporter.reports)
+}
+
+func TestGetBrokerOffsetsSingleRequestPerBroker(t *testing.T) {
+	partitions := map[string]int32{"t1": 2, "t2": 1, "t3": 3}
+	offsets := sarama.NewMockOffsetResponse(t)
+	for topic, count := range partitions {
+		for partition := int32(0); partition < count; partition++ {
+			offsets.SetOffset(topic, partition, sarama.OffsetNewest, 100)
+		}
+	}
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": offsets,
+	})
+
+	qm, recorder := newTestMonitor(&QMConfig{MaxBrokerConcurrency: 4})
+	qm.Client = &leaderClient{cached: broker}
+	for topic, count := range partitions {
+		for partition := int32(0); partition < count; partition++ {
+			qm.storeConsumerOffset(&PartitionOffset{Topic: topic,
+				Partition: partition, Group: "g1", Offset: 90})
+		}
+	}
+
+	assert.NoError(t, qm.GetBrokerOffsets())
+	requests := 0
+	for _, exchange := range leader.History() {
+		if _, ok := exchange.Request.(*sarama.OffsetRequest); ok {
+			requests++
+		}
+	}
+	assert.Equal(t, 1, requests)
+	assert.Contains(t, recorder.gauges,
+		fmt.Sprintf(".broker.%d.partition_count=6", broker.ID()))
+	for topic, count := range partitions {
+		for partition := int32(0); partition < count; partition++ {
+			_, ok := qm.BrokerOffsetStore.Load(topic, partition, time.Now(),
+				time.Minute)
+			assert.True(t, ok, "%s/%d", topic, partition)
+		}
+	}
+}
+
+// offsetTopicClient : Kafka client for which the Offset Topic only exists
+// after the metadata has been refreshed a number of times.
+type offsetTopicClient struct {
+	sarama.Client
+	missingFor int
+	refreshes  int
+}
+
+func (c *offsetTopicClient) Partitions(topic string) ([]int32, error) {
+	if c.refreshes < c.missingFor {
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+	return []int32{0, 1}, nil
+}
+
+func (c *offsetTopicClient) RefreshMetadata(topics ...string) error {
+	c.refreshes++
+	return nil
+}
+
+func TestOffsetTopicPartitionsWaitsForTopic(t *testing.T) {
+	client := &offsetTopicClient{missingFor: 2}
+	qm, _ := newTestMonitor(&QMConfig{RetryInterval: time.Millisecond})
+	qm.Client = client
+
+	partitions, err := qm.offsetTopicPartitions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{0, 1}, partitions)
+	assert.Equal(t, 2, client.refreshes)
+
+	// It stops waiting once the context is done.
+	client = &offsetTopicClient{missingFor: 1}
+	qm.Client = client
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = qm.offsetTopicPartitions(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestGetBrokerOffsetsFetchTimeout(t *testing.T) {
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100),
+	})
+	leader.SetLatency(time.Second)
+
+	qm, _ := newTestMonitor(&QMConfig{
+		MaxBrokerConcurrency: 1,
+		FetchTimeout:         50 * time.Millisecond,
+	})
+	qm.Client = &leaderClient{cached: broker, current: broker}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+
+	start := time.Now()
+	err := qm.GetBrokerOffsets()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Offset request timed out after 50ms")
+	}
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestGetBrokerOffsetsCloseBrokers(t *testing.T) {
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100),
+	})
+
+	qm, _ := newTestMonitor(&QMConfig{
+		MaxBrokerConcurrency: 1,
+		CloseBrokers:         true,
+	})
+	qm.Client = &coordinatorClient{leaderClient: leaderClient{cached: broker}}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+
+	// The offsets are fetched on a connection of the cycle, and the broker
+	// shared by the client stays connected.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	offset, ok := qm.BrokerOffsetStore.Load("t1", 0, time.Now(), time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), offset)
+	assert.Len(t, leader.History(), 1)
+	connected, err := broker.Connected()
+	assert.NoError(t, err)
+	assert.True(t, connected)
+}
+
+func TestGetBrokerOffsetsStaleOnFailure(t *testing.T) {
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100),
+	})
+	leader.SetLatency(time.Second)
+
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+		Granularity:          map[string]bool{PartitionGranularity: true},
+		MaxBrokerConcurrency: 1,
+		FetchTimeout:         50 * time.Millisecond,
+		BrokerOffsetMaxAge:   time.Minute,
+	})
+	qm.Client = &leaderClient{cached: broker, current: broker}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 90})
+	qm.BrokerOffsetStore.Store("t1", 0, 95, time.Now())
+
+	// The lags are sent with the stored broker offset, and the cycle
+	// doesn't fail, so that it isn't retried and sent twice.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Contains(t, recorder.gauges, "kqm.group.g1.t1.0=5")
+}
+
+func TestStoreConsumerOffsetConcurrent(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+
+	// As with the consumers of the Offset Topic partitions, each goroutine
+	// stores the commits of its own groups, on the same topic partitions,
+	// while the lags are being computed.
+	const consumers, commits = 8, 500
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				qm.getTopicsAndPartitions(qm.OffsetStore)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for consumer := 0; consumer < consumers; consumer++ {
+		wg.Add(1)
+		go func(consumer int) {
+			defer wg.Done()
+			group := fmt.Sprintf("g%d", consumer)
+			for offset := int64(1); offset <= commits; offset++ {
+				for partition := int32(0); partition < 4; partition++ {
+					qm.storeConsumerOffset(&PartitionOffset{Topic: "t1",
+						Partition: partition, Group: group, Offset: offset})
+				}
+			}
+			qm.removeConsumerGroup(&PartitionOffset{Topic: "t1", Partition: 3,
+				Group: group})
+		}(consumer)
+	}
+	wg.Wait()
+	close(done)
+
+	for consumer := 0; consumer < consumers; consumer++ {
+		group := fmt.Sprintf("g%d", consumer)
+		for partition := int32(0); partition < 3; partition++ {
+			offset, ok := qm.loadConsumerOffset("t1", partition, group)
+			assert.True(t, ok)
+			assert.Equal(t, int64(commits), offset)
+		}
+		_, ok := qm.loadConsumerOffset("t1", 3, group)
+		assert.False(t, ok)
+	}
+}
+
+// closingPartitionConsumer : Partition consumer of the messages and errors
+// sent to its channels, which are closed by Close.
+type closingPartitionConsumer struct {
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+	once     sync.Once
+}
+
+func newClosingPartitionConsumer() *closingPartitionConsumer {
+	return &closingPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan *sarama.ConsumerError),
+	}
+}
+
+func (c *closingPartitionConsumer) AsyncClose() {
+	c.once.Do(func() {
+		close(c.messages)
+		close(c.errors)
+	})
+}
+
+func (c *closingPartitionConsumer) Close() error {
+	c.AsyncClose()
+	return nil
+}
+
+func (c *closingPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func (c *closingPartitionConsumer) Errors() <-chan *sarama.ConsumerError {
+	return c.errors
+}
+
+func (c *closingPartitionConsumer) HighWaterMarkOffset() int64 {
+	return 0
+}
+
+func TestStartConsumersDrain(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Parser = func(message *sarama.ConsumerMessage) (*PartitionOffset,
+		error) {
+		return &PartitionOffset{Topic: "t1", Partition: message.Partition,
+			Group: string(message.Key), Offset: message.Offset}, nil
+	}
+
+	const partitions, messages = 16, 1000
+	pConsumers := make([]sarama.PartitionConsumer, partitions)
+	for partition := range pConsumers {
+		pConsumers[partition] = newClosingPartitionConsumer()
+	}
+	ids := make([]int32, partitions)
+	for partition := range ids {
+		ids[partition] = int32(partition)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cCtx, cCancel := context.WithCancel(context.Background())
+	qm.startConsumers(ctx, pConsumers, ids, cCancel)
+
+	var wg sync.WaitGroup
+	for partition := range pConsumers {
+		wg.Add(1)
+		go func(partition int32, pConsumer *closingPartitionConsumer) {
+			defer wg.Done()
+			for offset := int64(1); offset <= messages; offset++ {
+				pConsumer.messages <- &sarama.ConsumerMessage{
+					Partition: partition, Key: []byte("g1"), Offset: offset}
+			}
+			pConsumer.errors <- &sarama.ConsumerError{Partition: partition,
+				Err: sarama.ErrMessageTooLarge}
+		}(int32(partition), pConsumers[partition].(*closingPartitionConsumer))
+	}
+	wg.Wait()
+
+	// Closing the consumers stops all the goroutines.
+	cancel()
+	qm.consumers.Wait()
+	<-cCtx.Done()
+	assert.Equal(t, int64(partitions), qm.consumerErrors)
+	for partition := int32(0); partition < partitions; partition++ {
+		offset, ok := qm.loadConsumerOffset("t1", partition, "g1")
+		assert.True(t, ok)
+		assert.Equal(t, int64(messages), offset)
+	}
+}
+
+func TestGetBrokerOffsetsNegativeLag(t *testing.T) {
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("t1", 0, sarama.OffsetNewest, 100).
+			SetOffset("t1", 1, sarama.OffsetNewest, 100),
+	})
+
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+		Granularity:          map[string]bool{PartitionGranularity: true},
+		MaxBrokerConcurrency: 1,
+	})
+	qm.Client = &leaderClient{cached: broker, current: broker}
+	// The commit at partition 0 is ahead of the broker offset.
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 120})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g1", Offset: 90})
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g2", Offset: 95})
+
+	// No gauge is sent for the partition, and the counter is incremented
+	// in every cycle with the inversion.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Equal(t, []string{"kqm.kqm.negative_lag.g1.t1+1"}, recorder.counts)
+	assert.Contains(t, recorder.gauges, "kqm.group.g1.t1.1=10")
+	for _, gauge := range recorder.gauges {
+		assert.False(t, strings.HasPrefix(gauge, "kqm.group.g1.t1.0="), gauge)
+		assert.False(t, strings.HasPrefix(gauge, "kqm.kqm.negative_lag."),
+			gauge)
+	}
+	recorder.counts = nil
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Equal(t, []string{"kqm.kqm.negative_lag.g1.t1+1"}, recorder.counts)
+
+	// Nothing is counted once the lag is no longer negative.
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 100})
+	recorder.gauges, recorder.counts = nil, nil
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Empty(t, recorder.counts)
+	assert.Contains(t, recorder.gauges, "kqm.group.g1.t1.0=0")
+
+	// With AllowNegativeLag, the negative lag is sent and still counted.
+	qm.Config.AllowNegativeLag = true
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 120})
+	recorder.gauges, recorder.counts = nil, nil
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Contains(t, recorder.gauges, "kqm.group.g1.t1.0=-20")
+	assert.Equal(t, []string{"kqm.kqm.negative_lag.g1.t1+1"}, recorder.counts)
+}
+
+func TestStartConsumersCancel(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Parser = func(message *sarama.ConsumerMessage) (*PartitionOffset,
+		error) {
+		return &PartitionOffset{Topic: "t1", Partition: message.Partition,
+			Group: "g1", Offset: message.Offset}, nil
+	}
+	pConsumer := newClosingPartitionConsumer()
+	ctx, cancel := context.WithCancel(context.Background())
+	qm.startConsumers(ctx, []sarama.PartitionConsumer{pConsumer},
+		[]int32{0}, func() {})
+
+	// The consumer is waiting for the next message when the context is
+	// cancelled.
+	pConsumer.messages <- &sarama.ConsumerMessage{Offset: 1}
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		qm.consumers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The consumer goroutines didn't stop")
+	}
+	offset, ok := qm.loadConsumerOffset("t1", 0, "g1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), offset)
+}
+
+// startingConsumer : Consumer recording the offsets the partitions are
+// consumed from, failing with out of range for the offsets in outOfRange.
+type startingConsumer struct {
+	sarama.Consumer
+	outOfRange map[int64]bool
+	offsets    []int64
+}
+
+func (c *startingConsumer) ConsumePartition(topic string, partition int32,
+	offset int64) (sarama.PartitionConsumer, error) {
+	c.offsets = append(c.offsets, offset)
+	if c.outOfRange[offset] {
+		return nil, sarama.ErrOffsetOutOfRange
+	}
+	return newClosingPartitionConsumer(), nil
+}
+
+func TestConsumePartitionResumes(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	consumer := &startingConsumer{outOfRange: map[int64]bool{7: true}}
+
+	// The first start consumes from the start offset.
+	_, err := qm.consumePartition(consumer, 0, sarama.OffsetOldest)
+	assert.NoError(t, err)
+
+	// A restart resumes from the saved position.
+	qm.positions.Store(int32(0), int64(42))
+	_, err = qm.consumePartition(consumer, 0, sarama.OffsetOldest)
+	assert.NoError(t, err)
+
+	// A position deleted by the retention falls back to the start offset.
+	qm.positions.Store(int32(1), int64(7))
+	_, err = qm.consumePartition(consumer, 1, sarama.OffsetOldest)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []int64{sarama.OffsetOldest, 42, 7, sarama.OffsetOldest},
+		consumer.offsets)
+}
+
+func TestResolveBrokers(t *testing.T) {
+	assert.NoError(t, resolveBrokers([]string{"localhost", "localhost:9092"}))
+	assert.Error(t, resolveBrokers([]string{"localhost"}))
+}
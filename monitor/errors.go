@@ -0,0 +1,30 @@
+package monitor
+
+import (
+	"strings"
+)
+
+// CycleError : Aggregates the errors encountered in a cycle.
+type CycleError struct {
+	Errors []error
+}
+
+func (e *CycleError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Returns nil without errors, the error itself when there's only one, and
+// a CycleError aggregating them otherwise.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return &CycleError{Errors: errs}
+}
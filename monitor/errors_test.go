@@ -0,0 +1,93 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingClient : Kafka client failing to fetch the partitions and leaders.
+type failingClient struct {
+	sarama.Client
+}
+
+func (c *failingClient) Partitions(topic string) ([]int32, error) {
+	return nil, sarama.ErrOutOfBrokers
+}
+
+func (c *failingClient) Leader(topic string, partition int32) (
+	*sarama.Broker, error) {
+	return nil, sarama.ErrNotLeaderForPartition
+}
+
+func TestGetConsumerOffsetsPartitionsError(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Client = &failingClient{}
+	_, err := qm.GetConsumerOffsets(context.Background())
+	assert.Equal(t, sarama.ErrOutOfBrokers, err)
+}
+
+func TestGetBrokerOffsetsLeaderError(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Client = &failingClient{}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 10})
+	assert.Equal(t, sarama.ErrNotLeaderForPartition, qm.GetBrokerOffsets())
+}
+
+func TestJoinErrors(t *testing.T) {
+	assert.NoError(t, joinErrors(nil))
+	first, second := errors.New("first"), errors.New("second")
+	assert.Equal(t, first, joinErrors([]error{first}))
+	assert.EqualError(t, joinErrors([]error{first, second}), "first; second")
+}
+
+func TestHealthzLastCycleError(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.running = 1
+	qm.Status.cycleFinished(errors.New("broker 1: timeout"))
+
+	recorder := httptest.NewRecorder()
+	qm.NewAPIHandler().ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, recorder.Code)
+	var report HealthzReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, "ok", report.Status)
+	assert.Equal(t, "broker 1: timeout", report.LastCycleError)
+
+	qm.Status.cycleFinished(nil)
+	recorder = httptest.NewRecorder()
+	qm.NewAPIHandler().ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/healthz", nil))
+	report = HealthzReport{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Empty(t, report.LastCycleError)
+	assert.NotContains(t, recorder.Body.String(), "last_cycle_error")
+}
+
+func (c *failingClient) RefreshMetadata(topics ...string) error {
+	return nil
+}
+
+func TestFetchBrokerOffsetsAggregatesErrors(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{MaxBrokerConcurrency: 2})
+	qm.Client = &failingClient{}
+	requests := make(map[int32]*BrokerOffsetRequest)
+	for id := int32(1); id <= 2; id++ {
+		// The brokers are never opened, so the requests fail.
+		broker := sarama.NewBroker("localhost:0")
+		addBrokerOffsetBlock(requests, id, broker, "t1", id)
+	}
+	_, err := qm.fetchBrokerOffsets(requests)
+	cycleErr, ok := err.(*CycleError)
+	if !assert.True(t, ok, "%v", err) {
+		return
+	}
+	assert.Len(t, cycleErr.Errors, 2)
+}
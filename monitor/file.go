@@ -0,0 +1,158 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Formats of the file output.
+const (
+	CSVFileFormat  = "csv"
+	JSONFileFormat = "json"
+)
+
+// FileReporter : Defines a Reporter appending the lags of every cycle to a
+// local CSV or JSON lines file, which is rotated once it grows beyond the
+// maximum size.
+type FileReporter struct {
+	Config  FileConfig
+	file    *os.File
+	buffer  *bufio.Writer
+	writer  *csv.Writer
+	encoder *json.Encoder
+	size    int64
+}
+
+var csvHeader = []string{"timestamp", "group", "topic", "partition",
+	"broker_offset", "consumer_offset", "lag"}
+
+// Record of a partition lag in the JSON lines file output.
+type fileRecord struct {
+	Timestamp      string `json:"ts"`
+	Group          string `json:"group"`
+	Topic          string `json:"topic"`
+	Partition      int32  `json:"partition"`
+	BrokerOffset   int64  `json:"broker_offset"`
+	ConsumerOffset int64  `json:"consumer_offset"`
+	Lag            int64  `json:"lag"`
+}
+
+// NewFileReporter : Returns a FileReporter writing to the file at the
+// configured path, in the "csv" or "json" format.
+func NewFileReporter(cfg FileConfig) (*FileReporter, error) {
+	if cfg.Format != CSVFileFormat && cfg.Format != JSONFileFormat {
+		return nil, fmt.Errorf("Unsupported file output format: %s", cfg.Format)
+	}
+	reporter := &FileReporter{Config: cfg}
+	err := reporter.open()
+	if err != nil {
+		return nil, err
+	}
+	return reporter, nil
+}
+
+// Report : Appends a row for every partition lag and flushes the rows to
+// the file.
+func (r *FileReporter) Report(timestamp time.Time, lags []PartitionLag) error {
+	ts := timestamp.UTC().Format(time.RFC3339)
+	for _, lag := range lags {
+		if r.encoder != nil {
+			err := r.encoder.Encode(fileRecord{ts, lag.Group, lag.Topic,
+				lag.Partition, lag.BrokerOffset, lag.ConsumerOffset, lag.Lag})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := r.writer.Write([]string{ts, lag.Group, lag.Topic,
+			strconv.Itoa(int(lag.Partition)),
+			strconv.FormatInt(lag.BrokerOffset, 10),
+			strconv.FormatInt(lag.ConsumerOffset, 10),
+			strconv.FormatInt(lag.Lag, 10)})
+		if err != nil {
+			return err
+		}
+	}
+	err := r.flush()
+	if err != nil {
+		return err
+	}
+	if r.Config.MaxSize > 0 && r.size >= r.Config.MaxSize {
+		return r.rotate()
+	}
+	return nil
+}
+
+// Close : Flushes the buffered rows and closes the file.
+func (r *FileReporter) Close() error {
+	err := r.flush()
+	if err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// Opens the file for appending, writing the CSV header if the file is
+// empty.
+func (r *FileReporter) open() error {
+	file, err := os.OpenFile(r.Config.Path,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	r.buffer = bufio.NewWriter(file)
+	if r.Config.Format == JSONFileFormat {
+		r.encoder = json.NewEncoder(r.buffer)
+		return nil
+	}
+	r.writer = csv.NewWriter(r.buffer)
+	if r.size == 0 {
+		return r.writer.Write(csvHeader)
+	}
+	return nil
+}
+
+// Flushes the CSV writer and the buffer, keeping track of the file size.
+func (r *FileReporter) flush() error {
+	if r.writer != nil {
+		r.writer.Flush()
+		err := r.writer.Error()
+		if err != nil {
+			return err
+		}
+	}
+	buffered := int64(r.buffer.Buffered())
+	err := r.buffer.Flush()
+	if err != nil {
+		return err
+	}
+	r.size += buffered
+	return nil
+}
+
+// Renames the current file with a timestamp suffix and opens a new one.
+func (r *FileReporter) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", r.Config.Path,
+		time.Now().UTC().Format("20060102T150405.000"))
+	err = os.Rename(r.Config.Path, rotated)
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
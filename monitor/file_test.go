@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileReporterJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kqm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lags.jsonl")
+
+	reporter, err := NewFileReporter(FileConfig{Path: path,
+		Format: JSONFileFormat})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ts := time.Unix(1508140800, 0)
+	assert.NoError(t, reporter.Report(ts, []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, BrokerOffset: 100,
+			ConsumerOffset: 90, Lag: 10},
+		{Group: "g1", Topic: "t1", Partition: 1, BrokerOffset: 50,
+			ConsumerOffset: 50, Lag: 0},
+	}))
+	assert.NoError(t, reporter.Close())
+
+	data, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, map[string]interface{}{
+		"ts": "2017-10-16T08:00:00Z", "group": "g1", "topic": "t1",
+		"partition": 0.0, "broker_offset": 100.0, "consumer_offset": 90.0,
+		"lag": 10.0,
+	}, record)
+}
+
+func TestFileReporterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kqm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lags.jsonl")
+
+	reporter, err := NewFileReporter(FileConfig{Path: path,
+		Format: JSONFileFormat, MaxSize: 200})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reporter.Close()
+	lags := []PartitionLag{{Group: "g1", Topic: "t1", Lag: 10}}
+
+	// A record is below the maximum size, two are above it.
+	assert.NoError(t, reporter.Report(time.Now(), lags))
+	files, _ := filepath.Glob(path + "*")
+	assert.Len(t, files, 1)
+	assert.NoError(t, reporter.Report(time.Now(), lags))
+	files, _ = filepath.Glob(path + "*")
+	assert.Len(t, files, 2)
+
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(0), info.Size())
+	}
+}
+
+func TestNewFileReporterFormat(t *testing.T) {
+	_, err := NewFileReporter(FileConfig{Path: "lags.xml", Format: "xml"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package monitor
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter : Matches names against a whitelist and a blacklist regex. An empty
+// pattern is not applied, and the whitelist takes precedence over the
+// blacklist when both are set.
+type Filter struct {
+	Whitelist *regexp.Regexp
+	Blacklist *regexp.Regexp
+}
+
+// NewFilter : Compiles the whitelist and blacklist patterns into a Filter,
+// returning an error for an invalid pattern.
+func NewFilter(whitelist, blacklist string) (*Filter, error) {
+	filter := &Filter{}
+	var err error
+	if whitelist != "" {
+		filter.Whitelist, err = regexp.Compile(whitelist)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid whitelist pattern: %s", err)
+		}
+	}
+	if blacklist != "" {
+		filter.Blacklist, err = regexp.Compile(blacklist)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid blacklist pattern: %s", err)
+		}
+	}
+	return filter, nil
+}
+
+// Allowed : Checks whether the name passes the filter. A nil Filter allows
+// every name.
+func (f *Filter) Allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	if f.Whitelist != nil {
+		return f.Whitelist.MatchString(name)
+	}
+	if f.Blacklist != nil {
+		return !f.Blacklist.MatchString(name)
+	}
+	return true
+}
+
+// PartitionFilter : Restricts the partitions monitored for some topics to
+// ranges of partitions. The topics without ranges are not restricted.
+type PartitionFilter struct {
+	ranges map[string][][2]int32
+}
+
+// ParsePartitionFilter : Parses a comma-separated list of topic:first-last
+// or topic:partition entries, e.g. "orders:0-3,payments:5", into a
+// PartitionFilter.
+func ParsePartitionFilter(spec string) (*PartitionFilter, error) {
+	filter := &PartitionFilter{ranges: make(map[string][][2]int32)}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid partition range: %q. Expected "+
+				"topic:first-last or topic:partition", entry)
+		}
+		bounds := strings.Split(parts[1], "-")
+		if len(bounds) > 2 {
+			return nil, fmt.Errorf("Invalid partition range: %q", entry)
+		}
+		var partitionRange [2]int32
+		for index, bound := range bounds {
+			partition, err := strconv.ParseInt(bound, 10, 32)
+			if err != nil || partition < 0 {
+				return nil, fmt.Errorf("Invalid partition in range: %q",
+					entry)
+			}
+			partitionRange[index] = int32(partition)
+		}
+		if len(bounds) == 1 {
+			partitionRange[1] = partitionRange[0]
+		}
+		if partitionRange[1] < partitionRange[0] {
+			return nil, fmt.Errorf("Invalid partition range: %q. The last "+
+				"partition is below the first one", entry)
+		}
+		filter.ranges[parts[0]] = append(filter.ranges[parts[0]],
+			partitionRange)
+	}
+	return filter, nil
+}
+
+// Allowed : Checks whether the partition of the topic is in one of the
+// ranges of the topic, if it has any. A nil PartitionFilter allows every
+// partition.
+func (f *PartitionFilter) Allowed(topic string, partition int32) bool {
+	if f == nil {
+		return true
+	}
+	ranges, ok := f.ranges[topic]
+	if !ok {
+		return true
+	}
+	for _, partitionRange := range ranges {
+		if partition >= partitionRange[0] && partition <= partitionRange[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the partition of the topic is both in the allowlist and
+// allowed by the partition filter.
+func (qm *QueueMonitor) partitionAllowed(topic string, partition int32) bool {
+	return qm.Allowlist.Allowed(topic, partition) &&
+		qm.Config.PartitionFilter.Allowed(topic, partition)
+}
@@ -0,0 +1,197 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		whitelist, blacklist string
+		allowed, denied      []string
+	}{
+		{"", "", []string{"billing", "console-consumer-1"}, nil},
+		{"^billing", "", []string{"billing", "billing-v2"},
+			[]string{"console-consumer-1"}},
+		{"", "^console-consumer-", []string{"billing"},
+			[]string{"console-consumer-1"}},
+		{"^billing", "v2$", []string{"billing", "billing-v2"},
+			[]string{"console-consumer-1"}},
+	}
+	for _, test := range tests {
+		filter, err := NewFilter(test.whitelist, test.blacklist)
+		assert.NoError(t, err)
+		for _, name := range test.allowed {
+			assert.True(t, filter.Allowed(name), name)
+		}
+		for _, name := range test.denied {
+			assert.False(t, filter.Allowed(name), name)
+		}
+	}
+
+	var filter *Filter
+	assert.True(t, filter.Allowed("billing"))
+
+	_, err := NewFilter("billing(", "")
+	assert.Error(t, err)
+	_, err = NewFilter("", "[console")
+	assert.Error(t, err)
+}
+
+func TestStoreConsumerOffsetGroupFilter(t *testing.T) {
+	filter, err := NewFilter("^billing", "")
+	assert.NoError(t, err)
+	qm, _ := newTestMonitor(&QMConfig{GroupFilter: filter})
+
+	assert.True(t, qm.storeConsumerOffset(&PartitionOffset{Topic: "t1",
+		Group: "billing", Offset: 10}))
+	assert.False(t, qm.storeConsumerOffset(&PartitionOffset{Topic: "t1",
+		Group: "console-consumer-1", Offset: 10}))
+
+	offset, ok := qm.loadConsumerOffset("t1", 0, "billing")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), offset)
+	_, ok = qm.loadConsumerOffset("t1", 0, "console-consumer-1")
+	assert.False(t, ok)
+}
+
+func TestTopicFilter(t *testing.T) {
+	filter, err := NewFilter("", "^__|^_confluent")
+	assert.NoError(t, err)
+	qm, _ := newTestMonitor(&QMConfig{TopicFilter: filter})
+	for _, topic := range []string{"orders", "__consumer_offsets",
+		"_confluent-metrics"} {
+		qm.storeConsumerOffset(&PartitionOffset{Topic: topic, Partition: 0,
+			Group: "g1", Offset: 10})
+	}
+
+	assert.Equal(t, map[string][]int32{"orders": {0}},
+		qm.getTopicsAndPartitions(qm.OffsetStore))
+	lags, err := qm.lag("__consumer_offsets", 0, 20)
+	assert.NoError(t, err)
+	assert.Empty(t, lags)
+	lags, err = qm.lag("orders", 0, 20)
+	assert.NoError(t, err)
+	assert.Len(t, lags, 1)
+}
+
+func TestParsePartitionFilter(t *testing.T) {
+	filter, err := ParsePartitionFilter("orders:0-3,payments:5,orders:8")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for partition, allowed := range map[int32]bool{0: true, 3: true, 4: false,
+		8: true, 9: false} {
+		assert.Equal(t, allowed, filter.Allowed("orders", partition),
+			"orders %d", partition)
+	}
+	assert.True(t, filter.Allowed("payments", 5))
+	assert.False(t, filter.Allowed("payments", 4))
+	assert.True(t, filter.Allowed("billing", 42))
+
+	var none *PartitionFilter
+	assert.True(t, none.Allowed("orders", 4))
+
+	for _, spec := range []string{"orders", "orders:", ":1", "orders:a",
+		"orders:3-1", "orders:1-2-3", "orders:-1", "orders:1,"} {
+		_, err = ParsePartitionFilter(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestGetTopicsAndPartitionsPartitionFilter(t *testing.T) {
+	filter, _ := ParsePartitionFilter("orders:1-2")
+	qm, _ := newTestMonitor(&QMConfig{PartitionFilter: filter})
+	now := time.Now()
+	for partition := int32(0); partition < 4; partition++ {
+		for _, topic := range []string{"orders", "payments"} {
+			qm.storeConsumerOffset(&PartitionOffset{Topic: topic,
+				Partition: partition, Group: "g1", Offset: 5})
+			qm.BrokerOffsetStore.Store(topic, partition, 10, now)
+		}
+	}
+
+	tpMap := qm.getTopicsAndPartitions(qm.OffsetStore)
+	sortPartitions := func(partitions []int32) []int32 {
+		sort.Slice(partitions, func(i, j int) bool {
+			return partitions[i] < partitions[j]
+		})
+		return partitions
+	}
+	assert.Equal(t, []int32{1, 2}, sortPartitions(tpMap["orders"]))
+	assert.Equal(t, []int32{0, 1, 2, 3}, sortPartitions(tpMap["payments"]))
+
+	// The filter also applies to the partitions passed to computeLags.
+	tpMap["orders"] = []int32{0, 1, 2, 3}
+	lags, _, total := qm.computeLags(tpMap, now, time.Minute)
+	assert.Equal(t, 6, total)
+	assert.Len(t, lags, 6)
+}
+
+func TestRefreshAllowlistStopsOnCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`["t1"]`))
+		}))
+	defer server.Close()
+	qm, _ := newTestMonitor(&QMConfig{AllowlistURL: server.URL,
+		Interval: time.Hour})
+	qm.loadAllowlist()
+	assert.True(t, qm.Allowlist.Allowed("t1", 0))
+	assert.False(t, qm.Allowlist.Allowed("t2", 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		qm.refreshAllowlist(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The allowlist refresh didn't stop")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	allowlist := &Allowlist{}
+	assert.True(t, allowlist.Allowed("t1", 0))
+
+	assert.NoError(t, allowlist.Set([]string{"t1", "t2:1", "t1:3",
+		"ns:t3:0"}))
+	assert.True(t, allowlist.Allowed("t1", 5))
+	assert.True(t, allowlist.Allowed("t2", 1))
+	assert.False(t, allowlist.Allowed("t2", 0))
+	assert.True(t, allowlist.Allowed("ns:t3", 0))
+	assert.False(t, allowlist.Allowed("t4", 0))
+
+	// An invalid entry keeps the last known allowlist.
+	assert.Error(t, allowlist.Set([]string{"t4:x"}))
+	assert.True(t, allowlist.Allowed("t1", 5))
+	assert.False(t, allowlist.Allowed("t4", 0))
+}
+
+func TestFetchAllowlist(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(`["t1", "t2:0"]`))
+		}))
+	defer server.Close()
+
+	entries, err := FetchAllowlist(http.DefaultClient, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"t1", "t2:0"}, entries)
+
+	status = http.StatusInternalServerError
+	_, err = FetchAllowlist(http.DefaultClient, server.URL)
+	assert.Error(t, err)
+}
@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GraphiteReporter : Defines a Reporter writing the lags of every cycle to
+// Graphite with the plaintext protocol, over a TCP connection kept open
+// between the cycles and opened again when a write fails.
+type GraphiteReporter struct {
+	Config GraphiteConfig
+	conn   net.Conn
+}
+
+// NewGraphiteReporter : Returns a GraphiteReporter for the configured
+// address. The connection is opened by the first report.
+func NewGraphiteReporter(cfg GraphiteConfig) (*GraphiteReporter, error) {
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return nil, fmt.Errorf("Invalid Graphite address. Details: %s", err)
+	}
+	return &GraphiteReporter{Config: cfg}, nil
+}
+
+// Report : Writes a <prefix>.group.<group>.<topic>.<partition>.lag line
+// for every partition lag, timestamped with the time of the cycle. The
+// whitespace in the group and topic names, which would split the line, is
+// replaced with underscores.
+func (r *GraphiteReporter) Report(timestamp time.Time,
+	lags []PartitionLag) error {
+	if len(lags) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, lag := range lags {
+		fmt.Fprintf(&buf, "%s.group.%s.%s.%d.lag %d %d\n", r.Config.Prefix,
+			graphiteName(lag.Group), graphiteName(lag.Topic), lag.Partition,
+			lag.Lag, timestamp.Unix())
+	}
+	err := r.write(buf.Bytes())
+	if err != nil {
+		// The connection may have been closed by Graphite since the
+		// previous cycle, so the lines are written once more on a new one.
+		log.Warningln("Reconnecting to Graphite after error:", err)
+		err = r.write(buf.Bytes())
+	}
+	return err
+}
+
+// Replaces the whitespace in a path component of a metric name with
+// underscores.
+func graphiteName(name string) string {
+	return strings.Map(func(char rune) rune {
+		if unicode.IsSpace(char) {
+			return '_'
+		}
+		return char
+	}, name)
+}
+
+// Writes the data to the connection, opening it first if needed. The
+// connection is closed if the write fails.
+func (r *GraphiteReporter) write(data []byte) error {
+	if r.conn == nil {
+		conn, err := net.DialTimeout("tcp", r.Config.Addr, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	r.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := r.conn.Write(data)
+	if err != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return err
+}
+
+// Close : Closes the connection to Graphite, if open.
+func (r *GraphiteReporter) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
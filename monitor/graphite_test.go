@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Accepts the connections on the listener and sends the lines read from
+// them to the channel.
+func readLines(listener net.Listener, lines chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}(conn)
+	}
+}
+
+func TestGraphiteReporter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go readLines(listener, lines)
+
+	reporter, err := NewGraphiteReporter(GraphiteConfig{
+		Addr:   listener.Addr().String(),
+		Prefix: "kqm",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reporter.Close()
+	timestamp := time.Unix(1508140800, 0)
+	lags := []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: "g2", Topic: "t1", Partition: 3, Lag: 0},
+		{Group: "web\tworkers 2", Topic: "t1", Partition: 0, Lag: 1},
+	}
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Equal(t, "kqm.group.g1.t1.0.lag 5 1508140800", <-lines)
+	assert.Equal(t, "kqm.group.g2.t1.3.lag 0 1508140800", <-lines)
+	assert.Equal(t, "kqm.group.web_workers_2.t1.0.lag 1 1508140800", <-lines)
+
+	// A closed connection is opened again.
+	reporter.conn.Close()
+	assert.NoError(t, reporter.Report(timestamp, lags[:1]))
+	assert.Equal(t, "kqm.group.g1.t1.0.lag 5 1508140800", <-lines)
+}
+
+func TestNewGraphiteReporterInvalidAddr(t *testing.T) {
+	_, err := NewGraphiteReporter(GraphiteConfig{Addr: "graphite"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/syncmap"
+)
+
+// GetGroupAssignments : Describes the consumer groups present in the Offset
+// Store using their coordinator brokers and returns the partitions assigned
+// to the members of each group, keyed by group and topic. Only groups in the
+// Stable state are considered, since assignments change during a rebalance.
+// The groups whose coordinator can't be reached are logged, counted as
+// broker errors and left out, so that they don't fail the other groups.
+func (qm *QueueMonitor) GetGroupAssignments() (map[string]map[string][]int32, error) {
+	client, release := qm.acquireClient()
+	defer release()
+	assignments := make(map[string]map[string][]int32)
+	for _, group := range getGroups(qm.OffsetStore) {
+		coordinator, err := client.Coordinator(group)
+		if err != nil {
+			log.Errorf("Error occured while fetching coordinator broker of "+
+				"group %s: %s", group, err)
+			atomic.AddInt64(&qm.brokerErrors, 1)
+			continue
+		}
+		response, err := coordinator.DescribeGroups(&sarama.DescribeGroupsRequest{
+			Groups: []string{group},
+		})
+		if err != nil {
+			log.Errorf("Error while describing consumer group %s: %s", group,
+				err)
+			atomic.AddInt64(&qm.brokerErrors, 1)
+			continue
+		}
+		for _, description := range response.Groups {
+			if description.Err != sarama.ErrNoError {
+				log.Errorln("Error in group description.", description.Err.Error())
+				continue
+			}
+			if description.State != "Stable" {
+				continue
+			}
+			for _, member := range description.Members {
+				assignment, err := member.GetMemberAssignment()
+				if err != nil {
+					log.Errorln("Error while parsing member assignment:", err)
+					continue
+				}
+				if _, ok := assignments[group]; !ok {
+					assignments[group] = make(map[string][]int32)
+				}
+				for topic, partitions := range assignment.Topics {
+					assignments[group][topic] = append(
+						assignments[group][topic], partitions...)
+				}
+			}
+		}
+	}
+	return assignments, nil
+}
+
+// emitAssignedPartitions : Sends a zero lag for the partitions assigned to a
+// group that don't have a committed offset in the Offset Store yet, so that
+// every assigned partition reports a value each interval.
+func (qm *QueueMonitor) emitAssignedPartitions() error {
+	if !qm.Config.Granularity[PartitionGranularity] {
+		return nil
+	}
+	assignments, err := qm.GetGroupAssignments()
+	if err != nil {
+		return err
+	}
+	for group, tpMap := range assignments {
+		if !qm.Config.GroupFilter.Allowed(group) {
+			continue
+		}
+		for topic, partitions := range tpMap {
+			if !qm.Config.TopicFilter.Allowed(topic) {
+				continue
+			}
+			for _, partition := range partitions {
+				if !qm.partitionAllowed(topic, partition) {
+					continue
+				}
+				if _, ok := qm.loadConsumerOffset(topic, partition, group); ok {
+					continue
+				}
+				qm.sendGauge(qm.partitionStat(group, topic, partition, ""), 0)
+			}
+		}
+	}
+	return nil
+}
+
+// emitCoordinators : Resolves the coordinator broker of each group in the
+// Offset Store and sends its ID as a gauge. The coordinators are cached for
+// the API, and refreshed when resolving one fails.
+func (qm *QueueMonitor) emitCoordinators() {
+	client, release := qm.acquireClient()
+	defer release()
+	for _, group := range getGroups(qm.OffsetStore) {
+		coordinator, err := client.Coordinator(group)
+		if err != nil {
+			log.Warningf("Refreshing coordinator of group %s due to error: %s",
+				group, err)
+			err = client.RefreshCoordinator(group)
+			if err == nil {
+				coordinator, err = client.Coordinator(group)
+			}
+		}
+		if err != nil {
+			log.Errorf("Error while fetching coordinator of group %s: %s",
+				group, err)
+			qm.Coordinators.Delete(group)
+			continue
+		}
+		qm.Coordinators.Store(group, coordinator.ID())
+		stat := fmt.Sprintf(".group.%s.coordinator", group)
+		qm.sendGaugeToStatsd(stat, int64(coordinator.ID()))
+	}
+}
+
+// Fetches the distinct consumer groups present in the Offset Store.
+func getGroups(offsetStore *syncmap.Map) []string {
+	seen := make(map[string]bool)
+	groups := []string{}
+	offsetStore.Range(func(_, tbodyI interface{}) bool {
+		tbodyI.(*syncmap.Map).Range(func(_, pbodyI interface{}) bool {
+			pbodyI.(*syncmap.Map).Range(func(groupI, _ interface{}) bool {
+				group := groupI.(string)
+				if !seen[group] {
+					seen[group] = true
+					groups = append(groups, group)
+				}
+				return true
+			})
+			return true
+		})
+		return true
+	})
+	return groups
+}
+
+// Loads the committed offset of a group for a topic and partition.
+func (qm *QueueMonitor) loadConsumerOffset(topic string, partition int32,
+	group string) (int64, bool) {
+	commit, ok := qm.loadConsumerCommit(topic, partition, group)
+	return commit.Offset, ok
+}
+
+// Loads the committed offset of a group for a topic and partition, along
+// with the timestamp of the commit.
+func (qm *QueueMonitor) loadConsumerCommit(topic string, partition int32,
+	group string) (ConsumerOffset, bool) {
+	tmp, ok := qm.OffsetStore.Load(topic)
+	if !ok {
+		return ConsumerOffset{}, false
+	}
+	tmp, ok = tmp.(*syncmap.Map).Load(partition)
+	if !ok {
+		return ConsumerOffset{}, false
+	}
+	tmp, ok = tmp.(*syncmap.Map).Load(group)
+	if !ok {
+		return ConsumerOffset{}, false
+	}
+	commit, ok := tmp.(ConsumerOffset)
+	return commit, ok
+}
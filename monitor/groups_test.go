@@ -0,0 +1,107 @@
+package monitor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGroupAssignments(t *testing.T) {
+	// Assignment of partitions 0 and 1 of t1, without user data.
+	assignment := encode(uint16(0), uint32(1), "t1", uint32(2), uint32(0),
+		uint32(1), int32(-1))
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"DescribeGroupsRequest": sarama.NewMockWrapper(
+			&sarama.DescribeGroupsResponse{
+				Groups: []*sarama.GroupDescription{{
+					GroupId: "g1",
+					State:   "Stable",
+					Members: map[string]*sarama.GroupMemberDescription{
+						"m1": {MemberAssignment: assignment},
+					},
+				}},
+			}),
+	})
+
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Client = &coordinatorClient{leaderClient: leaderClient{cached: broker},
+		failing: "bad"}
+	for _, group := range []string{"g1", "bad"} {
+		qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+			Group: group, Offset: 10})
+	}
+
+	// The group whose coordinator fails is left out.
+	assignments, err := qm.GetGroupAssignments()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string][]int32{
+		"g1": {"t1": {0, 1}},
+	}, assignments)
+	assert.Equal(t, int64(1), qm.brokerErrors)
+}
+
+func TestEmitAssignedPartitions(t *testing.T) {
+	// Assignment of partitions 0 and 1 of t1, without user data.
+	assignment := encode(uint16(0), uint32(1), "t1", uint32(2), uint32(0),
+		uint32(1), int32(-1))
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"DescribeGroupsRequest": sarama.NewMockWrapper(
+			&sarama.DescribeGroupsResponse{
+				Groups: []*sarama.GroupDescription{{
+					GroupId: "g1",
+					State:   "Stable",
+					Members: map[string]*sarama.GroupMemberDescription{
+						"m1": {MemberAssignment: assignment},
+					},
+				}},
+			}),
+	})
+
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:   StatsdConfig{Prefix: "kqm"},
+		Granularity: map[string]bool{PartitionGranularity: true},
+	})
+	qm.Client = &coordinatorClient{leaderClient: leaderClient{cached: broker}}
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1", Offset: 10})
+
+	// Only the assigned partition without a committed offset gets a zero.
+	assert.NoError(t, qm.emitAssignedPartitions())
+	assert.Equal(t, []string{"kqm.group.g1.t1.1=0"}, recorder.gauges)
+}
+
+func TestEmitCoordinators(t *testing.T) {
+	_, broker := newLeaderBroker(t, nil)
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm"},
+	})
+	qm.Client = &refreshingCoordinatorClient{coordinatorClient{
+		leaderClient: leaderClient{cached: broker}, failing: "bad"}}
+	for _, group := range []string{"g1", "bad"} {
+		qm.storeConsumerOffset(&PartitionOffset{Topic: "t1", Partition: 0,
+			Group: group, Offset: 10})
+	}
+	qm.Coordinators.Store("bad", int32(7))
+
+	// The coordinator of a group that can't be resolved is forgotten.
+	qm.emitCoordinators()
+	assert.Equal(t, []string{fmt.Sprintf("kqm.group.g1.coordinator=%d",
+		broker.ID())}, recorder.gauges)
+	id, ok := qm.Coordinators.Load("g1")
+	assert.True(t, ok)
+	assert.Equal(t, broker.ID(), id)
+	_, ok = qm.Coordinators.Load("bad")
+	assert.False(t, ok)
+}
+
+// refreshingCoordinatorClient : coordinatorClient whose coordinators are
+// refreshed without contacting the brokers.
+type refreshingCoordinatorClient struct {
+	coordinatorClient
+}
+
+func (c *refreshingCoordinatorClient) RefreshCoordinator(group string) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"time"
+)
+
+// HealthCounts : Counts of the problems found in a broker offsets cycle,
+// which make up the cluster health score.
+type HealthCounts struct {
+	// Partitions monitored, and those without a leader or a broker offset.
+	Partitions     int
+	NoLeader       int
+	MissingOffsets int
+	// Lags computed, and those where the consumer offset is ahead of the
+	// broker offset or the group has a lag but hasn't committed recently.
+	Lags         int
+	Inversions   int
+	StaleCommits int
+}
+
+// Weights of each problem in the cluster health score. Partitions without a
+// leader or a broker offset weigh the most, since no lag is reported for
+// them at all. Inversions and stale commits produce a lag that is reported
+// but likely to be wrong.
+const (
+	noLeaderWeight       = 0.35
+	missingOffsetsWeight = 0.35
+	inversionsWeight     = 0.15
+	staleCommitsWeight   = 0.15
+)
+
+// HealthScore : Returns a score between 0 and 100 reflecting the confidence
+// in the lags of a cycle. The fraction of partitions (or lags) affected by
+// each problem is multiplied by its weight, and the weighted sum is deducted
+// from 100.
+func HealthScore(c HealthCounts) int64 {
+	fraction := func(count, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(count) / float64(total)
+	}
+	penalty := noLeaderWeight*fraction(c.NoLeader, c.Partitions) +
+		missingOffsetsWeight*fraction(c.MissingOffsets, c.Partitions) +
+		inversionsWeight*fraction(c.Inversions, c.Lags) +
+		staleCommitsWeight*fraction(c.StaleCommits, c.Lags)
+	score := int64(100*(1-penalty) + 0.5)
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// Counts the inversions and stale commits in the lags. A commit is stale
+// when the group has a lag and its last commit is older than ten intervals.
+func (qm *QueueMonitor) countLagProblems(counts *HealthCounts,
+	lags []PartitionLag, now time.Time) {
+	counts.Lags = len(lags)
+	for _, lag := range lags {
+		if lag.ConsumerOffset > lag.BrokerOffset {
+			counts.Inversions++
+		}
+		if lag.Lag <= 0 {
+			continue
+		}
+		tmp, ok := qm.CommitTimestamps.Load(lag.Group)
+		if !ok {
+			continue
+		}
+		age, ok := TimestampAge(tmp.(int64), now)
+		if ok && age > 10*qm.Config.Interval {
+			counts.StaleCommits++
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthScore(t *testing.T) {
+	assert.Equal(t, int64(100), HealthScore(HealthCounts{}))
+	assert.Equal(t, int64(100), HealthScore(HealthCounts{Partitions: 4,
+		Lags: 4}))
+	// A quarter of the partitions without a leader, and half of the lags
+	// inverted: 100 * (1 - 0.35/4 - 0.15/2).
+	assert.Equal(t, int64(84), HealthScore(HealthCounts{Partitions: 4,
+		NoLeader: 1, Lags: 4, Inversions: 2}))
+	assert.Equal(t, int64(0), HealthScore(HealthCounts{Partitions: 1,
+		NoLeader: 1, MissingOffsets: 1, Lags: 1, Inversions: 1,
+		StaleCommits: 1}))
+}
+
+func TestCountLagProblems(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{Interval: time.Minute})
+	now := time.Now()
+	millis := func(t time.Time) int64 {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	qm.CommitTimestamps.Store("stale", millis(now.Add(-time.Hour)))
+	qm.CommitTimestamps.Store("recent", millis(now.Add(-time.Minute)))
+
+	var counts HealthCounts
+	qm.countLagProblems(&counts, []PartitionLag{
+		{Group: "stale", Lag: 5, ConsumerOffset: 5, BrokerOffset: 10},
+		{Group: "stale", Lag: 0, ConsumerOffset: 10, BrokerOffset: 10},
+		{Group: "recent", Lag: 5, ConsumerOffset: 5, BrokerOffset: 10},
+		{Group: "recent", Lag: -2, ConsumerOffset: 12, BrokerOffset: 10},
+	}, now)
+	assert.Equal(t, HealthCounts{Lags: 4, Inversions: 1, StaleCommits: 1},
+		counts)
+}
@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Sends the metrics of KQM itself under the kqm namespace at the end of a
+// broker offsets cycle: the duration of the cycle, and the number of Offset
+// Topic messages that failed to parse, of Offset Topic consumer errors and
+// of broker offset requests that failed since the previous cycle.
+func (qm *QueueMonitor) emitInternalMetrics(start time.Time) {
+	qm.sendGaugeToStatsd(".kqm.cycle_duration_ms",
+		int64(time.Since(start)/time.Millisecond))
+	qm.sendGaugeToStatsd(".kqm.parse_errors",
+		atomic.SwapInt64(&qm.parseErrors, 0))
+	qm.sendGaugeToStatsd(".kqm.consumer_errors",
+		atomic.SwapInt64(&qm.consumerErrors, 0))
+	qm.sendGaugeToStatsd(".kqm.broker_errors",
+		atomic.SwapInt64(&qm.brokerErrors, 0))
+}
+
+// Increments the .kqm.negative_lag.<group>.<topic> counter by the number of
+// partitions of each group and topic where the consumer offset is ahead of
+// the broker offset. Such a lag usually comes from the broker offset being
+// fetched before the commit, but can also point to an offset reset or a
+// clock issue. The lags are expected to be sorted.
+func (qm *QueueMonitor) sendNegativeLags(lags []PartitionLag) {
+	for index := 0; index < len(lags); {
+		group, topic := lags[index].Group, lags[index].Topic
+		var count int64
+		for ; index < len(lags) && lags[index].Group == group &&
+			lags[index].Topic == topic; index++ {
+			if lags[index].ConsumerOffset > lags[index].BrokerOffset {
+				count++
+			}
+		}
+		if count > 0 {
+			qm.sendCountToStatsd(fmt.Sprintf(".kqm.negative_lag.%s.%s", group,
+				topic), count)
+		}
+	}
+}
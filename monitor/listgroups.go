@@ -0,0 +1,71 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/syncmap"
+)
+
+// ListGroups : Reads the consumer offsets, from the Offset Topic up to the
+// offsets it has when called (for at most the OnceTimeout), or from the
+// group coordinators, then prints the groups found with their topics.
+func (qm *QueueMonitor) ListGroups(ctx context.Context, w io.Writer) error {
+	if qm.Config.KafkaCfg.OffsetSource == AdminOffsetSource {
+		if err := qm.GetAdminOffsets(); err != nil {
+			return err
+		}
+	} else {
+		cCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		qm.consumeOffsetTopic(cCtx, &wg)
+		qm.waitConsumed(ctx, qm.Config.OnceTimeout)
+		cancel()
+		wg.Wait()
+	}
+	return PrintGroups(w, qm.OffsetStore)
+}
+
+// PrintGroups : Prints a line for each consumer group of the Offset Store,
+// with the group followed by the topics it committed offsets for. The
+// groups and their topics are sorted.
+func PrintGroups(w io.Writer, offsetStore *syncmap.Map) error {
+	groupTopics := make(map[string]map[string]bool)
+	offsetStore.Range(func(topicI, tbodyI interface{}) bool {
+		topic := topicI.(string)
+		tbodyI.(*syncmap.Map).Range(func(_, pbodyI interface{}) bool {
+			pbodyI.(*syncmap.Map).Range(func(groupI, _ interface{}) bool {
+				group := groupI.(string)
+				if _, ok := groupTopics[group]; !ok {
+					groupTopics[group] = make(map[string]bool)
+				}
+				groupTopics[group][topic] = true
+				return true
+			})
+			return true
+		})
+		return true
+	})
+
+	groups := make([]string, 0, len(groupTopics))
+	for group := range groupTopics {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		topics := make([]string, 0, len(groupTopics[group]))
+		for topic := range groupTopics[group] {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		_, err := fmt.Fprintf(w, "%s\t%s\n", group, strings.Join(topics, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package monitor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/syncmap"
+)
+
+func TestPrintGroups(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	for _, offset := range []PartitionOffset{
+		{Topic: "payments", Partition: 0, Group: "billing", Offset: 1},
+		{Topic: "orders", Partition: 0, Group: "billing", Offset: 1},
+		{Topic: "orders", Partition: 1, Group: "billing", Offset: 1},
+		{Topic: "orders", Partition: 0, Group: "analytics", Offset: 1},
+	} {
+		offset := offset
+		qm.storeConsumerOffset(&offset)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, PrintGroups(&buf, qm.OffsetStore))
+	assert.Equal(t, "analytics\torders\nbilling\torders,payments\n",
+		buf.String())
+
+	buf.Reset()
+	assert.NoError(t, PrintGroups(&buf, &syncmap.Map{}))
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,96 @@
+package monitor
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/syncmap"
+)
+
+// Adds the partitions of the topics in the map that no group has committed
+// to, so that their broker offsets are fetched as well. The map passed is
+// left untouched.
+func (qm *QueueMonitor) withAllPartitions(
+	tpMap map[string][]int32) map[string][]int32 {
+	client, release := qm.acquireClient()
+	defer release()
+	all := make(map[string][]int32, len(tpMap))
+	for topic, partitions := range tpMap {
+		all[topic] = partitions
+		topicPartitions, err := client.Partitions(topic)
+		if err != nil {
+			log.Errorf("Error while fetching partitions of topic %s: %s",
+				topic, err)
+			continue
+		}
+		seen := make(map[int32]bool, len(partitions))
+		for _, partition := range partitions {
+			seen[partition] = true
+		}
+		for _, partition := range topicPartitions {
+			if !seen[partition] && qm.partitionAllowed(topic, partition) {
+				all[topic] = append(all[topic], partition)
+			}
+		}
+	}
+	return all
+}
+
+// Sends a missing_commit gauge of 1 for each group consuming a topic, i.e.
+// with a committed offset at any of its partitions, but without one at a
+// partition of the topic that has a broker offset. Such a partition gets no
+// lag, which hides new or stuck consumers. A gauge of 0 is sent once such a
+// partition gets a committed offset, or is no longer checked.
+func (qm *QueueMonitor) sendMissingCommits(tpMap map[string][]int32,
+	now time.Time, maxAge time.Duration) {
+	missing := make(map[string]bool)
+	for topic, partitions := range tpMap {
+		groups := qm.topicGroups(topic)
+		for _, partition := range partitions {
+			if _, ok := qm.BrokerOffsetStore.Load(topic, partition, now,
+				maxAge); !ok {
+				continue
+			}
+			for _, group := range groups {
+				if _, ok := qm.loadConsumerOffset(topic, partition, group); ok {
+					continue
+				}
+				stat := qm.partitionStat(group, topic, partition,
+					".missing_commit")
+				missing[stat] = true
+				qm.missingCommits.Store(stat, true)
+				qm.sendGauge(stat, 1)
+			}
+		}
+	}
+	qm.missingCommits.Range(func(statI, _ interface{}) bool {
+		stat := statI.(string)
+		if !missing[stat] {
+			qm.missingCommits.Delete(stat)
+			qm.sendGauge(stat, 0)
+		}
+		return true
+	})
+}
+
+// Returns the groups with a committed offset at any partition of the topic.
+func (qm *QueueMonitor) topicGroups(topic string) []string {
+	tmp, ok := qm.OffsetStore.Load(topic)
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var groups []string
+	tmp.(*syncmap.Map).Range(func(_, pbodyI interface{}) bool {
+		pbodyI.(*syncmap.Map).Range(func(groupI, _ interface{}) bool {
+			group := groupI.(string)
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+			return true
+		})
+		return true
+	})
+	return groups
+}
@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendMissingCommits(t *testing.T) {
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm"},
+	})
+	for _, offset := range []*PartitionOffset{
+		{Topic: "t1", Partition: 0, Group: "g1", Offset: 10},
+		{Topic: "t1", Partition: 1, Group: "g1", Offset: 10},
+		{Topic: "t1", Partition: 0, Group: "g2", Offset: 10},
+		{Topic: "t2", Partition: 0, Group: "g3", Offset: 10},
+	} {
+		qm.storeConsumerOffset(offset)
+	}
+	now := time.Now()
+	for partition := int32(0); partition < 3; partition++ {
+		qm.BrokerOffsetStore.Store("t1", partition, 20, now)
+	}
+	qm.BrokerOffsetStore.Store("t2", 0, 20, now)
+
+	// Partition 3 of t1 has no broker offset, so no group is reported as
+	// missing a commit for it.
+	qm.sendMissingCommits(map[string][]int32{
+		"t1": {0, 1, 2, 3},
+		"t2": {0},
+	}, now, time.Minute)
+	sort.Strings(recorder.gauges)
+	assert.Equal(t, []string{
+		"kqm.group.g1.t1.2.missing_commit=1",
+		"kqm.group.g2.t1.1.missing_commit=1",
+		"kqm.group.g2.t1.2.missing_commit=1",
+	}, recorder.gauges)
+
+	// Once committed to, the partitions get a gauge of 0, only once.
+	qm.storeConsumerOffset(&PartitionOffset{
+		Topic: "t1", Partition: 2, Group: "g1", Offset: 10})
+	for _, cycle := range [][]string{{
+		"kqm.group.g1.t1.2.missing_commit=0",
+		"kqm.group.g2.t1.1.missing_commit=1",
+		"kqm.group.g2.t1.2.missing_commit=1",
+	}, {
+		"kqm.group.g2.t1.1.missing_commit=1",
+		"kqm.group.g2.t1.2.missing_commit=1",
+	}} {
+		recorder.gauges = nil
+		qm.sendMissingCommits(map[string][]int32{
+			"t1": {0, 1, 2, 3},
+			"t2": {0},
+		}, now, time.Minute)
+		sort.Strings(recorder.gauges)
+		assert.Equal(t, cycle, recorder.gauges)
+	}
+}
@@ -0,0 +1,79 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// Waits until the Offset Topic partitions owned by this instance have been
+// consumed up to the offsets they have when called, for at most the timeout.
+// There's nothing to wait for when the consumption starts from the newest
+// offsets.
+func (qm *QueueMonitor) waitConsumed(ctx context.Context,
+	timeout time.Duration) {
+	if qm.Config.KafkaCfg.OffsetStart == NewestOffsetStart {
+		return
+	}
+	targets, err := qm.offsetTopicTargets()
+	if err != nil {
+		log.Errorln("Error while fetching the Offset Topic offsets.", err)
+		return
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !qm.consumedUpTo(targets) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			log.Warningf("Offset Topic not consumed within %s, running the "+
+				"cycle with the offsets consumed so far", timeout)
+			return
+		case <-ticker.C:
+		}
+	}
+	log.Infoln("Consumed the Offset Topic up to its latest offsets.")
+}
+
+// Returns the latest offset of each non-empty Offset Topic partition owned
+// by this instance.
+func (qm *QueueMonitor) offsetTopicTargets() (map[int32]int64, error) {
+	client, release := qm.acquireClient()
+	defer release()
+	partitions, err := client.Partitions(ConsumerOffsetTopic)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[int32]int64)
+	for _, partition := range qm.Config.KafkaCfg.ShardPartitions(partitions) {
+		newest, err := client.GetOffset(ConsumerOffsetTopic, partition,
+			sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		oldest, err := client.GetOffset(ConsumerOffsetTopic, partition,
+			sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		}
+		if newest > oldest {
+			targets[partition] = newest
+		}
+	}
+	return targets, nil
+}
+
+// Reports whether each partition has been consumed up to its target offset.
+func (qm *QueueMonitor) consumedUpTo(targets map[int32]int64) bool {
+	for partition, target := range targets {
+		position, ok := qm.positions.Load(partition)
+		if !ok || position.(int64) < target {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumedUpTo(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	targets := map[int32]int64{0: 10, 1: 5}
+	assert.False(t, qm.consumedUpTo(targets))
+
+	qm.positions.Store(int32(0), int64(10))
+	assert.False(t, qm.consumedUpTo(targets))
+
+	qm.positions.Store(int32(1), int64(4))
+	assert.False(t, qm.consumedUpTo(targets))
+
+	qm.positions.Store(int32(1), int64(5))
+	assert.True(t, qm.consumedUpTo(targets))
+	assert.True(t, qm.consumedUpTo(map[int32]int64{}))
+}
+
+func TestRunOnce(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	commits := &sarama.FetchResponse{}
+	for offset, group := range []string{"group1", "group2"} {
+		commits.AddMessage(ConsumerOffsetTopic, 0,
+			sarama.ByteEncoder(encode(uint16(1), group, "topic1", uint32(0))),
+			sarama.ByteEncoder(encode(uint16(1), uint64(40+offset), "meta",
+				uint64(1500000000000), uint64(1500086400000))),
+			int64(offset))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(ConsumerOffsetTopic, 0, broker.BrokerID()).
+			SetLeader("topic1", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(ConsumerOffsetTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(ConsumerOffsetTopic, 0, sarama.OffsetNewest, 2).
+			SetOffset("topic1", 0, sarama.OffsetNewest, 50),
+		"FetchRequest": sarama.NewMockWrapper(commits),
+	})
+	allowlist := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`["topic1"]`))
+		}))
+	defer allowlist.Close()
+
+	qm, err := NewQueueMonitor(&QMConfig{
+		KafkaCfg: KafkaConfig{
+			Brokers:      []string{broker.Addr()},
+			OffsetFormat: BurrowOffsetFormat,
+			OffsetStart:  OldestOffsetStart,
+		},
+		Interval:             time.Hour,
+		MaxBrokerConcurrency: 1,
+		DryRun:               true,
+		Once:                 true,
+		OnceTimeout:          10 * time.Second,
+		AllowlistURL:         allowlist.URL,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer qm.Close()
+
+	// The cycle runs once both commits are consumed, well before the
+	// OnceTimeout.
+	done := make(chan error)
+	go func() {
+		done <- qm.RunOnce(context.Background())
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunOnce did not return once the Offset Topic was consumed")
+	}
+	offset, ok := qm.loadConsumerOffset("topic1", 0, "group2")
+	assert.True(t, ok)
+	assert.Equal(t, int64(41), offset)
+	// The allowlist is loaded before the cycle.
+	assert.False(t, qm.Allowlist.Allowed("topic2", 0))
+}
+
+func TestStartOnceUnreachable(t *testing.T) {
+	cfg := &QMConfig{
+		KafkaCfg: KafkaConfig{
+			Brokers: []string{"127.0.0.1:1"},
+		},
+		Once:                true,
+		OnceTimeout:         100 * time.Millisecond,
+		ReconnectBackoff:    time.Millisecond,
+		MaxReconnectBackoff: time.Millisecond,
+	}
+
+	// Start gives up on the brokers after the OnceTimeout.
+	done := make(chan error)
+	go func() {
+		done <- Start(context.Background(), cfg)
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, sarama.ErrOutOfBrokers, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start kept retrying the unreachable brokers")
+	}
+}
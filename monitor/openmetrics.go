@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// OpenMetricsReporter : Defines a Reporter producing a snapshot of the lags
+// of every cycle to a Kafka topic, as a single message in the OpenMetrics
+// text exposition format.
+type OpenMetricsReporter struct {
+	Client   sarama.Client
+	Producer sarama.SyncProducer
+	Topic    string
+}
+
+// NewOpenMetricsReporter : Returns an OpenMetricsReporter producing to the
+// topic with a producer built from the client passed as argument, which is
+// closed along with the reporter.
+func NewOpenMetricsReporter(client sarama.Client, topic string) (
+	*OpenMetricsReporter, error) {
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenMetricsReporter{Client: client, Producer: producer,
+		Topic: topic}, nil
+}
+
+// Report : Produces the snapshot of the lags.
+func (r *OpenMetricsReporter) Report(timestamp time.Time, lags []PartitionLag) error {
+	_, _, err := r.Producer.SendMessage(&sarama.ProducerMessage{
+		Topic: r.Topic,
+		Value: sarama.ByteEncoder(FormatOpenMetrics(timestamp, lags)),
+	})
+	return err
+}
+
+// Close : Closes the producer and its client.
+func (r *OpenMetricsReporter) Close() error {
+	err := r.Producer.Close()
+	if r.Client != nil {
+		if cErr := r.Client.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// FormatOpenMetrics : Formats the lags as a kqm_consumer_lag gauge family in
+// the OpenMetrics text exposition format, with the timestamp in seconds.
+func FormatOpenMetrics(timestamp time.Time, lags []PartitionLag) []byte {
+	var buf bytes.Buffer
+	ts := float64(timestamp.UnixNano()) / float64(time.Second)
+	buf.WriteString("# TYPE kqm_consumer_lag gauge\n")
+	buf.WriteString("# HELP kqm_consumer_lag Lag of the consumer group in messages.\n")
+	for _, lag := range lags {
+		fmt.Fprintf(&buf, "kqm_consumer_lag{group=\"%s\",topic=\"%s\","+
+			"partition=\"%d\"} %d %.3f\n", escapeLabel(lag.Group),
+			escapeLabel(lag.Topic), lag.Partition, lag.Lag, ts)
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Bytes()
+}
+
+// Escapes a label value as required by the exposition format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,68 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingProducer : Producer recording the messages sent to it.
+type recordingProducer struct {
+	sarama.SyncProducer
+	messages []*sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessage(message *sarama.ProducerMessage) (
+	int32, int64, error) {
+	p.messages = append(p.messages, message)
+	return 0, int64(len(p.messages)), nil
+}
+
+func TestOpenMetricsReporter(t *testing.T) {
+	producer := &recordingProducer{}
+	reporter := &OpenMetricsReporter{Producer: producer, Topic: "lags"}
+	timestamp := time.Unix(1508140800, 0)
+	assert.NoError(t, reporter.Report(timestamp, []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: `g"2`, Topic: "t1", Partition: 1, Lag: 0},
+	}))
+
+	if !assert.Len(t, producer.messages, 1) {
+		return
+	}
+	message := producer.messages[0]
+	assert.Equal(t, "lags", message.Topic)
+	assert.Nil(t, message.Key)
+	value, err := message.Value.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, "# TYPE kqm_consumer_lag gauge\n"+
+		"# HELP kqm_consumer_lag Lag of the consumer group in messages.\n"+
+		"kqm_consumer_lag{group=\"g1\",topic=\"t1\",partition=\"0\"} 5 1508140800.000\n"+
+		"kqm_consumer_lag{group=\"g\\\"2\",topic=\"t1\",partition=\"1\"} 0 1508140800.000\n"+
+		"# EOF\n", string(value))
+}
+
+func TestNewReportersOpenMetricsClient(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	// The reporter produces with a client of its own, which the rebuild of
+	// the client of the QueueMonitor doesn't close.
+	reporters, err := newReporters(&QMConfig{
+		KafkaCfg:         KafkaConfig{Brokers: []string{broker.Addr()}},
+		OpenMetricsTopic: "lags",
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, reporters, 1) {
+		return
+	}
+	reporter := reporters[0].(*OpenMetricsReporter)
+	assert.False(t, reporter.Client.Closed())
+	assert.NoError(t, reporter.Close())
+	assert.True(t, reporter.Client.Closed())
+}
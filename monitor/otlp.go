@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPReporter : Defines a Reporter pushing the lags of every cycle to an
+// OpenTelemetry collector as a consumer.lag gauge, with the group, topic and
+// partition attributes. The metrics are sent with the OTLP/HTTP protocol in
+// its JSON encoding, with the static tags as attributes of the resource.
+type OTLPReporter struct {
+	URL        string
+	Tags       []string
+	HTTPClient *http.Client
+}
+
+// NewOTLPReporter : Returns an OTLPReporter pushing to the endpoint of the
+// collector, e.g. http://localhost:4318.
+func NewOTLPReporter(cfg OTLPConfig) (*OTLPReporter, error) {
+	if !strings.HasPrefix(cfg.Endpoint, "http://") &&
+		!strings.HasPrefix(cfg.Endpoint, "https://") {
+		return nil, fmt.Errorf("Invalid OTLP endpoint, expected an http or "+
+			"https URL: %s", cfg.Endpoint)
+	}
+	return &OTLPReporter{
+		URL:        strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/metrics",
+		Tags:       cfg.Tags,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Types of the OTLP ExportMetricsServiceRequest, as mapped to JSON. The
+// 64-bit integers are encoded as strings.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string    `json:"name"`
+		Description string    `json:"description"`
+		Unit        string    `json:"unit"`
+		Gauge       otlpGauge `json:"gauge"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpDataPoint struct {
+		Attributes   []otlpAttribute `json:"attributes"`
+		TimeUnixNano string          `json:"timeUnixNano"`
+		AsInt        string          `json:"asInt"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue,omitempty"`
+		IntValue    string `json:"intValue,omitempty"`
+	}
+)
+
+// Report : Pushes the lags as the data points of the consumer.lag gauge.
+func (r *OTLPReporter) Report(timestamp time.Time, lags []PartitionLag) error {
+	if len(lags) == 0 {
+		return nil
+	}
+	points := make([]otlpDataPoint, len(lags))
+	nanos := strconv.FormatInt(timestamp.UnixNano(), 10)
+	for i, lag := range lags {
+		points[i] = otlpDataPoint{
+			Attributes: []otlpAttribute{
+				{"group", otlpValue{StringValue: lag.Group}},
+				{"topic", otlpValue{StringValue: lag.Topic}},
+				{"partition", otlpValue{
+					IntValue: strconv.Itoa(int(lag.Partition))}},
+			},
+			TimeUnixNano: nanos,
+			AsInt:        strconv.FormatInt(lag.Lag, 10),
+		}
+	}
+	resource := []otlpAttribute{
+		{"service.name", otlpValue{StringValue: "kqm"}},
+	}
+	for _, tag := range r.Tags {
+		if parts := strings.SplitN(tag, "=", 2); len(parts) == 2 {
+			resource = append(resource,
+				otlpAttribute{parts[0], otlpValue{StringValue: parts[1]}})
+		}
+	}
+	request := otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: resource},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: "kqm"},
+			Metrics: []otlpMetric{{
+				Name:        "consumer.lag",
+				Description: "Lag of the consumer group in messages.",
+				Unit:        "{message}",
+				Gauge:       otlpGauge{DataPoints: points},
+			}},
+		}},
+	}}}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	response, err := r.HTTPClient.Post(r.URL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Error response from the OTLP collector: %s %s",
+			response.Status, message)
+	}
+	return nil
+}
+
+// Close : Nothing to close for the OTLPReporter.
+func (r *OTLPReporter) Close() error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPReporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/metrics", r.URL.Path)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			body, _ := ioutil.ReadAll(r.Body)
+			var request otlpRequest
+			assert.NoError(t, json.Unmarshal(body, &request))
+			requests <- request
+		}))
+	defer receiver.Close()
+
+	reporter, err := NewOTLPReporter(OTLPConfig{
+		Endpoint: receiver.URL + "/",
+		Tags:     []string{"region=us-east"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	timestamp := time.Unix(1508140800, 0)
+	err = reporter.Report(timestamp, []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: "g2", Topic: "t1", Partition: 3, Lag: 0},
+	})
+	assert.NoError(t, err)
+
+	request := <-requests
+	if !assert.Len(t, request.ResourceMetrics, 1) ||
+		!assert.Len(t, request.ResourceMetrics[0].ScopeMetrics, 1) {
+		return
+	}
+	assert.Equal(t, []otlpAttribute{
+		{"service.name", otlpValue{StringValue: "kqm"}},
+		{"region", otlpValue{StringValue: "us-east"}},
+	}, request.ResourceMetrics[0].Resource.Attributes)
+	metrics := request.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if !assert.Len(t, metrics, 1) {
+		return
+	}
+	assert.Equal(t, "consumer.lag", metrics[0].Name)
+	assert.Equal(t, []otlpDataPoint{
+		{
+			Attributes: []otlpAttribute{
+				{"group", otlpValue{StringValue: "g1"}},
+				{"topic", otlpValue{StringValue: "t1"}},
+				{"partition", otlpValue{IntValue: "0"}},
+			},
+			TimeUnixNano: "1508140800000000000",
+			AsInt:        "5",
+		},
+		{
+			Attributes: []otlpAttribute{
+				{"group", otlpValue{StringValue: "g2"}},
+				{"topic", otlpValue{StringValue: "t1"}},
+				{"partition", otlpValue{IntValue: "3"}},
+			},
+			TimeUnixNano: "1508140800000000000",
+			AsInt:        "0",
+		},
+	}, metrics[0].Gauge.DataPoints)
+}
+
+func TestOTLPReporterErrors(t *testing.T) {
+	_, err := NewOTLPReporter(OTLPConfig{Endpoint: "localhost:4318"})
+	assert.Error(t, err)
+
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}))
+	defer receiver.Close()
+	reporter, err := NewOTLPReporter(OTLPConfig{Endpoint: receiver.URL})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = reporter.Report(time.Now(), []PartitionLag{{Group: "g1"}})
+	assert.Error(t, err)
+}
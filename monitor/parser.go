@@ -9,22 +9,84 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// ParseConsumerMessage : Burrow-based Consumer Offset Message parser function.
-func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, error) {
-	readString := func(buf *bytes.Buffer) (string, error) {
-		var strlen uint16
-		err := binary.Read(buf, binary.BigEndian, &strlen)
+// OffsetParser : Defines the type of a parser of the messages on the Offset
+// Topic. A nil PartitionOffset is returned for messages that don't carry a
+// consumer offset.
+type OffsetParser func(message *sarama.ConsumerMessage) (*PartitionOffset, error)
+
+// Offset formats for which parsers are registered by default.
+const (
+	BurrowOffsetFormat = "burrow"
+	ModernOffsetFormat = "modern"
+)
+
+// OffsetParsers : Registered Offset Topic parsers, keyed by offset format.
+var OffsetParsers = map[string]OffsetParser{
+	BurrowOffsetFormat: ParseConsumerMessage,
+	ModernOffsetFormat: ParseModernConsumerMessage,
+}
+
+// RegisterOffsetParser : Registers an Offset Topic parser for a format, which
+// can then be selected through the configuration.
+func RegisterOffsetParser(format string, parser OffsetParser) {
+	OffsetParsers[format] = parser
+}
+
+// Reads a string prefixed by its int16 length.
+func readString(buf *bytes.Buffer) (string, error) {
+	var strlen uint16
+	err := binary.Read(buf, binary.BigEndian, &strlen)
+	if err != nil {
+		return "", err
+	}
+	strbytes := make([]byte, strlen)
+	n, err := buf.Read(strbytes)
+	if (err != nil) || (n != int(strlen)) {
+		return "", fmt.Errorf("String Underflow")
+	}
+	return string(strbytes), nil
+}
+
+// Reads the fields of an offset commit value of the schema version passed as
+// argument, following the version. The leader epoch is only present in
+// version 3 and the expiration time only in version 1.
+func readOffsetValue(buf *bytes.Buffer, valver uint16) (offset, timestamp,
+	exptime uint64, leaderEpoch int32, err error) {
+	err = binary.Read(buf, binary.BigEndian, &offset)
+	if err != nil {
+		err = fmt.Errorf("Error reading offset from message value. Details: %s", err)
+		return
+	}
+	if valver == 3 {
+		err = binary.Read(buf, binary.BigEndian, &leaderEpoch)
 		if err != nil {
-			return "", err
+			err = fmt.Errorf("Error reading leader epoch from message value. Details: %s", err)
+			return
 		}
-		strbytes := make([]byte, strlen)
-		n, err := buf.Read(strbytes)
-		if (err != nil) || (n != int(strlen)) {
-			return "", fmt.Errorf("String Underflow")
+	}
+	_, err = readString(buf)
+	if err != nil {
+		err = fmt.Errorf("Error reading metadata(omitted) from message value. Details: %s", err)
+		return
+	}
+	err = binary.Read(buf, binary.BigEndian, &timestamp)
+	if err != nil {
+		err = fmt.Errorf("Error reading timestamp from message value. Details: %s", err)
+		return
+	}
+	if valver == 1 {
+		err = binary.Read(buf, binary.BigEndian, &exptime)
+		if err != nil {
+			err = fmt.Errorf("Error reading expiration time from message value. Details: %s", err)
+			return
 		}
-		return string(strbytes), nil
 	}
+	return
+}
 
+// ParseConsumerMessage : Burrow-based Consumer Offset Message parser function.
+// It reads the value versions 0 to 3, and the unknown versions as version 1.
+func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, error) {
 	var (
 		keyver, valver             uint16
 		group, topic               string
@@ -34,6 +96,9 @@ func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, er
 
 	buf := bytes.NewBuffer(message.Key)
 	err := binary.Read(buf, binary.BigEndian, &keyver)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading version from message key. Details: %s", err)
+	}
 	switch keyver {
 	case 0, 1:
 		group, err = readString(buf)
@@ -49,9 +114,10 @@ func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, er
 			return nil, fmt.Errorf("Error parsing partition from key. Details: %s", err)
 		}
 	case 2:
+		// Group metadata messages don't carry a consumer offset.
 		return nil, nil
 	default:
-		return nil, fmt.Errorf("Unknown version error in message key. Details: %s", err)
+		return nil, fmt.Errorf("Unknown version in message key: %d", keyver)
 	}
 
 	if message.Value == nil {
@@ -59,7 +125,7 @@ func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, er
 			Topic:         topic,
 			Partition:     int32(partition),
 			Group:         group,
-			Timestamp:     -1,
+			Timestamp:     UnknownTimestamp,
 			Offset:        -1,
 			DueForRemoval: true,
 		}, nil
@@ -70,21 +136,13 @@ func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, er
 	if err != nil {
 		return nil, fmt.Errorf("Error reading version from message value. Details: %s", err)
 	}
-	err = binary.Read(buf, binary.BigEndian, &offset)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading offset from message value. Details: %s", err)
+	// Unknown versions are read with the layout of version 1.
+	if valver > 3 {
+		valver = 1
 	}
-	_, err = readString(buf)
+	offset, timestamp, exptime, _, err = readOffsetValue(buf, valver)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading metadata(omitted) from message value. Details: %s", err)
-	}
-	err = binary.Read(buf, binary.BigEndian, &timestamp)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading timestamp from message value. Details: %s", err)
-	}
-	err = binary.Read(buf, binary.BigEndian, &exptime)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading expiration time from message value. Details: %s", err)
+		return nil, err
 	}
 
 	partitionOffset := &PartitionOffset{
@@ -107,3 +165,76 @@ func ParseConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, er
 
 	return partitionOffset, nil
 }
+
+// ParseModernConsumerMessage : Strict Consumer Offset Message parser, which
+// reads the value according to its schema version (0 to 3) and rejects
+// unknown key and value versions.
+func ParseModernConsumerMessage(message *sarama.ConsumerMessage) (*PartitionOffset, error) {
+	var (
+		keyver, valver uint16
+		partition      uint32
+	)
+
+	buf := bytes.NewBuffer(message.Key)
+	err := binary.Read(buf, binary.BigEndian, &keyver)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading version from message key. Details: %s", err)
+	}
+	switch keyver {
+	case 0, 1:
+	case 2:
+		// Group metadata messages don't carry a consumer offset.
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown version in message key: %d", keyver)
+	}
+	group, err := readString(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing group message from key. Details: %s", err)
+	}
+	topic, err := readString(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing topic from key. Details: %s", err)
+	}
+	err = binary.Read(buf, binary.BigEndian, &partition)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing partition from key. Details: %s", err)
+	}
+
+	if message.Value == nil {
+		return &PartitionOffset{
+			Topic:         topic,
+			Partition:     int32(partition),
+			Group:         group,
+			Timestamp:     UnknownTimestamp,
+			Offset:        -1,
+			DueForRemoval: true,
+		}, nil
+	}
+
+	buf = bytes.NewBuffer(message.Value)
+	err = binary.Read(buf, binary.BigEndian, &valver)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading version from message value. Details: %s", err)
+	}
+	if valver > 3 {
+		return nil, fmt.Errorf("Unknown version in message value: %d", valver)
+	}
+	offset, timestamp, _, leaderEpoch, err := readOffsetValue(buf, valver)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("[%s,%s,%d]::[OffsetMetadata[%d,NO_METADATA],CommitTime %d,"+
+		"LeaderEpoch %d,ValueVersion %d]", group, topic, int32(partition),
+		int64(offset), int64(timestamp), leaderEpoch, valver)
+
+	return &PartitionOffset{
+		Topic:         topic,
+		Partition:     int32(partition),
+		Group:         group,
+		Timestamp:     int64(timestamp),
+		Offset:        int64(offset),
+		DueForRemoval: false,
+	}, nil
+}
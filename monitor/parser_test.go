@@ -0,0 +1,150 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// errorHook : Logrus hook counting the errors logged.
+type errorHook struct {
+	errors int
+}
+
+func (h *errorHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (h *errorHook) Fire(entry *log.Entry) error {
+	h.errors++
+	return nil
+}
+
+// fakePartitionConsumer : PartitionConsumer delivering a fixed set of
+// messages.
+type fakePartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func (c *fakePartitionConsumer) HighWaterMarkOffset() int64 {
+	return int64(len(c.messages))
+}
+
+// Encodes the fields passed as argument in the Offset Topic wire format.
+func encode(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if s, ok := field.(string); ok {
+			binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+			buf.WriteString(s)
+			continue
+		}
+		binary.Write(&buf, binary.BigEndian, field)
+	}
+	return buf.Bytes()
+}
+
+func TestGroupMetadataMessageSkipped(t *testing.T) {
+	message := &sarama.ConsumerMessage{
+		Key:   encode(uint16(2), "group1"),
+		Value: encode(uint16(1), "consumer", int32(1), "range", "leader"),
+	}
+	for format, parser := range OffsetParsers {
+		partitionOffset, err := parser(message)
+		assert.NoError(t, err, format)
+		assert.Nil(t, partitionOffset, format)
+	}
+
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Parser = ParseConsumerMessage
+	hook := &errorHook{}
+	logger := log.StandardLogger()
+	hooks := logger.Hooks
+	logger.Hooks = make(log.LevelHooks)
+	logger.Hooks.Add(hook)
+	defer func() { logger.Hooks = hooks }()
+
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- message
+	close(messages)
+	qm.consumeMessage(&fakePartitionConsumer{messages: messages}, 0, func() {})
+
+	assert.Equal(t, 0, hook.errors)
+	stored := 0
+	qm.OffsetStore.Range(func(_, _ interface{}) bool {
+		stored++
+		return true
+	})
+	assert.Equal(t, 0, stored)
+}
+
+func TestUnknownKeyVersion(t *testing.T) {
+	for format, parser := range OffsetParsers {
+		_, err := parser(&sarama.ConsumerMessage{Key: encode(uint16(9), "g")})
+		assert.EqualError(t, err, "Unknown version in message key: 9", format)
+		_, err = parser(&sarama.ConsumerMessage{Key: []byte{0}})
+		assert.Error(t, err, format)
+	}
+}
+
+func TestParseValueVersions(t *testing.T) {
+	key := encode(uint16(1), "group1", "topic1", uint32(3))
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"v0", encode(uint16(0), uint64(42), "meta", uint64(1500000000000))},
+		{"v1", encode(uint16(1), uint64(42), "meta", uint64(1500000000000),
+			uint64(1500086400000))},
+		{"v2", encode(uint16(2), uint64(42), "meta", uint64(1500000000000))},
+		{"v3", encode(uint16(3), uint64(42), int32(7), "meta",
+			uint64(1500000000000))},
+	}
+	expected := &PartitionOffset{
+		Topic:     "topic1",
+		Partition: 3,
+		Group:     "group1",
+		Offset:    42,
+		Timestamp: 1500000000000,
+	}
+	for _, test := range tests {
+		for format, parser := range OffsetParsers {
+			partitionOffset, err := parser(&sarama.ConsumerMessage{
+				Key:   key,
+				Value: test.value,
+			})
+			assert.NoError(t, err, test.name+" "+format)
+			assert.Equal(t, expected, partitionOffset, test.name+" "+format)
+		}
+	}
+}
+
+func TestCommitTimestampStored(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Parser = ParseConsumerMessage
+
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{
+		Key: encode(uint16(1), "group1", "topic1", uint32(3)),
+		Value: encode(uint16(1), uint64(42), "meta", uint64(1500000000000),
+			uint64(1500086400000)),
+	}
+	close(messages)
+	qm.consumeMessage(&fakePartitionConsumer{messages: messages}, 0, func() {})
+
+	commit, ok := qm.loadConsumerCommit("topic1", 3, "group1")
+	assert.True(t, ok)
+	assert.Equal(t, ConsumerOffset{Offset: 42, Timestamp: 1500000000000}, commit)
+	offset, ok := qm.loadConsumerOffset("topic1", 3, "group1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), offset)
+}
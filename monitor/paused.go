@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PauseDetector : Tracks the broker and consumer offsets of the partitions
+// across cycles to find partitions that a consumer has likely paused, i.e.
+// the broker offset keeps moving while the committed offset stays frozen for
+// longer than After, even though the partition is assigned to a member.
+type PauseDetector struct {
+	After  time.Duration
+	mutex  sync.Mutex
+	states map[string]*pauseState
+}
+
+type pauseState struct {
+	brokerOffset   int64
+	consumerOffset int64
+	frozenSince    time.Time
+}
+
+// NewPauseDetector : Returns a PauseDetector with the specified threshold.
+func NewPauseDetector(after time.Duration) *PauseDetector {
+	return &PauseDetector{
+		After:  after,
+		states: make(map[string]*pauseState),
+	}
+}
+
+// Observe : Records the lags of a cycle and returns the ones for which the
+// partition is suspected to be paused. States of partitions no longer
+// present in the lags are dropped.
+func (d *PauseDetector) Observe(lags []PartitionLag,
+	assigned func(group, topic string, partition int32) bool,
+	now time.Time) map[PartitionLag]bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	paused := make(map[PartitionLag]bool)
+	states := make(map[string]*pauseState)
+	for _, lag := range lags {
+		key := fmt.Sprintf("%s/%s/%d", lag.Group, lag.Topic, lag.Partition)
+		state, ok := d.states[key]
+		if !ok || state.consumerOffset != lag.ConsumerOffset {
+			states[key] = &pauseState{
+				brokerOffset:   lag.BrokerOffset,
+				consumerOffset: lag.ConsumerOffset,
+				frozenSince:    now,
+			}
+			continue
+		}
+		moving := lag.BrokerOffset > state.brokerOffset
+		state.brokerOffset = lag.BrokerOffset
+		states[key] = state
+		if moving && now.Sub(state.frozenSince) >= d.After &&
+			assigned(lag.Group, lag.Topic, lag.Partition) {
+			paused[lag] = true
+		}
+	}
+	d.states = states
+	return paused
+}
+
+// Sends a suspected_paused gauge for each of the lags, which is 1 when the
+// partition is suspected to be paused by the group's consumer.
+func (qm *QueueMonitor) detectPaused(lags []PartitionLag) error {
+	assignments, err := qm.GetGroupAssignments()
+	if err != nil {
+		return err
+	}
+	assigned := func(group, topic string, partition int32) bool {
+		for _, p := range assignments[group][topic] {
+			if p == partition {
+				return true
+			}
+		}
+		return false
+	}
+	paused := qm.PauseDetector.Observe(lags, assigned, time.Now())
+	for _, lag := range lags {
+		var value int64
+		if paused[lag] {
+			log.Infof("Suspected paused partition. Group: %s, Topic: %s, "+
+				"Partn: %d, Lag: %d", lag.Group, lag.Topic, lag.Partition,
+				lag.Lag)
+			value = 1
+		}
+		stat := qm.partitionStat(lag.Group, lag.Topic, lag.Partition,
+			".suspected_paused")
+		qm.sendGauge(stat, value)
+	}
+	return nil
+}
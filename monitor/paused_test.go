@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauseDetector(t *testing.T) {
+	detector := NewPauseDetector(time.Minute)
+	assigned := func(group, topic string, partition int32) bool {
+		return partition == 0
+	}
+	lag := func(partition int32, brokerOffset int64) PartitionLag {
+		return PartitionLag{Group: "g1", Topic: "t1", Partition: partition,
+			ConsumerOffset: 10, BrokerOffset: brokerOffset,
+			Lag: brokerOffset - 10}
+	}
+	start := time.Now()
+
+	detector.Observe([]PartitionLag{lag(0, 20), lag(1, 20)}, assigned, start)
+	// Frozen, but not for long enough yet.
+	paused := detector.Observe([]PartitionLag{lag(0, 30), lag(1, 30)},
+		assigned, start.Add(30*time.Second))
+	assert.Empty(t, paused)
+
+	// Only the assigned partition is suspected once the threshold passes.
+	paused = detector.Observe([]PartitionLag{lag(0, 40), lag(1, 40)},
+		assigned, start.Add(time.Minute))
+	assert.Equal(t, map[PartitionLag]bool{lag(0, 40): true}, paused)
+
+	// Nothing is suspected while the broker offset doesn't move.
+	paused = detector.Observe([]PartitionLag{lag(0, 40)}, assigned,
+		start.Add(2*time.Minute))
+	assert.Empty(t, paused)
+
+	// A commit starts the frozen period over.
+	moved := lag(0, 50)
+	moved.ConsumerOffset = 45
+	paused = detector.Observe([]PartitionLag{moved}, assigned,
+		start.Add(3*time.Minute))
+	assert.Empty(t, paused)
+}
@@ -0,0 +1,226 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PrometheusReporter : Defines a Reporter serving the lags of the last cycle
+// as a kqm_consumer_lag gauge on /metrics, to be scraped by Prometheus.
+// When buckets are configured, the lags of every cycle are also observed
+// into the kqm_consumer_lag_messages histogram of their group and topic.
+// The static tags are added as labels of every series.
+type PrometheusReporter struct {
+	mutex      sync.RWMutex
+	lags       []PartitionLag
+	buckets    []int64
+	tags       []string
+	histograms map[groupTopic]*lagHistogram
+	listener   net.Listener
+	server     *http.Server
+}
+
+type groupTopic struct {
+	group, topic string
+}
+
+// Cumulative observations of a histogram. The counts are per bucket, the
+// last one counting the lags above the highest bound.
+type lagHistogram struct {
+	counts []uint64
+	sum    int64
+	count  uint64
+}
+
+func (h *lagHistogram) observe(buckets []int64, lag int64) {
+	i := sort.Search(len(buckets), func(i int) bool { return lag <= buckets[i] })
+	h.counts[i]++
+	h.sum += lag
+	h.count++
+}
+
+// ParseBuckets : Parses a comma separated list of histogram bucket bounds,
+// which must be in increasing order.
+func ParseBuckets(value string) ([]int64, error) {
+	var buckets []int64
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		bound, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid histogram bucket: %s", item)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("Histogram buckets must be in increasing "+
+				"order: %s", value)
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// NewPrometheusReporter : Returns a PrometheusReporter serving the metrics
+// on the configured address. The listener is opened before returning, so
+// that an address already in use is reported at startup.
+func NewPrometheusReporter(cfg PrometheusConfig) (*PrometheusReporter, error) {
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error while listening for Prometheus. "+
+			"Details: %s", err)
+	}
+	r := &PrometheusReporter{
+		buckets:    cfg.Buckets,
+		tags:       cfg.Tags,
+		histograms: make(map[groupTopic]*lagHistogram),
+		listener:   listener,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", r.metricsHandler)
+	r.server = &http.Server{Handler: mux}
+	go func() {
+		log.Infoln("Serving Prometheus metrics on", listener.Addr())
+		err := r.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorln("Error while serving Prometheus metrics:", err)
+		}
+	}()
+	return r, nil
+}
+
+// Report : Replaces the lags served with the lags of the cycle, and
+// observes them into the histograms when buckets are configured.
+func (r *PrometheusReporter) Report(timestamp time.Time, lags []PartitionLag) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lags = lags
+	if len(r.buckets) == 0 {
+		return nil
+	}
+	for _, lag := range lags {
+		key := groupTopic{lag.Group, lag.Topic}
+		h, ok := r.histograms[key]
+		if !ok {
+			h = &lagHistogram{counts: make([]uint64, len(r.buckets)+1)}
+			r.histograms[key] = h
+		}
+		h.observe(r.buckets, lag.Lag)
+	}
+	return nil
+}
+
+// RemoveGroup : Drops the histograms of the group, so that the series of
+// the groups evicted from the Offset Store are no longer served.
+func (r *PrometheusReporter) RemoveGroup(group string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key := range r.histograms {
+		if key.group == group {
+			delete(r.histograms, key)
+		}
+	}
+}
+
+// Close : Shuts the HTTP server down.
+func (r *PrometheusReporter) Close() error {
+	err := r.server.Close()
+	// The server only closes the listener once it has started serving.
+	r.listener.Close()
+	return err
+}
+
+func (r *PrometheusReporter) metricsHandler(w http.ResponseWriter,
+	req *http.Request) {
+	r.mutex.RLock()
+	body := FormatPrometheus(r.lags, r.tags)
+	if len(r.buckets) > 0 {
+		body = append(body, r.formatHistograms()...)
+	}
+	r.mutex.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(body)
+}
+
+// FormatPrometheus : Formats the lags as a kqm_consumer_lag gauge vector in
+// the Prometheus text exposition format, with the key=value tags as labels.
+func FormatPrometheus(lags []PartitionLag, tags []string) []byte {
+	var buf bytes.Buffer
+	tagLabels := prometheusTagLabels(tags)
+	buf.WriteString("# HELP kqm_consumer_lag Lag of the consumer group in messages.\n")
+	buf.WriteString("# TYPE kqm_consumer_lag gauge\n")
+	for _, lag := range lags {
+		fmt.Fprintf(&buf, "kqm_consumer_lag{group=\"%s\",topic=\"%s\","+
+			"partition=\"%d\"%s} %d\n", escapeLabel(lag.Group),
+			escapeLabel(lag.Topic), lag.Partition, tagLabels, lag.Lag)
+	}
+	return buf.Bytes()
+}
+
+// Formats the key=value tags as labels to append to the ones of a series.
+// The characters not allowed in a label name are replaced with underscores.
+func prometheusTagLabels(tags []string) string {
+	var buf bytes.Buffer
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fmt.Fprintf(&buf, ",%s=\"%s\"", prometheusLabelName(parts[0]),
+			escapeLabel(parts[1]))
+	}
+	return buf.String()
+}
+
+func prometheusLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Formats the histograms in the Prometheus text exposition format, with
+// cumulative bucket counts as Prometheus expects.
+func (r *PrometheusReporter) formatHistograms() []byte {
+	keys := make([]groupTopic, 0, len(r.histograms))
+	for key := range r.histograms {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].topic < keys[j].topic
+	})
+	tagLabels := prometheusTagLabels(r.tags)
+	var buf bytes.Buffer
+	buf.WriteString("# HELP kqm_consumer_lag_messages Lags of the consumer group observed in every cycle.\n")
+	buf.WriteString("# TYPE kqm_consumer_lag_messages histogram\n")
+	for _, key := range keys {
+		h := r.histograms[key]
+		labels := fmt.Sprintf("group=\"%s\",topic=\"%s\"%s",
+			escapeLabel(key.group), escapeLabel(key.topic), tagLabels)
+		var cumulative uint64
+		for i, bound := range r.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&buf, "kqm_consumer_lag_messages_bucket{%s,le=\"%d\"} %d\n",
+				labels, bound, cumulative)
+		}
+		fmt.Fprintf(&buf, "kqm_consumer_lag_messages_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, h.count)
+		fmt.Fprintf(&buf, "kqm_consumer_lag_messages_sum{%s} %d\n", labels, h.sum)
+		fmt.Fprintf(&buf, "kqm_consumer_lag_messages_count{%s} %d\n", labels, h.count)
+	}
+	return buf.Bytes()
+}
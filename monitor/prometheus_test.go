@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusReporter(t *testing.T) {
+	reporter, err := NewPrometheusReporter(PrometheusConfig{Addr: "127.0.0.1:0"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reporter.Close()
+
+	reporter.Report(time.Now(), []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: `g"2`, Topic: "t1", Partition: 1, Lag: 0},
+	})
+	resp, err := http.Get("http://" + reporter.listener.Addr().String() +
+		"/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "# HELP kqm_consumer_lag Lag of the consumer group in messages.\n"+
+		"# TYPE kqm_consumer_lag gauge\n"+
+		"kqm_consumer_lag{group=\"g1\",topic=\"t1\",partition=\"0\"} 5\n"+
+		"kqm_consumer_lag{group=\"g\\\"2\",topic=\"t1\",partition=\"1\"} 0\n",
+		string(body))
+}
+
+func TestPrometheusReporterHistogram(t *testing.T) {
+	reporter, err := NewPrometheusReporter(PrometheusConfig{
+		Addr:    "127.0.0.1:0",
+		Buckets: []int64{10, 100},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reporter.Close()
+
+	reporter.Report(time.Now(), []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: "g1", Topic: "t1", Partition: 1, Lag: 10},
+	})
+	reporter.Report(time.Now(), []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 50},
+		{Group: "g1", Topic: "t1", Partition: 1, Lag: 500},
+	})
+	resp, err := http.Get("http://" + reporter.listener.Addr().String() +
+		"/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "# HELP kqm_consumer_lag Lag of the consumer group in messages.\n"+
+		"# TYPE kqm_consumer_lag gauge\n"+
+		"kqm_consumer_lag{group=\"g1\",topic=\"t1\",partition=\"0\"} 50\n"+
+		"kqm_consumer_lag{group=\"g1\",topic=\"t1\",partition=\"1\"} 500\n"+
+		"# HELP kqm_consumer_lag_messages Lags of the consumer group observed in every cycle.\n"+
+		"# TYPE kqm_consumer_lag_messages histogram\n"+
+		"kqm_consumer_lag_messages_bucket{group=\"g1\",topic=\"t1\",le=\"10\"} 2\n"+
+		"kqm_consumer_lag_messages_bucket{group=\"g1\",topic=\"t1\",le=\"100\"} 3\n"+
+		"kqm_consumer_lag_messages_bucket{group=\"g1\",topic=\"t1\",le=\"+Inf\"} 4\n"+
+		"kqm_consumer_lag_messages_sum{group=\"g1\",topic=\"t1\"} 565\n"+
+		"kqm_consumer_lag_messages_count{group=\"g1\",topic=\"t1\"} 4\n",
+		string(body))
+}
+
+func TestPrometheusReporterTags(t *testing.T) {
+	lags := []PartitionLag{{Group: "g1", Topic: "t1", Partition: 0, Lag: 5}}
+	assert.Equal(t, "# HELP kqm_consumer_lag Lag of the consumer group in messages.\n"+
+		"# TYPE kqm_consumer_lag gauge\n"+
+		"kqm_consumer_lag{group=\"g1\",topic=\"t1\",partition=\"0\","+
+		"region=\"us-east\",aws_zone=\"a\"} 5\n",
+		string(FormatPrometheus(lags, []string{"region=us-east", "aws.zone=a"})))
+
+	reporter := &PrometheusReporter{
+		buckets:    []int64{10},
+		tags:       []string{"region=us-east"},
+		histograms: make(map[groupTopic]*lagHistogram),
+	}
+	reporter.Report(time.Now(), lags)
+	assert.Contains(t, string(reporter.formatHistograms()),
+		"kqm_consumer_lag_messages_count{group=\"g1\",topic=\"t1\","+
+			"region=\"us-east\"} 1\n")
+}
+
+func TestParseBuckets(t *testing.T) {
+	buckets, err := ParseBuckets("10, 100,1000")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{10, 100, 1000}, buckets)
+
+	buckets, err = ParseBuckets("")
+	assert.NoError(t, err)
+	assert.Empty(t, buckets)
+
+	_, err = ParseBuckets("100,10")
+	assert.Error(t, err)
+	_, err = ParseBuckets("10,x")
+	assert.Error(t, err)
+}
+
+func TestPrometheusReporterRemoveGroup(t *testing.T) {
+	reporter := &PrometheusReporter{
+		buckets:    []int64{10},
+		histograms: make(map[groupTopic]*lagHistogram),
+	}
+	reporter.Report(time.Now(), []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: "g2", Topic: "t1", Partition: 0, Lag: 5},
+	})
+	qm, _ := newTestMonitor(&QMConfig{})
+	qm.Reporters = []Reporter{reporter}
+	for partition := int32(0); partition < 2; partition++ {
+		qm.storeConsumerOffset(&PartitionOffset{Topic: "t1",
+			Partition: partition, Group: "g1", Offset: 10})
+	}
+
+	// The histograms are kept while the group has offsets left.
+	qm.removeConsumerGroup(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "g1"})
+	assert.Len(t, reporter.histograms, 2)
+	qm.removeConsumerGroup(&PartitionOffset{Topic: "t1", Partition: 1,
+		Group: "g1"})
+	assert.Len(t, reporter.histograms, 1)
+	assert.Contains(t, reporter.histograms, groupTopic{"g2", "t1"})
+}
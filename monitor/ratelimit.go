@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/quipo/statsd"
+	log "github.com/sirupsen/logrus"
+)
+
+type queuedGauge struct {
+	stat       string
+	value      int64
+	sampleRate float32
+}
+
+// RateLimitedStatsdClient : Statsd client queueing the gauges in a buffered
+// channel, from which a single goroutine sends them to the wrapped client at
+// a limited rate. The queue holds the gauges that can be sent within a
+// cycle interval, and the gauges are dropped while it is full, the number
+// dropped being logged once per interval. All the other stats are sent by
+// the wrapped client as is.
+type RateLimitedStatsdClient struct {
+	statsd.Statsd
+	interval time.Duration
+	logEvery time.Duration
+	queue    chan queuedGauge
+	dropped  int64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewRateLimitedStatsdClient : Returns a RateLimitedStatsdClient sending at
+// most rate gauges per second to the client, and queueing at most the
+// gauges sent at that rate within the cycle interval.
+func NewRateLimitedStatsdClient(client statsd.Statsd, rate int,
+	cycleInterval time.Duration) *RateLimitedStatsdClient {
+	interval := time.Second / time.Duration(rate)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	if cycleInterval <= 0 {
+		cycleInterval = DefaultInterval
+	}
+	size := int(int64(rate) * int64(cycleInterval) / int64(time.Second))
+	if size < 1 {
+		size = 1
+	}
+	c := &RateLimitedStatsdClient{
+		Statsd:   client,
+		interval: interval,
+		logEvery: cycleInterval,
+		queue:    make(chan queuedGauge, size),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Gauge : Queues the gauge, dropping it if the queue is full.
+func (c *RateLimitedStatsdClient) Gauge(stat string, value int64) error {
+	return c.GaugeWithSampling(stat, value, 1)
+}
+
+// GaugeWithSampling : Queues the gauge along with its sample rate, which is
+// passed on to the wrapped client if it supports sampling. The gauge is
+// dropped if the queue is full.
+func (c *RateLimitedStatsdClient) GaugeWithSampling(stat string, value int64,
+	sampleRate float32) error {
+	select {
+	case c.queue <- queuedGauge{stat, value, sampleRate}:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+	return nil
+}
+
+// Close : Sends the gauges still queued, without limiting their rate, and
+// closes the wrapped client.
+func (c *RateLimitedStatsdClient) Close() error {
+	close(c.stop)
+	<-c.done
+	return c.Statsd.Close()
+}
+
+// Sends the queued gauges, waiting for the interval between them, and logs
+// the number of gauges dropped since the previous log.
+func (c *RateLimitedStatsdClient) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	logTicker := time.NewTicker(c.logEvery)
+	defer logTicker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			c.drain()
+			return
+		case <-logTicker.C:
+			c.logDropped()
+			continue
+		case gauge := <-c.queue:
+			c.send(gauge)
+		}
+		select {
+		case <-c.stop:
+			c.drain()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends the gauges left in the queue.
+func (c *RateLimitedStatsdClient) drain() {
+	for {
+		select {
+		case gauge := <-c.queue:
+			c.send(gauge)
+		default:
+			c.logDropped()
+			return
+		}
+	}
+}
+
+func (c *RateLimitedStatsdClient) send(gauge queuedGauge) {
+	err := sendSampledGauge(c.Statsd, gauge.stat, gauge.value,
+		gauge.sampleRate)
+	if err != nil {
+		log.Errorln("Error while sending gauge to statsd:", err)
+	}
+}
+
+func (c *RateLimitedStatsdClient) logDropped() {
+	if dropped := atomic.SwapInt64(&c.dropped, 0); dropped > 0 {
+		log.Warningf("Statsd queue full, dropped %d gauges", dropped)
+	}
+}
@@ -0,0 +1,43 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Records the commit timestamp of a group, keeping the latest one. All the
+// commits of a group are on the same Offset Topic partition, so a group's
+// timestamp is only updated by a single consumer.
+func (qm *QueueMonitor) storeCommitTimestamp(group string, timestamp int64) {
+	if !TimestampKnown(timestamp) {
+		return
+	}
+	if tmp, ok := qm.CommitTimestamps.Load(group); ok && tmp.(int64) >= timestamp {
+		return
+	}
+	qm.CommitTimestamps.Store(group, timestamp)
+}
+
+// emitRetentionRisk : Sends the time left before the committed offsets of
+// each group expire, i.e. the offsets retention minus the time since the
+// group's last commit. A warning is logged for groups with less than a tenth
+// of the retention left, as their offsets are about to be deleted.
+func (qm *QueueMonitor) emitRetentionRisk(now time.Time) {
+	retention := qm.Config.OffsetsRetention
+	qm.CommitTimestamps.Range(func(groupI, timestampI interface{}) bool {
+		group := groupI.(string)
+		age, ok := TimestampAge(timestampI.(int64), now)
+		if !ok {
+			return true
+		}
+		risk := retention - age
+		if risk < retention/10 {
+			log.Warningf("Offsets of group %s expire in %s.", group, risk)
+		}
+		stat := fmt.Sprintf(".group.%s.retention_risk_seconds", group)
+		qm.sendGaugeToStatsd(stat, int64(risk.Seconds()))
+		return true
+	})
+}
@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rollup : Maps the consumer groups matching the pattern to a rollup name,
+// obtained by expanding the template with the submatches of the pattern,
+// e.g. "^(svc-orders)-[a-z]+$" and "$1" map svc-orders-a to svc-orders.
+type Rollup struct {
+	Pattern  *regexp.Regexp
+	Template string
+}
+
+// ParseRollups : Parses rollups of the form regex=template. The last "=" is
+// the separator, so that the regex can contain one.
+func ParseRollups(values []string) ([]Rollup, error) {
+	var rollups []Rollup
+	for _, value := range values {
+		index := strings.LastIndex(value, "=")
+		if index <= 0 || index == len(value)-1 {
+			return nil, fmt.Errorf("Invalid group rollup: %s. Expected "+
+				"regex=template", value)
+		}
+		pattern, err := regexp.Compile(value[:index])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex in group rollup %s. "+
+				"Details: %s", value, err)
+		}
+		rollups = append(rollups, Rollup{pattern, value[index+1:]})
+	}
+	return rollups, nil
+}
+
+// Returns the rollup name of the group from the first rollup matching it,
+// and false if none matches.
+func rollupName(rollups []Rollup, group string) (string, bool) {
+	for _, rollup := range rollups {
+		match := rollup.Pattern.FindStringSubmatchIndex(group)
+		if match != nil {
+			name := rollup.Pattern.ExpandString(nil, rollup.Template, group,
+				match)
+			return string(name), true
+		}
+	}
+	return "", false
+}
+
+// Reports whether only the rollup gauges are sent for the group, and not its
+// own gauges.
+func (qm *QueueMonitor) rolledUp(group string) bool {
+	if !qm.Config.RollupOnly {
+		return false
+	}
+	_, ok := rollupName(qm.Config.Rollups, group)
+	return ok
+}
+
+// Sends the total lag of each rollup, summing the lags of all the groups
+// mapped to it.
+func (qm *QueueMonitor) sendRollups(lags []PartitionLag) {
+	totals := make(map[string]int64)
+	for _, lag := range lags {
+		name, ok := rollupName(qm.Config.Rollups, lag.Group)
+		if ok {
+			totals[name] += nonNegative(lag.Lag)
+		}
+	}
+	names := make([]string, 0, len(totals))
+	for name := range totals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		qm.sendGaugeToStatsd(fmt.Sprintf(".rollup.%s.total", name),
+			totals[name])
+	}
+}
@@ -0,0 +1,62 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRollups(t *testing.T) {
+	rollups, err := ParseRollups([]string{"^(svc-[a-z]+)-[a-z]+$=$1",
+		"^legacy-=legacy"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	name, ok := rollupName(rollups, "svc-orders-b")
+	assert.True(t, ok)
+	assert.Equal(t, "svc-orders", name)
+	name, ok = rollupName(rollups, "legacy-billing")
+	assert.True(t, ok)
+	assert.Equal(t, "legacy", name)
+	_, ok = rollupName(rollups, "billing")
+	assert.False(t, ok)
+
+	for _, value := range []string{"svc-orders", "=name", "svc=", "(svc=x"} {
+		_, err = ParseRollups([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSendLagsRollups(t *testing.T) {
+	rollups, _ := ParseRollups([]string{"^(svc-orders)-[a-z]+$=$1"})
+	lags := []PartitionLag{
+		{Group: "billing", Topic: "t1", Partition: 0, Lag: 4},
+		{Group: "svc-orders-a", Topic: "t1", Partition: 0, Lag: 3},
+		{Group: "svc-orders-a", Topic: "t1", Partition: 1, Lag: -1},
+		{Group: "svc-orders-b", Topic: "t1", Partition: 0, Lag: 5},
+		{Group: "svc-orders-c", Topic: "t2", Partition: 0, Lag: 2},
+	}
+	cfg := &QMConfig{
+		StatsdCfg:   StatsdConfig{Prefix: "kqm"},
+		Granularity: map[string]bool{GroupGranularity: true},
+		Rollups:     rollups,
+	}
+
+	qm, recorder := newTestMonitor(cfg)
+	qm.sendLags(lags)
+	assert.Equal(t, []string{
+		"kqm.group.billing.total=4",
+		"kqm.group.svc-orders-a.total=3",
+		"kqm.group.svc-orders-b.total=5",
+		"kqm.group.svc-orders-c.total=2",
+		"kqm.rollup.svc-orders.total=10",
+	}, recorder.gauges)
+
+	cfg.RollupOnly = true
+	qm, recorder = newTestMonitor(cfg)
+	qm.sendLags(lags)
+	assert.Equal(t, []string{
+		"kqm.group.billing.total=4",
+		"kqm.rollup.svc-orders.total=10",
+	}, recorder.gauges)
+}
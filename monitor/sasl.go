@@ -0,0 +1,15 @@
+package monitor
+
+import (
+	"fmt"
+)
+
+// ValidateSASL : Checks that the user and password of the SASL/PLAIN
+// authentication are present when SASL is enabled.
+func ValidateSASL(cfg *KafkaConfig) error {
+	if cfg.SASLEnabled && (cfg.SASLUser == "" || cfg.SASLPassword == "") {
+		return fmt.Errorf("SASL is enabled, please specify the SASL " +
+			"user and password")
+	}
+	return nil
+}
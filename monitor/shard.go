@@ -0,0 +1,52 @@
+package monitor
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OwnsPartition : Checks whether an Offset Topic partition is consumed by
+// this instance. With sharding, a partition belongs to the shard whose index
+// equals the partition number modulo the shard count, which keeps the
+// assignment stable across restarts.
+func (cfg *KafkaConfig) OwnsPartition(partition int32) bool {
+	if cfg.ShardCount <= 1 {
+		return true
+	}
+	return int(partition)%cfg.ShardCount == cfg.ShardIndex
+}
+
+// ShardPartitions : Returns the Offset Topic partitions owned by this instance.
+func (cfg *KafkaConfig) ShardPartitions(partitions []int32) []int32 {
+	owned := []int32{}
+	for _, partition := range partitions {
+		if cfg.OwnsPartition(partition) {
+			owned = append(owned, partition)
+		}
+	}
+	return owned
+}
+
+// Checks the shard configuration against the number of Offset Topic
+// partitions, failing if there are more shards than partitions, and logs
+// the partitions owned by this instance.
+func (qm *QueueMonitor) validateShards() error {
+	cfg := &qm.Config.KafkaCfg
+	if cfg.ShardCount <= 1 {
+		return nil
+	}
+	client, release := qm.acquireClient()
+	defer release()
+	partitions, err := client.Partitions(ConsumerOffsetTopic)
+	if err != nil {
+		return err
+	}
+	if cfg.ShardCount > len(partitions) {
+		return fmt.Errorf("Shard count %d exceeds the %d partitions of %s",
+			cfg.ShardCount, len(partitions), ConsumerOffsetTopic)
+	}
+	log.Infof("Shard %d of %d owns %s partitions: %v", cfg.ShardIndex,
+		cfg.ShardCount, ConsumerOffsetTopic, cfg.ShardPartitions(partitions))
+	return nil
+}
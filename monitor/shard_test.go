@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardPartitions(t *testing.T) {
+	partitions := []int32{0, 1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		index, count int
+		expected     []int32
+	}{
+		{0, 1, partitions},
+		{0, 0, partitions},
+		{0, 2, []int32{0, 2, 4, 6}},
+		{1, 2, []int32{1, 3, 5}},
+		{2, 3, []int32{2, 5}},
+	}
+	for _, test := range tests {
+		cfg := &KafkaConfig{ShardIndex: test.index, ShardCount: test.count}
+		assert.Equal(t, test.expected, cfg.ShardPartitions(partitions))
+	}
+
+	// Every partition is owned by exactly one of the shards.
+	for _, partition := range partitions {
+		owners := 0
+		for index := 0; index < 3; index++ {
+			cfg := &KafkaConfig{ShardIndex: index, ShardCount: 3}
+			if cfg.OwnsPartition(partition) {
+				owners++
+			}
+		}
+		assert.Equal(t, 1, owners, "partition %d", partition)
+	}
+}
@@ -0,0 +1,49 @@
+package monitor
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// LagSmoother : Applies an exponentially weighted moving average to the lag
+// of every partition across cycles. A smaller Alpha damps spikes more, at
+// the cost of the smoothed lag trailing the actual lag by a few cycles.
+type LagSmoother struct {
+	Alpha  float64
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewLagSmoother : Returns a LagSmoother with the specified smoothing factor,
+// which must be in the range (0, 1].
+func NewLagSmoother(alpha float64) *LagSmoother {
+	return &LagSmoother{
+		Alpha:  alpha,
+		values: make(map[string]float64),
+	}
+}
+
+// Smooth : Returns the smoothed lag for each of the lags of a cycle. The
+// first lag seen for a partition is used as is. State of partitions no
+// longer present in the lags is dropped.
+func (s *LagSmoother) Smooth(lags []PartitionLag) []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	smoothed := make([]int64, len(lags))
+	values := make(map[string]float64)
+	for index, lag := range lags {
+		key := fmt.Sprintf("%s/%s/%d", lag.Group, lag.Topic, lag.Partition)
+		value, ok := s.values[key]
+		if ok {
+			value = s.Alpha*float64(lag.Lag) + (1-s.Alpha)*value
+		} else {
+			value = float64(lag.Lag)
+		}
+		values[key] = value
+		smoothed[index] = int64(math.Round(value))
+	}
+	s.values = values
+	return smoothed
+}
@@ -0,0 +1,26 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLagSmoother(t *testing.T) {
+	smoother := NewLagSmoother(0.5)
+	lag := func(partition int32, value int64) PartitionLag {
+		return PartitionLag{Group: "g1", Topic: "t1", Partition: partition,
+			Lag: value}
+	}
+
+	// The first lags are used as is.
+	assert.Equal(t, []int64{100, -3},
+		smoother.Smooth([]PartitionLag{lag(0, 100), lag(1, -3)}))
+	// The averages are rounded half away from zero: 51 and -2.5.
+	assert.Equal(t, []int64{51, -3},
+		smoother.Smooth([]PartitionLag{lag(0, 2), lag(1, -2)}))
+	// The partition missing from a cycle starts over.
+	smoother.Smooth([]PartitionLag{lag(0, 2)})
+	assert.Equal(t, []int64{7},
+		smoother.Smooth([]PartitionLag{lag(1, 7)}))
+}
@@ -0,0 +1,40 @@
+package monitor
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identifies the committed offset of a group at a partition.
+type groupPartition struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// Records the time the offset of a group at a partition was last stored.
+func (qm *QueueMonitor) touchConsumerOffset(p *PartitionOffset, now time.Time) {
+	qm.LastSeen.Store(groupPartition{p.Group, p.Topic, p.Partition}, now)
+}
+
+// evictStaleGroups : Removes the offsets of the groups at the partitions
+// they haven't committed to for longer than the StaleTimeout from the Offset
+// Store, so that no lag or retention risk is reported for groups that were
+// deleted.
+func (qm *QueueMonitor) evictStaleGroups(now time.Time) {
+	qm.LastSeen.Range(func(keyI, seenI interface{}) bool {
+		key := keyI.(groupPartition)
+		if now.Sub(seenI.(time.Time)) <= qm.Config.StaleTimeout {
+			return true
+		}
+		log.Infof("Evicting stale group: %s topic: %s partition: %d",
+			key.group, key.topic, key.partition)
+		qm.removeConsumerGroup(&PartitionOffset{
+			Group:     key.group,
+			Topic:     key.topic,
+			Partition: key.partition,
+		})
+		return true
+	})
+}
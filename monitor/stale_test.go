@@ -0,0 +1,76 @@
+package monitor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvictStaleGroups(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{StaleTimeout: 10 * time.Minute})
+
+	start := time.Now()
+	deleted := &PartitionOffset{Topic: "t1", Partition: 0, Group: "deleted"}
+	active := &PartitionOffset{Topic: "t1", Partition: 0, Group: "active"}
+	qm.storeConsumerOffset(deleted)
+	qm.storeConsumerOffset(active)
+	qm.touchConsumerOffset(deleted, start)
+	qm.touchConsumerOffset(active, start)
+
+	qm.evictStaleGroups(start.Add(5 * time.Minute))
+	_, ok := qm.loadConsumerOffset("t1", 0, "deleted")
+	assert.True(t, ok)
+
+	qm.touchConsumerOffset(active, start.Add(8*time.Minute))
+	qm.evictStaleGroups(start.Add(11 * time.Minute))
+	_, ok = qm.loadConsumerOffset("t1", 0, "deleted")
+	assert.False(t, ok)
+	_, ok = qm.loadConsumerOffset("t1", 0, "active")
+	assert.True(t, ok)
+
+	lags, err := qm.lag("t1", 0, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, lags, 1) {
+		assert.Equal(t, "active", lags[0].Group)
+	}
+}
+
+func TestEvictStaleGroupsState(t *testing.T) {
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:        StatsdConfig{Prefix: "kqm"},
+		StaleTimeout:     10 * time.Minute,
+		OffsetsRetention: 24 * time.Hour,
+	})
+	// The commit timestamps are in milliseconds.
+	start := time.Now().Truncate(time.Millisecond)
+	for partition := int32(0); partition < 2; partition++ {
+		offset := &PartitionOffset{Topic: "t1", Partition: partition,
+			Group: "deleted", Offset: 10,
+			Timestamp: start.UnixNano() / int64(time.Millisecond)}
+		qm.storeConsumerOffset(offset)
+		qm.touchConsumerOffset(offset, start)
+	}
+	qm.Coordinators.Store("deleted", int32(1))
+
+	// A tombstone removes the offset along with its last seen time, and the
+	// group state is kept while it has offsets left.
+	qm.removeConsumerGroup(&PartitionOffset{Topic: "t1", Partition: 0,
+		Group: "deleted"})
+	_, ok := qm.LastSeen.Load(groupPartition{"deleted", "t1", 0})
+	assert.False(t, ok)
+	_, ok = qm.Coordinators.Load("deleted")
+	assert.True(t, ok)
+
+	// Once evicted, the retention risk of the group is still sent.
+	qm.evictStaleGroups(start.Add(11 * time.Minute))
+	_, ok = qm.LastSeen.Load(groupPartition{"deleted", "t1", 1})
+	assert.False(t, ok)
+	_, ok = qm.Coordinators.Load("deleted")
+	assert.False(t, ok)
+	qm.emitRetentionRisk(start.Add(11 * time.Minute))
+	assert.Equal(t, []string{fmt.Sprintf(
+		"kqm.group.deleted.retention_risk_seconds=%d",
+		int64((24*time.Hour - 11*time.Minute).Seconds()))}, recorder.gauges)
+}
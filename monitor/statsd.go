@@ -0,0 +1,273 @@
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/quipo/statsd"
+)
+
+// TaggedStatsdClient : Statsd client sending the gauges with DogStatsD tags
+// appended, along with the tags carried by the name of the gauge. All the
+// other stats are sent by the embedded client as is.
+type TaggedStatsdClient struct {
+	*statsd.StatsdClient
+	addr   string
+	prefix string
+	tags   string
+	conn   net.Conn
+}
+
+// NewTaggedStatsdClient : Returns a TaggedStatsdClient for the Statsd address
+// and prefix, attaching the "key=value" tags to every gauge.
+func NewTaggedStatsdClient(addr, prefix string, tags []string) *TaggedStatsdClient {
+	return &TaggedStatsdClient{
+		StatsdClient: statsd.NewStatsdClient(addr, prefix),
+		addr:         addr,
+		prefix:       prefix,
+		tags:         dogStatsdTags(tags),
+	}
+}
+
+// Converts the "key=value" tags to the DogStatsD "key:value" tags, joined
+// with commas.
+func dogStatsdTags(tags []string) string {
+	dogTags := make([]string, len(tags))
+	for index, tag := range tags {
+		dogTags[index] = strings.Replace(tag, "=", ":", 1)
+	}
+	return strings.Join(dogTags, ",")
+}
+
+// CreateSocket : Creates the UDP sockets for the gauges and the other stats.
+func (c *TaggedStatsdClient) CreateSocket() error {
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return c.StatsdClient.CreateSocket()
+}
+
+// Close : Closes the UDP sockets.
+func (c *TaggedStatsdClient) Close() error {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	return c.StatsdClient.Close()
+}
+
+// Gauge : Sends a gauge with the tags attached.
+func (c *TaggedStatsdClient) Gauge(stat string, value int64) error {
+	return c.GaugeWithSampling(stat, value, 1)
+}
+
+// GaugeWithSampling : Sends a gauge with the tags attached, only once every
+// 1/sampleRate calls on average, with the sample rate in the line.
+func (c *TaggedStatsdClient) GaugeWithSampling(stat string, value int64,
+	sampleRate float32) error {
+	if c.conn == nil {
+		return fmt.Errorf("Cannot send gauge, not connected to Statsd")
+	}
+	if sampleRate < 1 && rand.Float32() >= sampleRate {
+		return nil
+	}
+	_, err := fmt.Fprint(c.conn, sampledGaugeLine(c.prefix+stat, value,
+		sampleRate, c.tags))
+	return err
+}
+
+// Renders the gauge in the Statsd line format, with the tags carried by its
+// name and the static tags attached in the DogStatsD format.
+func gaugeLine(stat string, value int64, staticTags string) string {
+	return sampledGaugeLine(stat, value, 1, staticTags)
+}
+
+// Renders the gauge like gaugeLine, with the sample rate ahead of the tags
+// when it is below 1. Statsd reads a signed gauge value as a delta, so a
+// negative gauge is preceded by a line resetting it to 0, as the quipo client
+// does.
+func sampledGaugeLine(stat string, value int64, sampleRate float32,
+	staticTags string) string {
+	name, tags := splitStatTags(stat)
+	if staticTags != "" {
+		if tags != "" {
+			tags += ","
+		}
+		tags += staticTags
+	}
+	suffix := ""
+	if sampleRate < 1 {
+		suffix += fmt.Sprintf("|@%g", sampleRate)
+	}
+	if tags != "" {
+		suffix += "|#" + tags
+	}
+	line := fmt.Sprintf("%s:%d|g%s", name, value, suffix)
+	if value < 0 {
+		line = fmt.Sprintf("%s:0|g%s\n%s", name, suffix, line)
+	}
+	return line
+}
+
+// Separates the DogStatsD tags carried by the name of a gauge.
+const statTagsSeparator = "|#"
+
+// Returns the name of a gauge and the tags it carries, if any.
+func splitStatTags(stat string) (string, string) {
+	index := strings.Index(stat, statTagsSeparator)
+	if index < 0 {
+		return stat, ""
+	}
+	return stat[:index], stat[index+len(statTagsSeparator):]
+}
+
+// DogStatsdStat : Returns the name of a gauge carrying the DogStatsD tags,
+// given as "key:value".
+func DogStatsdStat(name string, tags ...string) string {
+	return name + statTagsSeparator + strings.Join(tags, ",")
+}
+
+// DryRunStatsdClient : Statsd client printing the gauges instead of sending
+// them, used in dry runs. It doesn't open any socket.
+type DryRunStatsdClient struct {
+	statsd.NoopClient
+	out io.Writer
+}
+
+// NewDryRunStatsdClient : Returns a DryRunStatsdClient printing to out.
+func NewDryRunStatsdClient(out io.Writer) *DryRunStatsdClient {
+	return &DryRunStatsdClient{out: out}
+}
+
+// Gauge : Prints the gauge in the Statsd line format.
+func (c *DryRunStatsdClient) Gauge(stat string, value int64) error {
+	_, err := fmt.Fprintln(c.out, gaugeLine(stat, value, ""))
+	return err
+}
+
+// GaugeWithSampling : Prints the gauge with the sample rate. Every gauge is
+// printed, so that a dry run shows all the gauges that may be sent.
+func (c *DryRunStatsdClient) GaugeWithSampling(stat string, value int64,
+	sampleRate float32) error {
+	_, err := fmt.Fprintln(c.out, sampledGaugeLine(stat, value, sampleRate, ""))
+	return err
+}
+
+// Incr : Prints the counter in the Statsd line format.
+func (c *DryRunStatsdClient) Incr(stat string, count int64) error {
+	_, err := fmt.Fprintf(c.out, "%s:%d|c\n", stat, count)
+	return err
+}
+
+// Creates a connected Statsd client for each of the configured addresses.
+// The names of the gauges sent are expected to include the prefix. The rate
+// limited clients queue the gauges they can send within the interval. When
+// a socket can't be created, the clients created before are closed.
+func newStatsdClients(cfg StatsdConfig, interval time.Duration) (
+	[]statsd.Statsd, error) {
+	var clients []statsd.Statsd
+	for _, addr := range cfg.Addrs {
+		var client statsd.Statsd
+		if cfg.FlushInterval > 0 {
+			client = NewBufferedStatsdClient(addr, cfg.Tags, cfg.FlushInterval)
+		} else if len(cfg.Tags) > 0 || cfg.Format == DogStatsdFormat {
+			client = NewTaggedStatsdClient(addr, "", cfg.Tags)
+		} else {
+			client = statsd.NewStatsdClient(addr, "")
+		}
+		err := client.CreateSocket()
+		if err != nil {
+			for _, created := range clients {
+				created.Close()
+			}
+			return nil, err
+		}
+		if cfg.Rate > 0 {
+			client = NewRateLimitedStatsdClient(client, cfg.Rate, interval)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// ValidateStatsdBuffer : Checks that the gauges can be buffered with the
+// Statsd configuration. The rate of the gauges can't be limited, nor the
+// gauges sampled, once they are sent in batches.
+func ValidateStatsdBuffer(cfg StatsdConfig) error {
+	if cfg.FlushInterval > 0 && cfg.Rate > 0 {
+		return fmt.Errorf("Statsd flush interval can't be combined with a " +
+			"Statsd rate")
+	}
+	if cfg.FlushInterval > 0 && cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		return fmt.Errorf("Statsd flush interval can't be combined with a " +
+			"Statsd sample rate")
+	}
+	return nil
+}
+
+// Returns the rate the per partition gauges are sampled at, which defaults
+// to 1.
+func (cfg StatsdConfig) sampleRate() float32 {
+	if cfg.SampleRate > 0 {
+		return cfg.SampleRate
+	}
+	return 1
+}
+
+// ValidateTags : Checks that every tag is of the form "key=value".
+func ValidateTags(tags []string) error {
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid tag, expected key=value: %s", tag)
+		}
+	}
+	return nil
+}
+
+// ValidateStatsdFormat : Checks that the format of the per partition metrics
+// is known.
+func ValidateStatsdFormat(format string) error {
+	if format != StatsdFormat && format != DogStatsdFormat {
+		return fmt.Errorf("Unknown statsd format: %s", format)
+	}
+	return nil
+}
+
+// DefaultMetricTemplate : Template of the names of the partition metrics
+// used when none is configured.
+const DefaultMetricTemplate = "{prefix}.group.{group}.{topic}.{partition}"
+
+var placeholderPattern = regexp.MustCompile(`\{[^}]*\}`)
+
+// ValidateMetricTemplate : Checks that the metric template only uses the
+// {prefix}, {group}, {topic} and {partition} placeholders.
+func ValidateMetricTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		switch placeholder {
+		case "{prefix}", "{group}", "{topic}", "{partition}":
+		default:
+			return fmt.Errorf("Unknown placeholder in metric template: %s",
+				placeholder)
+		}
+	}
+	return nil
+}
+
+// RenderMetricTemplate : Renders the name of a partition metric by replacing
+// the placeholders of the template with the values passed as argument.
+func RenderMetricTemplate(template, prefix, group, topic string,
+	partition int32) string {
+	return strings.NewReplacer(
+		"{prefix}", prefix,
+		"{group}", group,
+		"{topic}", topic,
+		"{partition}", fmt.Sprint(partition),
+	).Replace(template)
+}
@@ -0,0 +1,335 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMetricTemplate(t *testing.T) {
+	tests := []struct {
+		template, expected string
+	}{
+		{DefaultMetricTemplate, "kqm.group.billing.orders.3"},
+		{"{prefix}.consumer_lag.{topic}.{partition}.{group}",
+			"kqm.consumer_lag.orders.3.billing"},
+		{"lag.{group}", "lag.billing"},
+	}
+	for _, test := range tests {
+		assert.NoError(t, ValidateMetricTemplate(test.template))
+		assert.Equal(t, test.expected, RenderMetricTemplate(test.template,
+			"kqm", "billing", "orders", 3))
+	}
+	assert.Error(t, ValidateMetricTemplate("{prefix}.{cluster}.{group}"))
+}
+
+func TestSendLagsMetricTemplate(t *testing.T) {
+	granularity, err := ParseGranularity("partition,group")
+	assert.NoError(t, err)
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{
+			Prefix:         "kqm",
+			MetricTemplate: "{prefix}.lag.{topic}.{partition}.{group}",
+		},
+		Granularity: granularity,
+	})
+	qm.sendLags([]PartitionLag{
+		{Group: "billing", Topic: "orders", Partition: 3, Lag: 7},
+	})
+	assert.Equal(t, []string{
+		"kqm.lag.orders.3.billing=7",
+		"kqm.group.billing.total=7",
+	}, recorder.gauges)
+}
+
+func TestSendGaugeFanOut(t *testing.T) {
+	var addrs []string
+	var listeners []net.PacketConn
+	for i := 0; i < 2; i++ {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		addrs = append(addrs, listener.LocalAddr().String())
+	}
+
+	cfg := StatsdConfig{Addrs: addrs, Prefix: "kqm"}
+	clients, err := newStatsdClients(cfg, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	qm, _ := newTestMonitor(&QMConfig{StatsdCfg: cfg})
+	qm.StatsdClients = []StatsdEmitter{clients[0], clients[1]}
+	defer clients[0].Close()
+	defer clients[1].Close()
+	qm.sendGaugeToStatsd(".cluster.health_score", 100)
+
+	buf := make([]byte, 512)
+	for _, listener := range listeners {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "kqm.cluster.health_score:100|g", string(buf[:n]))
+	}
+}
+
+func TestSendLagsStatsdFormats(t *testing.T) {
+	granularity, err := ParseGranularity("partition")
+	assert.NoError(t, err)
+	tests := []struct {
+		format   string
+		tags     []string
+		expected string
+	}{
+		{StatsdFormat, nil, "kqm.group.billing.orders.3:7|g"},
+		{DogStatsdFormat, nil,
+			"kqm.consumer.lag:7|g|#group:billing,topic:orders,partition:3"},
+		{DogStatsdFormat, []string{"env=prod"}, "kqm.consumer.lag:7|g|" +
+			"#group:billing,topic:orders,partition:3,env:prod"},
+	}
+	for _, test := range tests {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer listener.Close()
+		cfg := StatsdConfig{
+			Addrs:  []string{listener.LocalAddr().String()},
+			Prefix: "kqm",
+			Tags:   test.tags,
+			Format: test.format,
+		}
+		clients, err := newStatsdClients(cfg, time.Minute)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer clients[0].Close()
+		qm, _ := newTestMonitor(&QMConfig{StatsdCfg: cfg,
+			Granularity: granularity})
+		qm.StatsdClients = []StatsdEmitter{clients[0]}
+		qm.sendLags([]PartitionLag{
+			{Group: "billing", Topic: "orders", Partition: 3, Lag: 7},
+		})
+
+		buf := make([]byte, 512)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		assert.NoError(t, err, test.format)
+		assert.Equal(t, test.expected, string(buf[:n]), test.format)
+	}
+	assert.Error(t, ValidateStatsdFormat("influx"))
+}
+
+func TestDogStatsdSuffixes(t *testing.T) {
+	qm, _ := newTestMonitor(&QMConfig{
+		StatsdCfg: StatsdConfig{Prefix: "kqm", Format: DogStatsdFormat},
+	})
+	var buf bytes.Buffer
+	qm.StatsdClients = []StatsdEmitter{NewDryRunStatsdClient(&buf)}
+	qm.sendGauge(qm.partitionStat("g1", "t1", 0, ".lag_seconds"), 12)
+	qm.sendGaugeToStatsd(".group.g1.total", 5)
+	assert.Equal(t, "kqm.consumer.lag_seconds:12|g|"+
+		"#group:g1,topic:t1,partition:0\nkqm.group.g1.total:5|g\n",
+		buf.String())
+}
+
+func TestSampledGaugeLine(t *testing.T) {
+	assert.Equal(t, "kqm.lag:5|g|@0.5|#group:g1,env:prod",
+		sampledGaugeLine(DogStatsdStat("kqm.lag", "group:g1"), 5, 0.5,
+			"env:prod"))
+	assert.Equal(t, "kqm.lag:5|g", sampledGaugeLine("kqm.lag", 5, 1, ""))
+}
+
+func TestSampledGaugeLineNegative(t *testing.T) {
+	// A negative gauge is reset to 0 first, since Statsd would otherwise
+	// subtract it from the previous value.
+	assert.Equal(t, "kqm.lag:0|g|@0.5|#group:g1\nkqm.lag:-3|g|@0.5|#group:g1",
+		sampledGaugeLine(DogStatsdStat("kqm.lag", "group:g1"), -3, 0.5, ""))
+	assert.Equal(t, "kqm.lag:0|g\nkqm.lag:-3|g",
+		gaugeLine("kqm.lag", -3, ""))
+	assert.Equal(t, "kqm.lag:0|g", gaugeLine("kqm.lag", 0, ""))
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	client := NewBufferedStatsdClient(listener.LocalAddr().String(), nil,
+		time.Hour)
+	if !assert.NoError(t, client.CreateSocket()) {
+		return
+	}
+	client.Gauge("kqm.lag", -3)
+	assert.NoError(t, client.Close())
+	buf := make([]byte, 512)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "kqm.lag:0|g\nkqm.lag:-3|g", string(buf[:n]))
+}
+
+func TestStatsdBuffer(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	read := func() string {
+		buf := make([]byte, 512)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		assert.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	cfg := StatsdConfig{
+		Addrs:         []string{listener.LocalAddr().String()},
+		Prefix:        "kqm",
+		FlushInterval: 50 * time.Millisecond,
+	}
+	clients, err := newStatsdClients(cfg, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	qm, _ := newTestMonitor(&QMConfig{StatsdCfg: cfg})
+	qm.StatsdClients = []StatsdEmitter{clients[0]}
+
+	// The gauges of an interval are sent in a single batch, with the last
+	// value of each gauge.
+	start := time.Now()
+	qm.sendGaugeToStatsd(".group.g1.total", 5)
+	qm.sendGaugeToStatsd(".group.g1.total", 7)
+	qm.sendGaugeToStatsd(".cluster.health_score", 100)
+	batch := strings.Split(read(), "\n")
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+	sort.Strings(batch)
+	assert.Equal(t, []string{"kqm.cluster.health_score:100|g",
+		"kqm.group.g1.total:7|g"}, batch)
+
+	// The gauges still buffered are sent on close.
+	qm.sendGaugeToStatsd(".group.g1.total", 9)
+	assert.NoError(t, clients[0].Close())
+	assert.Equal(t, "kqm.group.g1.total:9|g", read())
+
+	assert.NoError(t, ValidateStatsdBuffer(cfg))
+	cfg.Rate = 10
+	assert.Error(t, ValidateStatsdBuffer(cfg))
+}
+
+func TestBufferedStatsdClientPayloadSize(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	client := NewBufferedStatsdClient(listener.LocalAddr().String(),
+		[]string{"env=prod"}, time.Hour)
+	if !assert.NoError(t, client.CreateSocket()) {
+		return
+	}
+
+	// The 40 gauges of about 40 bytes don't fit in a single packet.
+	for i := 0; i < 40; i++ {
+		client.Gauge(DogStatsdStat(fmt.Sprintf("kqm.consumer.lag.%02d", i),
+			"group:g1"), int64(i))
+	}
+	assert.NoError(t, client.Close())
+	var lines []string
+	buf := make([]byte, 4096)
+	for len(lines) < 40 {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, n <= 512, "%d bytes", n)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	assert.Len(t, lines, 40)
+	assert.Equal(t, "kqm.consumer.lag.00:0|g|#group:g1,env:prod", lines[0])
+	assert.Equal(t, "kqm.consumer.lag.39:39|g|#group:g1,env:prod", lines[39])
+}
+
+func TestDryRun(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	qm, err := NewQueueMonitor(&QMConfig{
+		KafkaCfg: KafkaConfig{
+			Brokers:      []string{broker.Addr()},
+			OffsetFormat: BurrowOffsetFormat,
+		},
+		// Creating a socket for this address would fail.
+		StatsdCfg: StatsdConfig{Addrs: []string{"statsd.invalid:8125"}},
+		DryRun:    true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer qm.Close()
+	if assert.Len(t, qm.StatsdClients, 1) {
+		assert.IsType(t, &DryRunStatsdClient{}, qm.StatsdClients[0])
+	}
+
+	var buf bytes.Buffer
+	qm.StatsdClients = []StatsdEmitter{NewDryRunStatsdClient(&buf)}
+	qm.sendGaugeToStatsd(".group.g1.total", 5)
+	qm.sendCountToStatsd(".kqm.negative_lag.g1.t1", 2)
+	assert.Equal(t, ".group.g1.total:5|g\n.kqm.negative_lag.g1.t1:2|c\n",
+		buf.String())
+}
+
+func TestRateLimitedStatsdClient(t *testing.T) {
+	recorder := &recordingStatsd{}
+	client := NewRateLimitedStatsdClient(recorder, 100, time.Minute)
+	for i := 0; i < 30; i++ {
+		assert.NoError(t, client.Gauge(fmt.Sprintf("stat%d", i), int64(i)))
+	}
+	sent := func() int {
+		recorder.mutex.Lock()
+		defer recorder.mutex.Unlock()
+		return len(recorder.gauges)
+	}
+
+	// At 100 gauges per second, at most 11 gauges are sent in the first
+	// 100 milliseconds, and all of them within half a second.
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, sent() <= 11, "%d gauges sent", sent())
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 30, sent())
+	assert.Equal(t, "stat0=0", recorder.gauges[0])
+	assert.Equal(t, "stat29=29", recorder.gauges[29])
+	assert.NoError(t, client.Close())
+}
+
+func TestRateLimitedStatsdClientQueueFull(t *testing.T) {
+	recorder := &recordingStatsd{}
+	// At 1 gauge per second, the queue holds the 10 gauges sent within the
+	// 10 second interval.
+	client := NewRateLimitedStatsdClient(recorder, 1, 10*time.Second)
+	for i := 0; i < 15; i++ {
+		assert.NoError(t, client.Gauge(fmt.Sprintf("stat%d", i), int64(i)))
+	}
+	// The first gauge may already be taken off the queue by the sender.
+	dropped := atomic.LoadInt64(&client.dropped)
+	assert.True(t, dropped == 4 || dropped == 5, "%d gauges dropped", dropped)
+
+	// The queued gauges are sent on Close.
+	assert.NoError(t, client.Close())
+	assert.Len(t, recorder.gauges, 15-int(dropped))
+	assert.Equal(t, "stat0=0", recorder.gauges[0])
+}
@@ -0,0 +1,141 @@
+package monitor
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quipo/statsd"
+	log "github.com/sirupsen/logrus"
+)
+
+// BufferedStatsdClient : Statsd client buffering the gauges, and sending
+// them in batches every flush interval, packed into as few UDP packets as
+// statsd.UDPPayloadSize allows. A gauge sent several times within an
+// interval is only sent with its last value. The buffered gauges are sent
+// once more when the client is closed. All the other stats are sent by the
+// embedded client as is.
+type BufferedStatsdClient struct {
+	*statsd.StatsdClient
+	addr     string
+	tags     string
+	interval time.Duration
+	conn     net.Conn
+
+	mutex  sync.Mutex
+	gauges map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBufferedStatsdClient : Returns a BufferedStatsdClient for the Statsd
+// address, attaching the "key=value" tags to every gauge.
+func NewBufferedStatsdClient(addr string, tags []string,
+	interval time.Duration) *BufferedStatsdClient {
+	return &BufferedStatsdClient{
+		StatsdClient: statsd.NewStatsdClient(addr, ""),
+		addr:         addr,
+		tags:         dogStatsdTags(tags),
+		interval:     interval,
+		gauges:       make(map[string]int64),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// CreateSocket : Creates the UDP sockets for the gauges and the other stats,
+// and starts sending the buffered gauges every flush interval.
+func (c *BufferedStatsdClient) CreateSocket() error {
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	go c.run()
+	return c.StatsdClient.CreateSocket()
+}
+
+// Gauge : Buffers the gauge until the next flush.
+func (c *BufferedStatsdClient) Gauge(stat string, value int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gauges[stat] = value
+	return nil
+}
+
+// GaugeWithSampling : Buffers the gauge unsampled, since the sample rate
+// of a gauge is lost once its last value is kept.
+func (c *BufferedStatsdClient) GaugeWithSampling(stat string, value int64,
+	sampleRate float32) error {
+	return c.Gauge(stat, value)
+}
+
+// Close : Sends the buffered gauges and closes the UDP sockets.
+func (c *BufferedStatsdClient) Close() error {
+	if c.conn != nil {
+		close(c.stop)
+		<-c.done
+		c.conn.Close()
+	}
+	return c.StatsdClient.Close()
+}
+
+// Sends the buffered gauges every flush interval, and once more when the
+// client is closed.
+func (c *BufferedStatsdClient) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			c.flush()
+			return
+		case <-ticker.C:
+			c.flush()
+		}
+	}
+}
+
+// Sends the buffered gauges, sorted by name, with a line per gauge. The
+// gauges of a batch that fails to be sent are dropped.
+func (c *BufferedStatsdClient) flush() {
+	c.mutex.Lock()
+	gauges := c.gauges
+	c.gauges = make(map[string]int64)
+	c.mutex.Unlock()
+	if len(gauges) == 0 {
+		return
+	}
+	stats := make([]string, 0, len(gauges))
+	for stat := range gauges {
+		stats = append(stats, stat)
+	}
+	sort.Strings(stats)
+
+	var payload bytes.Buffer
+	for _, stat := range stats {
+		line := gaugeLine(stat, gauges[stat], c.tags)
+		if payload.Len() > 0 &&
+			payload.Len()+1+len(line) > statsd.UDPPayloadSize {
+			c.write(payload.Bytes())
+			payload.Reset()
+		}
+		if payload.Len() > 0 {
+			payload.WriteByte('\n')
+		}
+		payload.WriteString(line)
+	}
+	c.write(payload.Bytes())
+}
+
+// Sends a UDP packet of gauges.
+func (c *BufferedStatsdClient) write(payload []byte) {
+	_, err := c.conn.Write(payload)
+	if err != nil {
+		log.Errorln("Error while sending gauges to statsd:", err)
+	}
+}
@@ -0,0 +1,175 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Status : Tracks the state of the subsystems of the QueueMonitor, which is
+// reported by the status endpoint.
+type Status struct {
+	mutex            sync.RWMutex
+	consumersRunning int
+	consumerLag      map[int32]int64
+	lastCycle        time.Time
+	cycleDuration    time.Duration
+	partitions       int
+	fetched          int
+	cycleErr         error
+	reporterErrors   map[string]error
+}
+
+// NewStatus : Returns an empty Status.
+func NewStatus() *Status {
+	return &Status{
+		consumerLag:    make(map[int32]int64),
+		reporterErrors: make(map[string]error),
+	}
+}
+
+// StatusReport : Defines the composite view of the subsystems of the
+// QueueMonitor returned by the status endpoint.
+type StatusReport struct {
+	Healthy         bool                  `json:"healthy"`
+	Kafka           KafkaStatus           `json:"kafka"`
+	OffsetsConsumer OffsetsConsumerStatus `json:"offsets_consumer"`
+	BrokerOffsets   BrokerOffsetsStatus   `json:"broker_offsets"`
+	Reporters       []ReporterStatus      `json:"reporters"`
+}
+
+// KafkaStatus : Status of the Kafka client.
+type KafkaStatus struct {
+	Connected bool `json:"connected"`
+	Brokers   int  `json:"brokers"`
+}
+
+// OffsetsConsumerStatus : Status of the Offset Topic consumer. Lag is the
+// number of messages on the Offset Topic yet to be consumed by KQM.
+type OffsetsConsumerStatus struct {
+	Running    bool  `json:"running"`
+	Partitions int   `json:"partitions"`
+	Lag        int64 `json:"lag"`
+}
+
+// BrokerOffsetsStatus : Status of the last broker offsets cycle. Coverage
+// is the fraction of the monitored partitions a broker offset was fetched for.
+type BrokerOffsetsStatus struct {
+	LastCycle     time.Time `json:"last_cycle"`
+	CycleDuration float64   `json:"cycle_duration_seconds"`
+	Partitions    int       `json:"partitions"`
+	Coverage      float64   `json:"coverage"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// ReporterStatus : Status of a reporter, with the last error it returned.
+type ReporterStatus struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Records that a consumer of an Offset Topic partition started or stopped.
+func (s *Status) consumerRunning(partition int32, running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if running {
+		s.consumersRunning++
+	} else {
+		s.consumersRunning--
+		delete(s.consumerLag, partition)
+	}
+}
+
+// Records the lag of KQM at an Offset Topic partition.
+func (s *Status) setConsumerLag(partition int32, lag int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.consumerLag[partition] = lag
+}
+
+// Records the completion of a broker offsets cycle.
+func (s *Status) cycleCompleted(start time.Time, partitions, fetched int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastCycle = time.Now()
+	s.cycleDuration = s.lastCycle.Sub(start)
+	s.partitions, s.fetched = partitions, fetched
+}
+
+// Records the error of the last cycle, nil if it succeeded.
+func (s *Status) cycleFinished(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cycleErr = err
+}
+
+// Returns the error of the last cycle.
+func (s *Status) lastCycleError() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cycleErr
+}
+
+// Records the result of the last call to a reporter.
+func (s *Status) reported(name string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reporterErrors[name] = err
+}
+
+// Report : Builds the StatusReport of the QueueMonitor. It is healthy when
+// the Kafka client is connected, the consumer offsets are being read, the
+// last broker offsets cycle completed within three intervals and none of
+// the reporters are failing.
+func (qm *QueueMonitor) Report(now time.Time) *StatusReport {
+	client, release := qm.acquireClient()
+	defer release()
+	s := qm.Status
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	report := &StatusReport{}
+	report.Kafka.Brokers = len(client.Brokers())
+	report.Kafka.Connected = !client.Closed() && report.Kafka.Brokers > 0
+
+	report.OffsetsConsumer.Running = s.consumersRunning > 0
+	report.OffsetsConsumer.Partitions = s.consumersRunning
+	for _, lag := range s.consumerLag {
+		report.OffsetsConsumer.Lag += lag
+	}
+
+	report.BrokerOffsets.LastCycle = s.lastCycle
+	report.BrokerOffsets.CycleDuration = s.cycleDuration.Seconds()
+	report.BrokerOffsets.Partitions = s.partitions
+	report.BrokerOffsets.Coverage = 1
+	if s.partitions > 0 {
+		report.BrokerOffsets.Coverage = float64(s.fetched) / float64(s.partitions)
+	}
+	if s.cycleErr != nil {
+		report.BrokerOffsets.LastError = s.cycleErr.Error()
+	}
+
+	reportersOK := true
+	for name, err := range s.reporterErrors {
+		status := ReporterStatus{Name: name, OK: err == nil}
+		if err != nil {
+			status.Error = err.Error()
+			reportersOK = false
+		}
+		report.Reporters = append(report.Reporters, status)
+	}
+
+	consumerOK := report.OffsetsConsumer.Running ||
+		qm.Config.KafkaCfg.OffsetSource == AdminOffsetSource
+	cycleOK := !s.lastCycle.IsZero() &&
+		now.Sub(s.lastCycle) < 3*qm.Config.Interval
+	report.Healthy = report.Kafka.Connected && consumerOK && cycleOK &&
+		reportersOK
+	return report
+}
+
+// Returns the name of a reporter used in the status.
+func reporterName(reporter Reporter) string {
+	return fmt.Sprintf("%T", reporter)
+}
@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Levels of the lag sent in the level gauges.
+const (
+	OKLevel   = 0
+	WarnLevel = 1
+	CritLevel = 2
+)
+
+// Threshold : Defines the lags from which a partition is at the warn and
+// crit levels.
+type Threshold struct {
+	Warn int64
+	Crit int64
+}
+
+// Thresholds : Defines the lag thresholds of the topics, with a default for
+// the topics without one.
+type Thresholds struct {
+	Default *Threshold
+	Topics  map[string]Threshold
+}
+
+// ParseThresholds : Parses thresholds of the form topic:warn:crit, or
+// warn:crit for the default threshold.
+func ParseThresholds(values []string) (*Thresholds, error) {
+	thresholds := &Thresholds{Topics: make(map[string]Threshold)}
+	for _, value := range values {
+		parts := strings.Split(value, ":")
+		var topic string
+		switch len(parts) {
+		case 2:
+		case 3:
+			topic, parts = parts[0], parts[1:]
+		default:
+			return nil, fmt.Errorf("Invalid lag threshold: %s. Expected "+
+				"topic:warn:crit or warn:crit", value)
+		}
+		warn, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid warn lag in threshold %s. "+
+				"Details: %s", value, err)
+		}
+		crit, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid crit lag in threshold %s. "+
+				"Details: %s", value, err)
+		}
+		if warn < 0 || crit < warn {
+			return nil, fmt.Errorf("Invalid lag threshold: %s. The warn lag "+
+				"can't be negative or above the crit lag", value)
+		}
+		threshold := Threshold{Warn: warn, Crit: crit}
+		if topic == "" {
+			thresholds.Default = &threshold
+		} else {
+			thresholds.Topics[topic] = threshold
+		}
+	}
+	return thresholds, nil
+}
+
+// Level : Returns the level of the lag at a partition of the topic, and
+// false if the topic has no threshold.
+func (t *Thresholds) Level(topic string, lag int64) (int64, bool) {
+	threshold, ok := t.Topics[topic]
+	if !ok {
+		if t.Default == nil {
+			return OKLevel, false
+		}
+		threshold = *t.Default
+	}
+	switch {
+	case lag >= threshold.Crit:
+		return CritLevel, true
+	case lag >= threshold.Warn:
+		return WarnLevel, true
+	}
+	return OKLevel, true
+}
+
+// Sends the level of the lag of each group at each partition with a
+// threshold, logging the partitions at the crit level.
+func (qm *QueueMonitor) sendLevels(lags []PartitionLag) {
+	for _, lag := range lags {
+		level, ok := qm.Config.Thresholds.Level(lag.Topic, lag.Lag)
+		if !ok {
+			continue
+		}
+		if level == CritLevel {
+			log.Warningf("Critical lag of %d for group: %s topic: %s "+
+				"partition: %d", lag.Lag, lag.Group, lag.Topic, lag.Partition)
+		}
+		qm.sendGauge(qm.partitionStat(lag.Group, lag.Topic, lag.Partition,
+			".level"), level)
+	}
+}
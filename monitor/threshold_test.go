@@ -0,0 +1,70 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThresholdsLevel(t *testing.T) {
+	thresholds, err := ParseThresholds([]string{"1000:10000",
+		"orders:100:1000"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tests := []struct {
+		topic    string
+		lag      int64
+		expected int64
+	}{
+		{"orders", 0, OKLevel},
+		{"orders", 99, OKLevel},
+		{"orders", 100, WarnLevel},
+		{"orders", 999, WarnLevel},
+		{"orders", 1000, CritLevel},
+		{"payments", 999, OKLevel},
+		{"payments", 1000, WarnLevel},
+		{"payments", 9999, WarnLevel},
+		{"payments", 10000, CritLevel},
+	}
+	for _, test := range tests {
+		level, ok := thresholds.Level(test.topic, test.lag)
+		assert.True(t, ok)
+		assert.Equal(t, test.expected, level, "%s: %d", test.topic, test.lag)
+	}
+
+	thresholds, err = ParseThresholds([]string{"orders:100:1000"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, ok := thresholds.Level("payments", 5000)
+	assert.False(t, ok)
+}
+
+func TestParseThresholdsInvalid(t *testing.T) {
+	for _, value := range []string{"100", "a:b:c:d", "orders:x:10",
+		"orders:10:x", "orders:100:10", "-1:10"} {
+		_, err := ParseThresholds([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSendLevels(t *testing.T) {
+	thresholds, err := ParseThresholds([]string{"orders:100:1000"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:  StatsdConfig{Prefix: "kqm"},
+		Thresholds: thresholds,
+	})
+	qm.sendLevels([]PartitionLag{
+		{Group: "g1", Topic: "orders", Partition: 0, Lag: 100},
+		{Group: "g1", Topic: "orders", Partition: 1, Lag: 1000},
+		{Group: "g1", Topic: "payments", Partition: 0, Lag: 5000},
+	})
+	assert.Equal(t, []string{
+		"kqm.group.g1.orders.0.level=1",
+		"kqm.group.g1.orders.1.level=2",
+	}, recorder.gauges)
+}
@@ -0,0 +1,182 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum size of the message set fetched to read the timestamp of a
+// message.
+const timeLagFetchBytes = 64 * 1024
+
+// TimeLag : Returns how far behind the latest message the consumed message
+// is, from their Kafka timestamps (in milliseconds), and false if either
+// timestamp is unknown. Timestamps set by producers can go backwards, so the
+// time lag is clamped to zero.
+func TimeLag(latest, consumed int64) (time.Duration, bool) {
+	if !TimestampKnown(latest) || !TimestampKnown(consumed) {
+		return 0, false
+	}
+	if consumed >= latest {
+		return 0, true
+	}
+	return time.Duration(latest-consumed) * time.Millisecond, true
+}
+
+// Identifies the message at an offset of a partition.
+type messageKey struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+// sendTimeLags : Sends the time lag of each group at each partition, i.e.
+// the difference between the timestamps of the latest message and of the
+// message at the committed offset. Both are fetched from the leader broker,
+// once per message, as the timestamps are cached for the next cycles.
+func (qm *QueueMonitor) sendTimeLags(lags []PartitionLag) {
+	var keys []messageKey
+	for _, lag := range lags {
+		if lag.Lag > 0 {
+			keys = append(keys,
+				messageKey{lag.Topic, lag.Partition, lag.BrokerOffset - 1},
+				messageKey{lag.Topic, lag.Partition, lag.ConsumerOffset})
+		}
+	}
+	timestamps := qm.messageTimestamps(keys)
+	for _, lag := range lags {
+		stat := qm.partitionStat(lag.Group, lag.Topic, lag.Partition,
+			".lag_seconds")
+		if lag.Lag <= 0 {
+			qm.sendGauge(stat, 0)
+			continue
+		}
+		latestTimestamp, ok := timestamps[messageKey{lag.Topic, lag.Partition,
+			lag.BrokerOffset - 1}]
+		if !ok {
+			continue
+		}
+		consumedTimestamp, ok := timestamps[messageKey{lag.Topic,
+			lag.Partition, lag.ConsumerOffset}]
+		if !ok {
+			continue
+		}
+
+		timeLag, ok := TimeLag(latestTimestamp, consumedTimestamp)
+		if !ok {
+			log.Debugf("Unknown message timestamp for topic: %s partition: %d",
+				lag.Topic, lag.Partition)
+			continue
+		}
+		qm.sendGauge(stat, int64(timeLag.Seconds()))
+	}
+}
+
+// Returns the timestamps of the messages, from the cache or fetched by a
+// pool of at most MaxBrokerConcurrency workers. The messages whose timestamp
+// couldn't be fetched are left out. The timestamps of the messages not asked
+// for anymore are dropped from the cache.
+func (qm *QueueMonitor) messageTimestamps(keys []messageKey) map[messageKey]int64 {
+	timestamps := make(map[messageKey]int64, len(keys))
+	var missing []messageKey
+	for _, key := range keys {
+		if _, ok := timestamps[key]; ok {
+			continue
+		}
+		if timestamp, ok := qm.timestamps.Load(key); ok {
+			timestamps[key] = timestamp.(int64)
+			continue
+		}
+		timestamps[key] = UnknownTimestamp
+		missing = append(missing, key)
+	}
+	qm.timestamps.Range(func(key, _ interface{}) bool {
+		if _, ok := timestamps[key.(messageKey)]; !ok {
+			qm.timestamps.Delete(key)
+		}
+		return true
+	})
+
+	workers := qm.Config.MaxBrokerConcurrency
+	if workers <= 0 || workers > len(missing) {
+		workers = len(missing)
+	}
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	queue := make(chan messageKey)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				timestamp, err := qm.messageTimestamp(key.topic, key.partition,
+					key.offset)
+				mutex.Lock()
+				if err != nil {
+					log.Warningf("Error while fetching message timestamp of "+
+						"topic: %s partition: %d offset: %d: %s", key.topic,
+						key.partition, key.offset, err)
+					delete(timestamps, key)
+				} else {
+					timestamps[key] = timestamp
+				}
+				mutex.Unlock()
+				if err == nil && TimestampKnown(timestamp) {
+					qm.timestamps.Store(key, timestamp)
+				}
+			}
+		}()
+	}
+	for _, key := range missing {
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+	return timestamps
+}
+
+// Fetches the Kafka timestamp (in milliseconds) of the message at the offset
+// from the leader of the partition. UnknownTimestamp is returned when the
+// message has no timestamp or is no longer available.
+func (qm *QueueMonitor) messageTimestamp(topic string, partition int32,
+	offset int64) (int64, error) {
+	client, release := qm.acquireClient()
+	defer release()
+	broker, err := client.Leader(topic, partition)
+	if err != nil {
+		return UnknownTimestamp, err
+	}
+	// Version 2 of the fetch request returns messages with timestamps.
+	request := &sarama.FetchRequest{Version: 2, MaxWaitTime: 500, MinBytes: 1}
+	request.AddBlock(topic, partition, offset, timeLagFetchBytes)
+	response, err := broker.Fetch(request)
+	if err != nil {
+		return UnknownTimestamp, err
+	}
+	block := response.GetBlock(topic, partition)
+	if block == nil {
+		return UnknownTimestamp, fmt.Errorf("No fetch response block for "+
+			"topic: %s partition: %d", topic, partition)
+	}
+	if block.Err != sarama.ErrNoError {
+		return UnknownTimestamp, block.Err
+	}
+	for _, messageBlock := range block.MsgSet.Messages {
+		for _, message := range messageBlock.Messages() {
+			if message.Offset < offset {
+				continue
+			}
+			if message.Msg.Timestamp.IsZero() {
+				return UnknownTimestamp, nil
+			}
+			return message.Msg.Timestamp.UnixNano() / int64(time.Millisecond), nil
+		}
+	}
+	return UnknownTimestamp, nil
+}
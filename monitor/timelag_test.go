@@ -0,0 +1,78 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeLag(t *testing.T) {
+	tests := []struct {
+		latest, consumed int64
+		expected         time.Duration
+		known            bool
+	}{
+		{1500000090000, 1500000000000, 90 * time.Second, true},
+		{1500000000000, 1500000000000, 0, true},
+		{1500000000000, 1500000005000, 0, true},
+		{1500000000500, 1500000000000, 500 * time.Millisecond, true},
+		{UnknownTimestamp, 1500000000000, 0, false},
+		{1500000000000, UnknownTimestamp, 0, false},
+		{1500000000000, 0, 0, false},
+	}
+	for _, test := range tests {
+		timeLag, known := TimeLag(test.latest, test.consumed)
+		assert.Equal(t, test.known, known)
+		assert.Equal(t, test.expected, timeLag)
+	}
+}
+
+func TestSendTimeLagsCache(t *testing.T) {
+	// Messages of the partition with a timestamp of a second per offset.
+	messages := &sarama.FetchResponse{Version: 2}
+	for offset := int64(0); offset < 100; offset++ {
+		messages.AddMessage("t1", 0, nil, sarama.StringEncoder("m"), offset)
+	}
+	for _, block := range messages.Blocks["t1"][0].MsgSet.Messages {
+		block.Msg.Version = 1
+		block.Msg.Timestamp = time.Unix(1500000000+block.Offset, 0)
+	}
+	leader, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"FetchRequest": sarama.NewMockWrapper(messages),
+	})
+
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+		Granularity:          map[string]bool{PartitionGranularity: true},
+		MaxBrokerConcurrency: 2,
+	})
+	qm.Client = &leaderClient{cached: broker, current: broker}
+	lags := []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, BrokerOffset: 100,
+			ConsumerOffset: 40, Lag: 60},
+		{Group: "g2", Topic: "t1", Partition: 0, BrokerOffset: 100,
+			ConsumerOffset: 90, Lag: 10},
+	}
+	qm.sendTimeLags(lags)
+	assert.Equal(t, []string{
+		"kqm.group.g1.t1.0.lag_seconds=59",
+		"kqm.group.g2.t1.0.lag_seconds=9",
+	}, recorder.gauges)
+	// The latest message is fetched once for both groups.
+	assert.Len(t, leader.History(), 3)
+
+	// The timestamps are cached, so only the message at the new committed
+	// offset is fetched in the next cycle.
+	recorder.gauges = nil
+	lags[1].ConsumerOffset, lags[1].Lag = 95, 5
+	qm.sendTimeLags(lags)
+	assert.Equal(t, []string{
+		"kqm.group.g1.t1.0.lag_seconds=59",
+		"kqm.group.g2.t1.0.lag_seconds=4",
+	}, recorder.gauges)
+	assert.Len(t, leader.History(), 4)
+	_, ok := qm.timestamps.Load(messageKey{"t1", 0, 90})
+	assert.False(t, ok)
+}
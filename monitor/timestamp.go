@@ -0,0 +1,23 @@
+package monitor
+
+import "time"
+
+// UnknownTimestamp : Timestamp used by Kafka when the time is not known.
+const UnknownTimestamp int64 = -1
+
+// TimestampKnown : Checks whether a Kafka timestamp (in milliseconds) carries
+// an actual time. Both -1 (unknown) and 0 are treated as unknown, since
+// using them for time-based stats would produce ages since the epoch.
+func TimestampKnown(timestamp int64) bool {
+	return timestamp > 0
+}
+
+// TimestampAge : Returns the time elapsed between the Kafka timestamp and
+// now, and false if the timestamp is unknown. Time-based stats should be
+// skipped instead of being sent when the age is unknown.
+func TimestampAge(timestamp int64, now time.Time) (time.Duration, bool) {
+	if !TimestampKnown(timestamp) {
+		return 0, false
+	}
+	return now.Sub(time.Unix(0, timestamp*int64(time.Millisecond))), true
+}
@@ -0,0 +1,27 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimestampKnown(t *testing.T) {
+	assert.False(t, TimestampKnown(UnknownTimestamp))
+	assert.False(t, TimestampKnown(0))
+	assert.True(t, TimestampKnown(1508140800000))
+}
+
+func TestTimestampAge(t *testing.T) {
+	now := time.Unix(1508140860, 0)
+
+	_, ok := TimestampAge(UnknownTimestamp, now)
+	assert.False(t, ok)
+	_, ok = TimestampAge(0, now)
+	assert.False(t, ok)
+
+	age, ok := TimestampAge(1508140800000, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, age)
+}
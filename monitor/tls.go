@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig : Builds the TLS configuration for the connections to the
+// brokers from the CA, certificate and key files of the KafkaConfig. The
+// system roots are used when no CA file is given. The client certificate,
+// presented to the brokers requiring mutual TLS, needs both the certificate
+// and its key.
+func NewTLSConfig(cfg *KafkaConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+	if cfg.TLSCAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error while reading the TLS CA file. "+
+				"Details: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in the TLS CA "+
+				"file: %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, fmt.Errorf("Both the TLS certificate and key files " +
+				"are required for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error while loading the TLS certificate "+
+				"%s with the key %s, which must match. Details: %s",
+				cfg.TLSCertFile, cfg.TLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,72 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Adds all the partitions of the configured Topics to the map, so that their
+// broker offsets are fetched before any group commits to them. The map
+// passed is left untouched.
+func (qm *QueueMonitor) withTopics(
+	tpMap map[string][]int32) map[string][]int32 {
+	client, release := qm.acquireClient()
+	defer release()
+	all := make(map[string][]int32, len(tpMap)+len(qm.Config.Topics))
+	for topic, partitions := range tpMap {
+		all[topic] = partitions
+	}
+	for _, topic := range qm.Config.Topics {
+		topicPartitions, err := client.Partitions(topic)
+		if err != nil {
+			log.Errorf("Error while fetching partitions of topic %s: %s",
+				topic, err)
+			continue
+		}
+		seen := make(map[int32]bool, len(all[topic]))
+		for _, partition := range all[topic] {
+			seen[partition] = true
+		}
+		partitions := append([]int32(nil), all[topic]...)
+		for _, partition := range topicPartitions {
+			if !seen[partition] && qm.partitionAllowed(topic, partition) {
+				partitions = append(partitions, partition)
+			}
+		}
+		all[topic] = partitions
+	}
+	return all
+}
+
+// Sends the number of partitions of each topic of the map, from the cluster
+// metadata, and logs the topics whose partition count changed since the
+// previous cycle. The partitions added to a topic aren't monitored until a
+// group commits to them, unless the topic is one of the configured Topics.
+func (qm *QueueMonitor) sendPartitionCounts(tpMap map[string][]int32) {
+	client, release := qm.acquireClient()
+	defer release()
+	topics := make([]string, 0, len(tpMap))
+	for topic := range tpMap {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			log.Errorf("Error while fetching partitions of topic %s: %s",
+				topic, err)
+			continue
+		}
+		count := len(partitions)
+		previous, ok := qm.partitionCounts.Load(topic)
+		if ok && previous.(int) != count {
+			log.Warningf("Partition count of topic %s changed from %d to %d",
+				topic, previous, count)
+		}
+		qm.partitionCounts.Store(topic, count)
+		qm.sendGaugeToStatsd(fmt.Sprintf(".topic.%s.partition_count", topic),
+			int64(count))
+	}
+}
@@ -0,0 +1,152 @@
+package monitor
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// topicsClient : Kafka client with a single leader for the partitions of the
+// topics it knows.
+type topicsClient struct {
+	leaderClient
+	partitions map[string][]int32
+}
+
+func (c *topicsClient) Partitions(topic string) ([]int32, error) {
+	partitions, ok := c.partitions[topic]
+	if !ok {
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+	return partitions, nil
+}
+
+func TestGetBrokerOffsetsTopics(t *testing.T) {
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetNewest, 200),
+	})
+
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+		Granularity:          map[string]bool{PartitionGranularity: true},
+		MaxBrokerConcurrency: 1,
+		Topics:               []string{"orders", "unknown"},
+	})
+	qm.Client = &topicsClient{
+		leaderClient: leaderClient{cached: broker, current: broker},
+		partitions:   map[string][]int32{"orders": {0, 1}},
+	}
+
+	// No group has committed yet, the broker offsets are sent without lags.
+	assert.NoError(t, qm.GetBrokerOffsets())
+	var offsets []string
+	for _, gauge := range recorder.gauges {
+		if strings.HasPrefix(gauge, "kqm.topic.") {
+			offsets = append(offsets, gauge)
+		}
+	}
+	sort.Strings(offsets)
+	assert.Equal(t, []string{
+		"kqm.topic.orders.0.offset=100",
+		"kqm.topic.orders.1.offset=200",
+	}, offsets)
+	offset, ok := qm.BrokerOffsetStore.Load("orders", 1, time.Now(), time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(200), offset)
+}
+
+func TestGetBrokerOffsetsPartitionCounts(t *testing.T) {
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100),
+	})
+
+	qm, recorder := newTestMonitor(&QMConfig{
+		StatsdCfg:            StatsdConfig{Prefix: "kqm"},
+		MaxBrokerConcurrency: 1,
+		PartitionCounts:      true,
+	})
+	client := &topicsClient{
+		leaderClient: leaderClient{cached: broker, current: broker},
+		partitions:   map[string][]int32{"orders": {0, 1}},
+	}
+	qm.Client = client
+	qm.storeConsumerOffset(&PartitionOffset{Topic: "orders", Partition: 0,
+		Group: "g1", Offset: 90})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	counts := func() []string {
+		var counts []string
+		for _, gauge := range recorder.gauges {
+			if strings.HasPrefix(gauge, "kqm.topic.") &&
+				strings.Contains(gauge, ".partition_count=") {
+				counts = append(counts, gauge)
+			}
+		}
+		recorder.gauges = nil
+		return counts
+	}
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Equal(t, []string{"kqm.topic.orders.partition_count=2"}, counts())
+	assert.NotContains(t, buf.String(), "Partition count")
+
+	// The topic grows between the cycles.
+	client.partitions["orders"] = []int32{0, 1, 2}
+	assert.NoError(t, qm.GetBrokerOffsets())
+	assert.Equal(t, []string{"kqm.topic.orders.partition_count=3"}, counts())
+	assert.Contains(t, buf.String(),
+		"Partition count of topic orders changed from 2 to 3")
+}
+
+// leaderlessClient : Kafka client without a leader for the partitions of
+// some of the topics it knows.
+type leaderlessClient struct {
+	topicsClient
+	leaderless map[string]bool
+}
+
+func (c *leaderlessClient) Leader(topic string, partition int32) (
+	*sarama.Broker, error) {
+	if c.leaderless[topic] {
+		return nil, sarama.ErrLeaderNotAvailable
+	}
+	return c.topicsClient.Leader(topic, partition)
+}
+
+func TestGroupByLeaderNoLeader(t *testing.T) {
+	_, broker := newLeaderBroker(t, map[string]sarama.MockResponse{})
+	qm, _ := newTestMonitor(&QMConfig{})
+	client := &leaderlessClient{
+		topicsClient: topicsClient{
+			leaderClient: leaderClient{cached: broker, current: broker},
+			partitions:   map[string][]int32{"t1": {0, 1}, "orders": {0, 1}},
+		},
+		leaderless: map[string]bool{"orders": true},
+	}
+
+	// Only the partitions the lags are computed for are counted without a
+	// leader, not the ones fetched for --topics or --report-missing.
+	tpMap := map[string][]int32{"t1": {0}, "orders": {1}}
+	fetchMap := map[string][]int32{"t1": {0, 1}, "orders": {0, 1}}
+	requests, partitionCounts, noLeader, err := qm.groupByLeader(client,
+		fetchMap, tpMap)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, noLeader)
+	assert.Len(t, requests, 1)
+	assert.Equal(t, map[int32]int64{broker.ID(): 2}, partitionCounts)
+
+	_, _, noLeader, err = qm.groupByLeader(client, fetchMap, fetchMap)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, noLeader)
+}
@@ -1,20 +1,119 @@
 package monitor
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
-	"github.com/quipo/statsd"
 	"golang.org/x/sync/syncmap"
 )
 
+// Monitor : Defines the interface of a monitor of the consumer lag, which
+// runs until the context passed to Start is done.
+type Monitor interface {
+	Start(ctx context.Context)
+	Close()
+}
+
+var _ Monitor = (*QueueMonitor)(nil)
+
 // QueueMonitor : Defines the type for Kafka Queue Monitor implementation.
 type QueueMonitor struct {
-	Client       sarama.Client
-	StatsdClient *statsd.StatsdClient
-	Config       *QMConfig
-	OffsetStore  *syncmap.Map
+	Client            sarama.Client
+	StatsdClients     []StatsdEmitter
+	Config            *QMConfig
+	CommitTimestamps  *syncmap.Map
+	LastSeen          *syncmap.Map
+	Coordinators      *syncmap.Map
+	BrokerOffsetStore *BrokerOffsetStore
+	LogStartStore     *BrokerOffsetStore
+	OffsetStore       *syncmap.Map
+	Allowlist         *Allowlist
+	Reporters         []Reporter
+	PauseDetector     *PauseDetector
+	LagSmoother       *LagSmoother
+	Status            *Status
+	Parser            OffsetParser
+
+	// Counts of the errors since the previous cycle, sent as internal
+	// metrics.
+	parseErrors    int64
+	brokerErrors   int64
+	consumerErrors int64
+
+	// Guards the Client, which is replaced when it is rebuilt, and its
+	// users, which the replaced Client is closed after.
+	clientMutex sync.Mutex
+	clientUsers *sync.WaitGroup
+
+	// Offset of the next message to consume at each Offset Topic partition.
+	positions syncmap.Map
+
+	// Number of partitions of each topic seen in the previous cycle.
+	partitionCounts syncmap.Map
+
+	// Stats of the missing_commit gauges sent with 1 in the previous cycle.
+	missingCommits syncmap.Map
+
+	// Timestamps of the messages the time lags were computed from.
+	timestamps syncmap.Map
+
+	// Tracks the goroutines of the Offset Topic partition consumers.
+	consumers sync.WaitGroup
+
+	// Set atomically once Start is running, once a consumer offset is
+	// stored, and once a cycle has succeeded after that.
+	running      int32
+	offsetStored int32
+	ready        int32
+}
+
+// StatsdEmitter : Defines the interface of a client the gauges are sent to.
+// Emitters implementing io.Closer are closed along with the QueueMonitor.
+type StatsdEmitter interface {
+	Gauge(stat string, value int64) error
+}
+
+// SampledStatsdEmitter : Defines the interface of an emitter the per
+// partition gauges are sent to with the Statsd sample rate. Emitters not
+// implementing it are sent every gauge.
+type SampledStatsdEmitter interface {
+	GaugeWithSampling(stat string, value int64, sampleRate float32) error
+}
+
+// CountingStatsdEmitter : Defines the interface of an emitter the counters
+// of KQM itself are sent to. Emitters not implementing it aren't sent any
+// counter.
+type CountingStatsdEmitter interface {
+	Incr(stat string, count int64) error
+}
+
+// Reporter : Defines the interface for a sink receiving the lags computed
+// in every cycle. Backends other than Statsd, such as Prometheus or
+// Graphite, are added as Reporters, and are closed along with the
+// QueueMonitor.
+type Reporter interface {
+	Report(timestamp time.Time, lags []PartitionLag) error
+	Close() error
+}
+
+// GroupRemover : Defines the interface of the Reporters keeping state per
+// consumer group, which is dropped once the group has no offsets left.
+type GroupRemover interface {
+	RemoveGroup(group string)
+}
+
+// PartitionLag : Defines a type for the lag of a group at a partition.
+type PartitionLag struct {
+	Group          string `json:"group"`
+	Topic          string `json:"topic"`
+	Partition      int32  `json:"partition"`
+	BrokerOffset   int64  `json:"brokerOffset"`
+	ConsumerOffset int64  `json:"consumerOffset"`
+	Lag            int64  `json:"lag"`
 }
 
 // PartitionOffset : Defines a type for Partition Offset
@@ -33,26 +132,219 @@ func (p *PartitionOffset) String() string {
 		p.DueForRemoval)
 }
 
-// BrokerOffsetRequest : Aggregated type for Broker and OffsetRequest
+// ConsumerOffset : Defines a type for the offset committed by a group at a
+// partition, kept in the Offset Store along with the Kafka timestamp (in
+// milliseconds) of the commit.
+type ConsumerOffset struct {
+	Offset    int64
+	Timestamp int64
+}
+
+// BrokerOffsetRequest : Aggregated type for Broker and OffsetRequest. The
+// log start offsets are requested separately, since a request only holds a
+// block per partition. The requests are sent on Conn when it is set, a
+// connection to the Broker owned by the request rather than by the client.
 type BrokerOffsetRequest struct {
-	Broker        *sarama.Broker
-	OffsetRequest *sarama.OffsetRequest
+	Broker          *sarama.Broker
+	Conn            *sarama.Broker
+	OffsetRequest   *sarama.OffsetRequest
+	LogStartRequest *sarama.OffsetRequest
+	Partitions      map[string][]int32
+}
+
+// Returns the connection the requests are sent on.
+func (r *BrokerOffsetRequest) conn() *sarama.Broker {
+	if r.Conn != nil {
+		return r.Conn
+	}
+	return r.Broker
+}
+
+// AddBlock : Adds a block for the latest offset of the topic and partition
+// to the OffsetRequest, keeping track of the partitions requested.
+func (r *BrokerOffsetRequest) AddBlock(topic string, partition int32) {
+	r.OffsetRequest.AddBlock(topic, partition, sarama.OffsetNewest, 1)
+	if r.Partitions == nil {
+		r.Partitions = make(map[string][]int32)
+	}
+	r.Partitions[topic] = append(r.Partitions[topic], partition)
+}
+
+// AddLogStartBlock : Adds a block for the oldest offset of the topic and
+// partition to the LogStartRequest.
+func (r *BrokerOffsetRequest) AddLogStartBlock(topic string, partition int32) {
+	if r.LogStartRequest == nil {
+		r.LogStartRequest = &sarama.OffsetRequest{}
+	}
+	r.LogStartRequest.AddBlock(topic, partition, sarama.OffsetOldest, 1)
 }
 
 // KafkaConfig : Type for Kafka Broker Configuration.
 type KafkaConfig struct {
-	Brokers []string
+	Brokers        []string
+	ResolveBrokers bool
+	OffsetSource   string
+	OffsetFormat   string
+	OffsetStart    string
+	ClientID       string
+	Version        sarama.KafkaVersion
+	FetchDefault   int32
+	FetchMax       int32
+	MaxWaitTime    time.Duration
+	ReadTimeout    time.Duration
+	ShardIndex     int
+	ShardCount     int
+	SASLEnabled    bool
+	SASLUser       string
+	SASLPassword   string
+	TLSEnabled     bool
+	TLSCAFile      string
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSSkipVerify  bool
+
+	// Interval of the background refresh of the cluster metadata, and the
+	// number of retries of a failed metadata request.
+	MetadataRefresh  time.Duration
+	MetadataRetryMax int
+}
+
+// Positions of the Offset Topic partitions the consumption starts from.
+const (
+	OldestOffsetStart = "oldest"
+	NewestOffsetStart = "newest"
+)
+
+// OffsetStarts : Maps the offset start positions to the sarama offsets.
+var OffsetStarts = map[string]int64{
+	OldestOffsetStart: sarama.OffsetOldest,
+	NewestOffsetStart: sarama.OffsetNewest,
 }
 
 // StatsdConfig : Type for Statsd Client Configuration.
 type StatsdConfig struct {
+	Addrs          []string
+	Prefix         string
+	Tags           []string
+	MetricTemplate string
+	Format         string
+	Rate           int
+	FlushInterval  time.Duration
+	SampleRate     float32
+}
+
+// Formats of the per partition metrics sent to Statsd.
+const (
+	StatsdFormat    = "statsd"
+	DogStatsdFormat = "dogstatsd"
+)
+
+// FileConfig : Type for the File Reporter Configuration.
+type FileConfig struct {
+	Path    string
+	Format  string
+	MaxSize int64
+}
+
+// PrometheusConfig : Type for the Prometheus Reporter Configuration.
+type PrometheusConfig struct {
+	Addr    string
+	Buckets []int64
+	Tags    []string
+}
+
+// CloudWatchConfig : Type for the CloudWatch Reporter Configuration.
+type CloudWatchConfig struct {
+	Region     string
+	Namespace  string
+	Dimensions []string
+}
+
+// OTLPConfig : Type for the OTLP Reporter Configuration.
+type OTLPConfig struct {
+	Endpoint string
+	Tags     []string
+}
+
+// GraphiteConfig : Type for the Graphite Reporter Configuration.
+type GraphiteConfig struct {
 	Addr   string
 	Prefix string
 }
 
+// WebhookConfig : Type for the Webhook Reporter Configuration.
+type WebhookConfig struct {
+	URL       string
+	Threshold int64
+}
+
+// Granularities at which the lag can be reported.
+const (
+	PartitionGranularity = "partition"
+	TopicGranularity     = "topic"
+	GroupGranularity     = "group"
+)
+
+// ParseGranularity : Parses a comma-separated list of granularities into a
+// set, returning an error for an unknown granularity.
+func ParseGranularity(value string) (map[string]bool, error) {
+	granularity := make(map[string]bool)
+	for _, level := range strings.Split(value, ",") {
+		level = strings.TrimSpace(level)
+		switch level {
+		case PartitionGranularity, TopicGranularity, GroupGranularity:
+			granularity[level] = true
+		default:
+			return nil, fmt.Errorf("Unknown report granularity: %s", level)
+		}
+	}
+	return granularity, nil
+}
+
 // QMConfig : Aggregated type for all configuration required for KQM.
 type QMConfig struct {
-	KafkaCfg  KafkaConfig
-	StatsdCfg StatsdConfig
-	Interval  time.Duration
+	KafkaCfg             KafkaConfig
+	StatsdCfg            StatsdConfig
+	FileCfg              FileConfig
+	PrometheusCfg        PrometheusConfig
+	CloudWatchCfg        CloudWatchConfig
+	OTLPCfg              OTLPConfig
+	GraphiteCfg          GraphiteConfig
+	WebhookCfg           WebhookConfig
+	Interval             time.Duration
+	RetryInterval        time.Duration
+	MaxRetries           int
+	ReconnectBackoff     time.Duration
+	MaxReconnectBackoff  time.Duration
+	EmitAssigned         bool
+	ReportMissing        bool
+	Topics               []string
+	AllowNegativeLag     bool
+	AllowlistURL         string
+	Granularity          map[string]bool
+	GroupFilter          *Filter
+	TopicFilter          *Filter
+	PartitionFilter      *PartitionFilter
+	Thresholds           *Thresholds
+	Rollups              []Rollup
+	RollupOnly           bool
+	PausedAfter          time.Duration
+	MaxBrokerConcurrency int
+	FetchTimeout         time.Duration
+	LagSmoothingAlpha    float64
+	APIAddr              string
+	OffsetsRetention     time.Duration
+	CloseBrokers         bool
+	OpenMetricsTopic     string
+	ReportCoordinators   bool
+	BrokerOffsetMaxAge   time.Duration
+	TimeLag              bool
+	CommitAge            bool
+	PartitionCounts      bool
+	TrackLogStart        bool
+	StaleTimeout         time.Duration
+	DryRun               bool
+	Once                 bool
+	ListGroups           bool
+	OnceTimeout          time.Duration
 }
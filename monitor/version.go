@@ -0,0 +1,39 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// KafkaVersions : Maps the Kafka versions known to sarama to their
+// sarama.KafkaVersion.
+var KafkaVersions = map[string]sarama.KafkaVersion{
+	"0.8.2.0":  sarama.V0_8_2_0,
+	"0.8.2.1":  sarama.V0_8_2_1,
+	"0.8.2.2":  sarama.V0_8_2_2,
+	"0.9.0.0":  sarama.V0_9_0_0,
+	"0.9.0.1":  sarama.V0_9_0_1,
+	"0.10.0.0": sarama.V0_10_0_0,
+	"0.10.0.1": sarama.V0_10_0_1,
+	"0.10.1.0": sarama.V0_10_1_0,
+	"0.10.2.0": sarama.V0_10_2_0,
+}
+
+// ParseKafkaVersion : Parses a Kafka version such as 0.10.2.0, returning an
+// error listing the known versions when it is not one of them.
+func ParseKafkaVersion(version string) (sarama.KafkaVersion, error) {
+	kafkaVersion, ok := KafkaVersions[version]
+	if !ok {
+		known := make([]string, 0, len(KafkaVersions))
+		for name := range KafkaVersions {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return kafkaVersion, fmt.Errorf("Unknown Kafka version: %s. "+
+			"Known versions: %s", version, strings.Join(known, ", "))
+	}
+	return kafkaVersion, nil
+}
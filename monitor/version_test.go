@@ -0,0 +1,27 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKafkaVersion(t *testing.T) {
+	version, err := ParseKafkaVersion("0.10.2.0")
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.V0_10_2_0, version)
+
+	config, err := NewSaramaConfig(&KafkaConfig{Version: version})
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.V0_10_2_0, config.Version)
+
+	_, err = ParseKafkaVersion("0.10")
+	assert.EqualError(t, err, "Unknown Kafka version: 0.10. Known "+
+		"versions: 0.10.0.0, 0.10.0.1, 0.10.1.0, 0.10.2.0, 0.8.2.0, "+
+		"0.8.2.1, 0.8.2.2, 0.9.0.0, 0.9.0.1")
+
+	config, err = NewSaramaConfig(&KafkaConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.NewConfig().Version, config.Version)
+}
@@ -0,0 +1,138 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebhookReporter : Defines a Reporter posting alerts to a webhook when the
+// lag of a group at a partition crosses the threshold. The alerts of a cycle
+// are posted together, as a JSON list. A partition is alerted on once while
+// its lag stays above the threshold, and again only after its lag went back
+// to the threshold or below.
+type WebhookReporter struct {
+	URL        string
+	Threshold  int64
+	HTTPClient *http.Client
+
+	// Partitions alerted on whose lag is still above the threshold, with
+	// the number of cycles since their lag was last seen.
+	alerted map[webhookKey]int
+}
+
+// Number of cycles a partition alerted on can be missing from the lags, as
+// when its broker offset couldn't be fetched, before it is forgotten and
+// alerted on again.
+const webhookForgetCycles = 10
+
+type webhookKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// Payload of the alert posted to the webhook.
+type webhookAlert struct {
+	Group     string `json:"group"`
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Lag       int64  `json:"lag"`
+	Threshold int64  `json:"threshold"`
+	Timestamp string `json:"ts"`
+}
+
+// NewWebhookReporter : Returns a WebhookReporter posting to the URL of the
+// webhook.
+func NewWebhookReporter(cfg WebhookConfig) (*WebhookReporter, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") &&
+		!strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("Invalid alert webhook URL, expected an http "+
+			"or https URL: %s", cfg.URL)
+	}
+	if cfg.Threshold < 0 {
+		return nil, fmt.Errorf("Alert threshold can't be negative")
+	}
+	return &WebhookReporter{
+		URL:        cfg.URL,
+		Threshold:  cfg.Threshold,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		alerted:    make(map[webhookKey]int),
+	}, nil
+}
+
+// Report : Posts the alerts of the partitions whose lag crossed the
+// threshold since the last cycle. Failed alerts are posted again in the
+// next cycle.
+func (r *WebhookReporter) Report(timestamp time.Time, lags []PartitionLag) error {
+	alerted := make(map[webhookKey]int)
+	var alerts []webhookAlert
+	var keys []webhookKey
+	for _, lag := range lags {
+		key := webhookKey{lag.Group, lag.Topic, lag.Partition}
+		if lag.Lag <= r.Threshold {
+			delete(r.alerted, key)
+			continue
+		}
+		if _, ok := r.alerted[key]; ok {
+			alerted[key] = 0
+			delete(r.alerted, key)
+			continue
+		}
+		alerts = append(alerts, webhookAlert{
+			Group:     lag.Group,
+			Topic:     lag.Topic,
+			Partition: lag.Partition,
+			Lag:       lag.Lag,
+			Threshold: r.Threshold,
+			Timestamp: timestamp.UTC().Format(time.RFC3339),
+		})
+		keys = append(keys, key)
+	}
+	// The partitions missing from the lags keep their state for a few
+	// cycles.
+	for key, missing := range r.alerted {
+		if missing+1 < webhookForgetCycles {
+			alerted[key] = missing + 1
+		}
+	}
+	var err error
+	if len(alerts) > 0 {
+		if err = r.post(alerts); err == nil {
+			for _, key := range keys {
+				alerted[key] = 0
+			}
+		}
+	}
+	r.alerted = alerted
+	return err
+}
+
+// Posts the alerts as a JSON list to the webhook.
+func (r *WebhookReporter) post(alerts []webhookAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	response, err := r.HTTPClient.Post(r.URL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Error response from the alert webhook: %s %s",
+			response.Status, message)
+	}
+	return nil
+}
+
+// Close : Nothing to close for the WebhookReporter.
+func (r *WebhookReporter) Close() error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookReporter(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		alerts []webhookAlert
+		posts  int
+		status = http.StatusOK
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			var posted []webhookAlert
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+			mutex.Lock()
+			defer mutex.Unlock()
+			alerts = append(alerts, posted...)
+			posts++
+			w.WriteHeader(status)
+		}))
+	defer receiver.Close()
+	setStatus := func(code int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		status = code
+	}
+	received := func() []webhookAlert {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent := alerts
+		alerts = nil
+		return sent
+	}
+	postCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent := posts
+		posts = 0
+		return sent
+	}
+
+	reporter, err := NewWebhookReporter(WebhookConfig{URL: receiver.URL,
+		Threshold: 100})
+	if !assert.NoError(t, err) {
+		return
+	}
+	timestamp := time.Unix(1508140800, 0)
+	lags := []PartitionLag{
+		{Group: "g1", Topic: "t1", Partition: 0, Lag: 150},
+		{Group: "g1", Topic: "t1", Partition: 1, Lag: 100},
+	}
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Equal(t, []webhookAlert{{Group: "g1", Topic: "t1", Partition: 0,
+		Lag: 150, Threshold: 100, Timestamp: "2017-10-16T08:00:00Z"}},
+		received())
+
+	// The partition above the threshold isn't alerted on again until its
+	// lag goes back to the threshold or below.
+	lags[0].Lag = 200
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Empty(t, received())
+	lags[0].Lag = 50
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Empty(t, received())
+	lags[0].Lag = 120
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Len(t, received(), 1)
+
+	// A failed alert is posted again in the next cycle.
+	lags[1].Lag = 101
+	setStatus(http.StatusInternalServerError)
+	assert.Error(t, reporter.Report(timestamp, lags))
+	assert.Len(t, received(), 1)
+	setStatus(http.StatusOK)
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Equal(t, int32(1), received()[0].Partition)
+
+	// A partition missing from a cycle isn't alerted on again when it is
+	// back, until it has been missing for too many cycles.
+	assert.NoError(t, reporter.Report(timestamp, lags[1:]))
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Empty(t, received())
+	for cycle := 0; cycle < webhookForgetCycles; cycle++ {
+		assert.NoError(t, reporter.Report(timestamp, lags[1:]))
+	}
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Len(t, received(), 1)
+
+	// The alerts of a cycle are posted together.
+	postCount()
+	lags = []PartitionLag{
+		{Group: "g2", Topic: "t1", Partition: 0, Lag: 150},
+		{Group: "g2", Topic: "t1", Partition: 1, Lag: 150},
+		{Group: "g2", Topic: "t2", Partition: 0, Lag: 150},
+	}
+	assert.NoError(t, reporter.Report(timestamp, lags))
+	assert.Len(t, received(), 3)
+	assert.Equal(t, 1, postCount())
+}
+
+func TestNewWebhookReporterInvalid(t *testing.T) {
+	_, err := NewWebhookReporter(WebhookConfig{URL: "localhost:8080"})
+	assert.Error(t, err)
+	_, err = NewWebhookReporter(WebhookConfig{URL: "http://localhost:8080",
+		Threshold: -1})
+	assert.Error(t, err)
+}